@@ -1,15 +1,48 @@
 package main
 
 import (
+	"flag"
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rssb/imbere/pkg/client"
+	"github.com/rssb/imbere/pkg/config"
+	"github.com/rssb/imbere/pkg/constants"
 	"github.com/rssb/imbere/pkg/db"
+	"github.com/rssb/imbere/pkg/deployment_history"
+	"github.com/rssb/imbere/pkg/job_queue"
+	"github.com/rssb/imbere/pkg/logs"
+	"github.com/rssb/imbere/pkg/preview_proxy"
+	"github.com/rssb/imbere/pkg/pull_request"
+	"github.com/rssb/imbere/pkg/reconciler"
+	"github.com/rssb/imbere/pkg/repository_settings"
+	"github.com/rssb/imbere/pkg/scheduler"
+	"github.com/rssb/imbere/pkg/utils"
 	"github.com/rssb/imbere/pkg/webhook"
 )
 
 func main() {
-	db.DbInit() //
+	configPath := flag.String("config", config.DEFAULT_FILE, "path of the configuration file")
+	flag.Parse()
+
+	appConfig, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db.DbInit(appConfig.DatabaseDSN, appConfig.GetSecretKey())
+
+	githubClients := client.NewFactory(appConfig.Github)
+	builds := scheduler.New(appConfig.Concurrency)
+	queue := job_queue.NewJobQueue(constants.JOB_WORKERS, pull_request.NewJobHandler(appConfig, githubClients, builds))
+
+	// bring the PRs back in line with what really runs before jobs start changing them
+	reconciler.NewReconciler(appConfig, githubClients, queue).Start()
+
+	if err := queue.Start(); err != nil {
+		log.Fatal(err)
+	}
 
 	router := gin.Default()
 
@@ -21,7 +54,23 @@ func main() {
 		})
 	})
 
-	r.POST("/github/webhook", webhook.HandleWebhook)
+	r.POST("/github/webhook",
+		webhook.VerifySignature(appConfig.Github.WebhookSecret, appConfig.Github.WebhookPreviousSecret),
+		webhook.HandleWebhook(queue),
+	)
+
+	r.GET("/pull_requests/:pr_id/logs", logs.HandleGetLogs(appConfig.APIToken))
+
+	admin := r.Group("", utils.RequireToken(appConfig.APIToken))
+
+	admin.GET("/github/deliveries/:id", webhook.HandleGetDelivery)
+	admin.GET("/repositories/:owner/:repo/settings", repository_settings.HandleGetSettings)
+	admin.PUT("/repositories/:owner/:repo/settings", repository_settings.HandleUpdateSettings)
+	admin.GET("/pull_requests/:pr_id/deployments", deployment_history.HandleGetDeployments)
+	admin.POST("/pull_requests/:pr_id/rollback", deployment_history.HandleRollback(queue))
+
+	// previews are served on their own subdomains, everything else goes to the api
+	handler := preview_proxy.NewProxy(appConfig.Preview, queue, router)
 
-	router.Run()
+	log.Fatal(http.ListenAndServe(appConfig.ListenAddress, handler))
 }
@@ -5,37 +5,110 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/bradleyfalzon/ghinstallation"
 	"github.com/google/go-github/github"
-	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/config"
 )
 
-type GithubClient struct {
-	client *github.Client
+// GithubClient covers everything imbere does on github, on behalf of an installation of the app
+type GithubClient interface {
+	CreateComment(owner string, repo string, number int64, content string) (*int64, error)
+	EditComment(id int64, owner string, repo string, content string) (*int64, error)
+	CreateCheckRun(owner string, repo string, headBranch string, headSha string, check CheckRun) (*int64, error)
+	UpdateCheckRun(id int64, owner string, repo string, check CheckRun) (*int64, error)
+	CreateStatus(owner string, repo string, sha string, name string, state string, description string, targetURL string) error
+	CreateDeployment(owner string, repo string, ref string, environment string, description string) (*int64, error)
+	CreateDeploymentStatus(id int64, owner string, repo string, state string, description string, environmentURL string, logURL string) error
+	GetPermissionLevel(owner string, repo string, user string) (string, error)
+	CreateCommentReaction(commentID int64, owner string, repo string, content string) error
+	InstallationToken() (string, error)
 }
 
-func NewGithubClient(installationID int64) *GithubClient {
+// Factory gives the client of an installation of the app, it is injected where github is used
+// so that it can be pointed to another api (ie. the fake one of github_fake)
+type Factory func(installationID int64) (GithubClient, error)
+
+type githubClient struct {
+	client       *github.Client
+	installation *ghinstallation.Transport // nil when the client is not authenticated as an installation
+}
+
+// NewFactory gives the clients of the installations of the app configured in githubConfig
+func NewFactory(githubConfig config.GithubConfig) Factory {
+	return func(installationID int64) (GithubClient, error) {
+		return NewGithubClient(githubConfig, installationID)
+	}
+}
+
+func NewGithubClient(githubConfig config.GithubConfig, installationID int64) (GithubClient, error) {
 	// Shared transport to reuse TCP connections.
 	tr := http.DefaultTransport
 
-	// Wrap the shared transport for use with the app ID 1 authenticating with installation ID 99.
-	itr, err := ghinstallation.NewKeyFromFile(tr, constants.GITHUB_APP_ID, installationID, "keys/Imbere2_private_key.pem")
+	privateKey := []byte(githubConfig.PrivateKey)
+	if len(privateKey) == 0 {
+		var err error
+
+		privateKey, err = os.ReadFile(githubConfig.PrivateKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read private key of the github app: %v", err)
+		}
+	}
+
+	// Wrap the shared transport to authenticate as the installation of the app.
+	itr, err := ghinstallation.New(tr, githubConfig.AppID, installationID, privateKey)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("could not authenticate as installation %d: %v", installationID, err)
+	}
+
+	if githubConfig.APIURL != "" {
+		itr.BaseURL = strings.TrimSuffix(githubConfig.APIURL, "/")
 	}
 
 	// Use installation transport with github.com/google/go-github
-	ghClient := github.NewClient(&http.Client{Transport: itr})
+	gc, err := newGithubClient(&http.Client{Transport: itr}, githubConfig.APIURL)
+	if err != nil {
+		return nil, err
+	}
 
-	client := GithubClient{
-		client: ghClient,
+	gc.installation = itr
+
+	return gc, nil
+}
+
+// NewGithubClientWithBaseURL gives a client sending its requests with httpClient to the api at baseURL,
+// github.com when it is empty
+func NewGithubClientWithBaseURL(httpClient *http.Client, baseURL string) (GithubClient, error) {
+	gc, err := newGithubClient(httpClient, baseURL)
+	if err != nil {
+		return nil, err
 	}
 
-	return &client
+	return gc, nil
 }
 
-func (gc *GithubClient) CreateComment(owner string, repo string, number int64, content string) (*int64, error) {
+func newGithubClient(httpClient *http.Client, baseURL string) (*githubClient, error) {
+	ghClient := github.NewClient(httpClient)
+
+	if baseURL != "" {
+		parsedURL, err := url.Parse(strings.TrimSuffix(baseURL, "/") + "/")
+		if err != nil {
+			return nil, fmt.Errorf("invalid github api url %s: %v", baseURL, err)
+		}
+
+		ghClient.BaseURL = parsedURL
+	}
+
+	return &githubClient{
+		client: ghClient,
+	}, nil
+}
+
+func (gc *githubClient) CreateComment(owner string, repo string, number int64, content string) (*int64, error) {
 
 	comment := github.IssueComment{
 		Body: &content,
@@ -55,7 +128,7 @@ func (gc *GithubClient) CreateComment(owner string, repo string, number int64, c
 
 }
 
-func (gc *GithubClient) EditComment(id int64, owner string, repo string, content string) (*int64, error) {
+func (gc *githubClient) EditComment(id int64, owner string, repo string, content string) (*int64, error) {
 
 	comment := github.IssueComment{
 		Body: &content,
@@ -71,3 +144,186 @@ func (gc *GithubClient) EditComment(id int64, owner string, repo string, content
 	return prComment.ID, nil
 
 }
+
+// CheckRun is what is shown about a deployment in the checks of a PR
+type CheckRun struct {
+	Name       string
+	Status     string // queued, in_progress or completed
+	Conclusion string // success or failure, required once completed
+	Title      string
+	Summary    string
+	Text       string
+	DetailsURL string
+}
+
+func (gc *githubClient) CreateCheckRun(owner string, repo string, headBranch string, headSha string, check CheckRun) (*int64, error) {
+	options := github.CreateCheckRunOptions{
+		Name:       check.Name,
+		HeadBranch: headBranch,
+		HeadSHA:    headSha,
+		Status:     &check.Status,
+		DetailsURL: optionalString(check.DetailsURL),
+		Output:     checkRunOutput(check),
+	}
+
+	if check.Status == "completed" {
+		options.Conclusion = &check.Conclusion
+		options.CompletedAt = &github.Timestamp{Time: time.Now()}
+	}
+
+	checkRun, _, err := gc.client.Checks.CreateCheckRun(context.Background(), owner, repo, options)
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not create check run on %s %v", headSha, err)
+	}
+
+	log.Printf("Check run created with ID: %d\n", *checkRun.ID)
+
+	return checkRun.ID, nil
+}
+
+func (gc *githubClient) UpdateCheckRun(id int64, owner string, repo string, check CheckRun) (*int64, error) {
+	options := github.UpdateCheckRunOptions{
+		Name:       check.Name,
+		Status:     &check.Status,
+		DetailsURL: optionalString(check.DetailsURL),
+		Output:     checkRunOutput(check),
+	}
+
+	if check.Status == "completed" {
+		options.Conclusion = &check.Conclusion
+		options.CompletedAt = &github.Timestamp{Time: time.Now()}
+	}
+
+	checkRun, _, err := gc.client.Checks.UpdateCheckRun(context.Background(), owner, repo, id, options)
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not update check run %d %v", id, err)
+	}
+
+	return checkRun.ID, nil
+}
+
+// CreateStatus sets the commit status of a sha, state is one of pending, success, error or failure
+func (gc *githubClient) CreateStatus(owner string, repo string, sha string, name string, state string, description string, targetURL string) error {
+	status := github.RepoStatus{
+		State:       &state,
+		Context:     &name,
+		Description: &description,
+		TargetURL:   optionalString(targetURL),
+	}
+
+	_, _, err := gc.client.Repositories.CreateStatus(context.Background(), owner, repo, sha, &status)
+
+	if err != nil {
+		return fmt.Errorf("Could not create status on %s %v", sha, err)
+	}
+
+	return nil
+}
+
+func checkRunOutput(check CheckRun) *github.CheckRunOutput {
+	return &github.CheckRunOutput{
+		Title:   &check.Title,
+		Summary: &check.Summary,
+		Text:    optionalString(check.Text),
+	}
+}
+
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+
+	return &value
+}
+
+// CreateDeployment creates a deployment of ref on a transient environment, it shows up in the environments of the PR
+func (gc *githubClient) CreateDeployment(owner string, repo string, ref string, environment string, description string) (*int64, error) {
+	autoMerge := false
+	transient := true
+	production := false
+	requiredContexts := []string{} // the deployment is reported by imbere itself, it should not wait for the checks of the commit
+
+	request := github.DeploymentRequest{
+		Ref:                   &ref,
+		AutoMerge:             &autoMerge,
+		RequiredContexts:      &requiredContexts,
+		Environment:           &environment,
+		Description:           &description,
+		TransientEnvironment:  &transient,
+		ProductionEnvironment: &production,
+	}
+
+	deployment, _, err := gc.client.Repositories.CreateDeployment(context.Background(), owner, repo, &request)
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not create deployment of %s %v", ref, err)
+	}
+
+	log.Printf("Deployment created with ID: %d\n", *deployment.ID)
+
+	return deployment.ID, nil
+}
+
+// CreateDeploymentStatus reports the state of a deployment, one of queued, in_progress, success, failure or inactive
+func (gc *githubClient) CreateDeploymentStatus(id int64, owner string, repo string, state string, description string, environmentURL string, logURL string) error {
+	request := github.DeploymentStatusRequest{
+		State:          &state,
+		Description:    &description,
+		EnvironmentURL: optionalString(environmentURL),
+		LogURL:         optionalString(logURL),
+	}
+
+	_, _, err := gc.client.Repositories.CreateDeploymentStatus(context.Background(), owner, repo, id, &request)
+
+	if err != nil {
+		return fmt.Errorf("Could not create status of deployment %d %v", id, err)
+	}
+
+	return nil
+}
+
+// GetPermissionLevel gives the permission of a user on a repository, one of admin, write, read or none
+func (gc *githubClient) GetPermissionLevel(owner string, repo string, user string) (string, error) {
+	permission, _, err := gc.client.Repositories.GetPermissionLevel(context.Background(), owner, repo, user)
+
+	if err != nil {
+		return "", fmt.Errorf("Could not get permission of %s on %s/%s %v", user, owner, repo, err)
+	}
+
+	return permission.GetPermission(), nil
+}
+
+// CreateCommentReaction reacts to a comment of an issue or a PR, content is one of +1, -1, laugh, confused, heart, hooray, rocket or eyes
+func (gc *githubClient) CreateCommentReaction(commentID int64, owner string, repo string, content string) error {
+	// this version of go-github can only list reactions, the request is made by hand
+	path := fmt.Sprintf("repos/%s/%s/issues/comments/%d/reactions", owner, repo, commentID)
+
+	request, err := gc.client.NewRequest("POST", path, map[string]string{"content": content})
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Accept", "application/vnd.github.squirrel-girl-preview+json")
+
+	if _, err := gc.client.Do(context.Background(), request, nil); err != nil {
+		return fmt.Errorf("Could not react to comment %d %v", commentID, err)
+	}
+
+	return nil
+}
+
+// InstallationToken gives a token of the installation, valid for an hour, ie. to clone its private repositories
+func (gc *githubClient) InstallationToken() (string, error) {
+	if gc.installation == nil {
+		return "", fmt.Errorf("the github client is not authenticated as an installation")
+	}
+
+	token, err := gc.installation.Token(context.Background())
+	if err != nil {
+		return "", fmt.Errorf("Could not get installation token %v", err)
+	}
+
+	return token, nil
+}
@@ -0,0 +1,347 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File read when no other one is given, it is optional
+const DEFAULT_FILE = "imbere.yml"
+
+// Defaults of the settings that have one
+const (
+	DEFAULT_BUILD_DIR        = "./builds"
+	DEFAULT_LISTEN_ADDRESS   = ":8080"
+	DEFAULT_DATABASE_DSN     = "./database/imbere.db?_busy_timeout=5000"
+	DEFAULT_GITHUB_APP_ID    = 903361 // IMBERE2 github app
+	DEFAULT_PRIVATE_KEY_PATH = "keys/Imbere2_private_key.pem"
+	DEFAULT_PREVIEW_HOST     = "localhost"
+	DEFAULT_PREVIEW_SCHEME   = "https"
+	DEFAULT_PM2_NAMESPACE    = "IMBERE"
+	DEFAULT_PULL_TIMEOUT     = 10 // minutes
+	DEFAULT_INSTALL_TIMEOUT  = 20 // minutes
+	DEFAULT_BUILD_TIMEOUT    = 20 // minutes
+	DEFAULT_DEPLOY_TIMEOUT   = 10 // minutes
+	DEFAULT_MAX_BUILDS       = 2
+)
+
+type GithubConfig struct {
+	AppID          int64  `yaml:"app_id"`
+	PrivateKeyPath string `yaml:"private_key_path"`
+	PrivateKey     string `yaml:"private_key"` // the pem itself, takes precedence over private_key_path
+	APIURL         string `yaml:"api_url"`     // github.com unless set, ie. for github enterprise
+
+	// secret configured on the github app webhook, the previous one is only accepted while rotating to a new one
+	WebhookSecret         string `yaml:"webhook_secret"`
+	WebhookPreviousSecret string `yaml:"webhook_previous_secret"`
+}
+
+type PreviewConfig struct {
+	// PRs are served on pr-<number>-<repo>-<hash of owner/repo>.<domain> (which must point to imbere, ie. with a wildcard dns record),
+	// without a domain previews are linked with the host and their port
+	Domain string `yaml:"domain"`
+	Scheme string `yaml:"scheme"`
+	Host   string `yaml:"host"` // host the apps listen on
+}
+
+// TimeoutsConfig bounds how long each step of a deployment can run, in minutes.
+// A step that runs longer is killed with everything it started, and reported as timed out on the PR.
+type TimeoutsConfig struct {
+	Pull    int `yaml:"pull"`    // fetching and checking out the commit
+	Install int `yaml:"install"` // the install command of the repository
+	Build   int `yaml:"build"`   // the build command of the repository
+	Deploy  int `yaml:"deploy"`  // starting the app and waiting for its health check
+}
+
+// ConcurrencyConfig limits how many PRs are built at the same time, parallel installs are what exhausts the host.
+// The limits per repository and per installation of the github app are optional (0), builds over a limit wait for their turn.
+// Only builds are limited: rollbacks and waking a sleeping preview start a build that is already there and do not wait.
+type ConcurrencyConfig struct {
+	MaxBuilds                int `yaml:"max_builds"`
+	MaxBuildsPerRepository   int `yaml:"max_builds_per_repository"`
+	MaxBuildsPerInstallation int `yaml:"max_builds_per_installation"`
+}
+
+// Config is everything imbere is run with, read from a yaml file and IMBERE_* environment variables
+//
+//	build_dir: /var/lib/imbere/builds
+//	listen_address: :8080
+//	public_url: https://imbere.example.com
+//	database_dsn: ./database/imbere.db?_busy_timeout=5000
+//	api_token: ...
+//	secret_key: ...
+//	pm2_namespace: IMBERE
+//	github:
+//	  app_id: 903361
+//	  private_key_path: keys/Imbere2_private_key.pem
+//	  webhook_secret: ...
+//	preview:
+//	  domain: preview.example.com
+//	timeouts:
+//	  install: 20
+//	  build: 20
+//	concurrency:
+//	  max_builds: 2
+//	  max_builds_per_repository: 1
+//
+// Environment variables take precedence over the file, see envVars.
+type Config struct {
+	BuildDir      string            `yaml:"build_dir"`      // where PRs are checked out
+	ListenAddress string            `yaml:"listen_address"` // address the api and the previews are served on
+	PublicURL     string            `yaml:"public_url"`     // url imbere is reachable on, used in the links posted on PRs
+	DatabaseDSN   string            `yaml:"database_dsn"`
+	APIToken      string            `yaml:"api_token"`  // required by the management endpoints (ie. repository settings)
+	SecretKey     string            `yaml:"secret_key"` // base64 of 32 random bytes, encrypts the secrets stored in the database (ie. deploy keys)
+	PM2Namespace  string            `yaml:"pm2_namespace"`
+	Github        GithubConfig      `yaml:"github"`
+	Preview       PreviewConfig     `yaml:"preview"`
+	Timeouts      TimeoutsConfig    `yaml:"timeouts"`
+	Concurrency   ConcurrencyConfig `yaml:"concurrency"`
+}
+
+// envVars maps the environment variables to the settings they override
+func (config *Config) envVars() map[string]*string {
+	return map[string]*string{
+		"IMBERE_BUILD_DIR":               &config.BuildDir,
+		"IMBERE_LISTEN_ADDRESS":          &config.ListenAddress,
+		"IMBERE_PUBLIC_URL":              &config.PublicURL,
+		"IMBERE_DATABASE_DSN":            &config.DatabaseDSN,
+		"IMBERE_API_TOKEN":               &config.APIToken,
+		"IMBERE_SECRET_KEY":              &config.SecretKey,
+		"IMBERE_PM2_NAMESPACE":           &config.PM2Namespace,
+		"IMBERE_GITHUB_PRIVATE_KEY_PATH": &config.Github.PrivateKeyPath,
+		"IMBERE_GITHUB_PRIVATE_KEY":      &config.Github.PrivateKey,
+		"IMBERE_GITHUB_API_URL":          &config.Github.APIURL,
+		"IMBERE_WEBHOOK_SECRET":          &config.Github.WebhookSecret,
+		"IMBERE_WEBHOOK_PREVIOUS_SECRET": &config.Github.WebhookPreviousSecret,
+		"IMBERE_PREVIEW_DOMAIN":          &config.Preview.Domain,
+		"IMBERE_PREVIEW_SCHEME":          &config.Preview.Scheme,
+		"IMBERE_PREVIEW_HOST":            &config.Preview.Host,
+	}
+}
+
+// Load reads the configuration from path then from the environment, and validates it.
+// A missing file is only an error when the path was explicitly given (ie. not DEFAULT_FILE).
+func Load(path string) (*Config, error) {
+	config := &Config{}
+
+	if err := config.readFile(path); err != nil {
+		return nil, err
+	}
+
+	if err := config.readEnv(); err != nil {
+		return nil, err
+	}
+
+	config.setDefaults()
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (config *Config) readFile(path string) error {
+	content, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) && path == DEFAULT_FILE {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not read configuration %s: %v", path, err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true) // typos should not be silently ignored
+
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid configuration %s: %v", path, err)
+	}
+
+	return nil
+}
+
+func (config *Config) readEnv() error {
+	for name, setting := range config.envVars() {
+		if value, ok := os.LookupEnv(name); ok {
+			*setting = value
+		}
+	}
+
+	if value, ok := os.LookupEnv("IMBERE_GITHUB_APP_ID"); ok {
+		appID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("IMBERE_GITHUB_APP_ID %q is not a number", value)
+		}
+
+		config.Github.AppID = appID
+	}
+
+	// what hosting platforms usually give, imbere used to only read it
+	if port := os.Getenv("PORT"); port != "" && os.Getenv("IMBERE_LISTEN_ADDRESS") == "" {
+		config.ListenAddress = ":" + port
+	}
+
+	return nil
+}
+
+func (config *Config) setDefaults() {
+	if config.BuildDir == "" {
+		config.BuildDir = DEFAULT_BUILD_DIR
+	}
+
+	if config.ListenAddress == "" {
+		config.ListenAddress = DEFAULT_LISTEN_ADDRESS
+	}
+
+	if config.DatabaseDSN == "" {
+		config.DatabaseDSN = DEFAULT_DATABASE_DSN
+	}
+
+	if config.PM2Namespace == "" {
+		config.PM2Namespace = DEFAULT_PM2_NAMESPACE
+	}
+
+	if config.Github.AppID == 0 {
+		config.Github.AppID = DEFAULT_GITHUB_APP_ID
+	}
+
+	if config.Github.PrivateKey == "" && config.Github.PrivateKeyPath == "" {
+		config.Github.PrivateKeyPath = DEFAULT_PRIVATE_KEY_PATH
+	}
+
+	if config.Preview.Scheme == "" {
+		config.Preview.Scheme = DEFAULT_PREVIEW_SCHEME
+	}
+
+	if config.Preview.Host == "" {
+		config.Preview.Host = DEFAULT_PREVIEW_HOST
+	}
+
+	if config.Timeouts.Pull == 0 {
+		config.Timeouts.Pull = DEFAULT_PULL_TIMEOUT
+	}
+
+	if config.Timeouts.Install == 0 {
+		config.Timeouts.Install = DEFAULT_INSTALL_TIMEOUT
+	}
+
+	if config.Timeouts.Build == 0 {
+		config.Timeouts.Build = DEFAULT_BUILD_TIMEOUT
+	}
+
+	if config.Timeouts.Deploy == 0 {
+		config.Timeouts.Deploy = DEFAULT_DEPLOY_TIMEOUT
+	}
+
+	if config.Concurrency.MaxBuilds == 0 {
+		config.Concurrency.MaxBuilds = DEFAULT_MAX_BUILDS
+	}
+
+	config.PublicURL = strings.TrimSuffix(config.PublicURL, "/")
+	config.Preview.Domain = strings.ToLower(config.Preview.Domain)
+}
+
+// Validate checks every setting, all the problems are reported at once
+func (config *Config) Validate() error {
+	problems := []string{}
+
+	if absolute, err := filepath.Abs(config.BuildDir); err != nil {
+		problems = append(problems, fmt.Sprintf("build_dir %q is not a valid path", config.BuildDir))
+	} else {
+		config.BuildDir = absolute
+	}
+
+	if config.Github.AppID <= 0 {
+		problems = append(problems, "github.app_id must be a positive number")
+	}
+
+	if config.Github.PrivateKey == "" {
+		if _, err := os.Stat(config.Github.PrivateKeyPath); err != nil {
+			problems = append(problems, fmt.Sprintf("github.private_key_path %q can not be read: %v", config.Github.PrivateKeyPath, err))
+		}
+	}
+
+	if config.Github.WebhookSecret == "" {
+		problems = append(problems, "github.webhook_secret is required, github deliveries can not be verified without it")
+	}
+
+	if config.Github.APIURL != "" && !isURL(config.Github.APIURL) {
+		problems = append(problems, fmt.Sprintf("github.api_url %q must be an http(s) url", config.Github.APIURL))
+	}
+
+	if config.PublicURL != "" && !isURL(config.PublicURL) {
+		problems = append(problems, fmt.Sprintf("public_url %q must be an http(s) url", config.PublicURL))
+	}
+
+	if config.Preview.Scheme != "http" && config.Preview.Scheme != "https" {
+		problems = append(problems, fmt.Sprintf("preview.scheme %q must be http or https", config.Preview.Scheme))
+	}
+
+	if strings.Contains(config.Preview.Domain, "/") || strings.Contains(config.Preview.Domain, ":") {
+		problems = append(problems, fmt.Sprintf("preview.domain %q must be a domain name, without scheme or port", config.Preview.Domain))
+	}
+
+	if config.SecretKey != "" && len(config.GetSecretKey()) != 32 {
+		problems = append(problems, "secret_key must be the base64 of 32 bytes, ie. the output of `openssl rand -base64 32`")
+	}
+
+	if config.ListenAddress != "" && !strings.Contains(config.ListenAddress, ":") {
+		problems = append(problems, fmt.Sprintf("listen_address %q must be host:port or :port", config.ListenAddress))
+	}
+
+	timeouts := map[string]int{
+		"pull":    config.Timeouts.Pull,
+		"install": config.Timeouts.Install,
+		"build":   config.Timeouts.Build,
+		"deploy":  config.Timeouts.Deploy,
+	}
+
+	for _, step := range []string{"pull", "install", "build", "deploy"} {
+		if timeouts[step] < 0 {
+			problems = append(problems, fmt.Sprintf("timeouts.%s must be a positive number of minutes", step))
+		}
+	}
+
+	if config.Concurrency.MaxBuilds < 0 || config.Concurrency.MaxBuildsPerRepository < 0 || config.Concurrency.MaxBuildsPerInstallation < 0 {
+		problems = append(problems, "concurrency limits must be positive numbers")
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("invalid configuration:\n- %s", strings.Join(problems, "\n- "))
+}
+
+// GetSecretKey gives the key the secrets stored in the database are encrypted with, nil when none is configured
+func (config *Config) GetSecretKey() []byte {
+	if config.SecretKey == "" {
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(config.SecretKey)
+	if err != nil {
+		return nil
+	}
+
+	return key
+}
+
+func isURL(value string) bool {
+	parsed, err := url.Parse(value)
+
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// clearEnv unsets every variable imbere reads, the ones of the host running the tests must not leak in
+func clearEnv(t *testing.T) {
+	t.Helper()
+
+	names := []string{"IMBERE_GITHUB_APP_ID", "PORT"}
+	for name := range (&Config{}).envVars() {
+		names = append(names, name)
+	}
+
+	for _, name := range names {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
+
+// writeConfig writes the yaml file of the configuration, it gives its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "imbere.yml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	clearEnv(t)
+
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	path := writeConfig(t, `
+github:
+  private_key: pem
+  webhook_secret: from-file
+secret_key: `+key+`
+preview:
+  domain: Preview.Example.com
+`)
+
+	t.Setenv("IMBERE_WEBHOOK_SECRET", "from-env")
+
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Github.WebhookSecret != "from-env" {
+		t.Errorf("webhook secret = %q, want the environment to take precedence over the file", config.Github.WebhookSecret)
+	}
+
+	if len(config.GetSecretKey()) != 32 {
+		t.Errorf("GetSecretKey() gave %d bytes, want 32", len(config.GetSecretKey()))
+	}
+
+	if config.Preview.Domain != "preview.example.com" || config.Timeouts.Build != DEFAULT_BUILD_TIMEOUT || !filepath.IsAbs(config.BuildDir) {
+		t.Errorf("defaults were not applied: domain %q, build timeout %d, build dir %q", config.Preview.Domain, config.Timeouts.Build, config.BuildDir)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		problem string // part of the error, "" when the configuration is valid
+	}{
+		{
+			name: "valid",
+			env:  map[string]string{"IMBERE_WEBHOOK_SECRET": "secret"},
+		},
+		{
+			name:    "no webhook secret",
+			problem: "github.webhook_secret is required",
+		},
+		{
+			name:    "secret key too short",
+			env:     map[string]string{"IMBERE_WEBHOOK_SECRET": "secret", "IMBERE_SECRET_KEY": base64.StdEncoding.EncodeToString(make([]byte, 16))},
+			problem: "secret_key must be the base64 of 32 bytes",
+		},
+		{
+			name:    "secret key not base64",
+			env:     map[string]string{"IMBERE_WEBHOOK_SECRET": "secret", "IMBERE_SECRET_KEY": "not base64!"},
+			problem: "secret_key must be the base64 of 32 bytes",
+		},
+		{
+			name:    "unknown private key",
+			env:     map[string]string{"IMBERE_WEBHOOK_SECRET": "secret", "IMBERE_GITHUB_PRIVATE_KEY": "", "IMBERE_GITHUB_PRIVATE_KEY_PATH": "/nowhere/key.pem"},
+			problem: "github.private_key_path",
+		},
+		{
+			name:    "typo in the file",
+			file:    "github:\n  webhook_secert: secret\n",
+			problem: "webhook_secert",
+		},
+		{
+			name:    "app id that is not a number",
+			env:     map[string]string{"IMBERE_WEBHOOK_SECRET": "secret", "IMBERE_GITHUB_APP_ID": "imbere"},
+			problem: "IMBERE_GITHUB_APP_ID",
+		},
+		{
+			name:    "preview domain with a scheme",
+			env:     map[string]string{"IMBERE_WEBHOOK_SECRET": "secret", "IMBERE_PREVIEW_DOMAIN": "https://preview.example.com"},
+			problem: "preview.domain",
+		},
+		{
+			name:    "every problem at once",
+			env:     map[string]string{"IMBERE_PREVIEW_SCHEME": "ftp", "IMBERE_PUBLIC_URL": "imbere.example.com"},
+			problem: "github.webhook_secret is required, github deliveries can not be verified without it\n- public_url",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearEnv(t)
+
+			t.Setenv("IMBERE_GITHUB_PRIVATE_KEY", "pem")
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			_, err := Load(writeConfig(t, test.file))
+
+			if test.problem == "" {
+				if err != nil {
+					t.Errorf("Load() = %v, want the configuration accepted", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.problem) {
+				t.Errorf("Load() = %v, want it to report %q", err, test.problem)
+			}
+		})
+	}
+}
@@ -1,17 +1,37 @@
 package constants
 
-const MAIN_DIR = "/Users/claranceliberi/projects/rssb/imbere/"
-const BUILD_DIR = MAIN_DIR + "builds/"
+// Runtimes a repository can be deployed with, see deployment.Deployer
+const (
+	DEPLOYER_PM2     = "pm2"
+	DEPLOYER_DOCKER  = "docker"
+	DEPLOYER_PROCESS = "process"
+)
+
+const DEFAULT_DEPLOYER = DEPLOYER_PM2
+
+// How repositories are cloned, see credentials.ForPR
+const (
+	CLONE_AUTH_TOKEN = "token" // over https with an installation token of the github app
+	CLONE_AUTH_SSH   = "ssh"   // over ssh with the deploy key of the repository
+	CLONE_AUTH_NONE  = "none"  // over https without credentials, public repositories only
+)
+
+const DEFAULT_CLONE_AUTH = CLONE_AUTH_TOKEN
+
+// What is done with PRs from forks, their code is not trusted
+const (
+	FORK_POLICY_NEVER   = "never"   // they are never deployed
+	FORK_POLICY_LABEL   = "label"   // each of their commits is deployed once a maintainer labels (or asks for) it
+	FORK_POLICY_SANDBOX = "sandbox" // they are built and run in a container, without the variables of the imbere host
+)
 
-const PM2_NAMESPACE = "IMBERE"
+const DEFAULT_FORK_POLICY = FORK_POLICY_NEVER
 
 // This is the label text that will be added to github PR if they want it to be deployed
 const DEPLOYMENT_LABEL = "IMBERE_DEPLOY"
 
-// IMBERE2 github app id
-const GITHUB_APP_ID = 903361
-
-const IP_ADDRESS = "localhost"
+// Name of the check run (or commit status) reporting the deployment of a PR, it can be made required in branch protection
+const CHECK_RUN_NAME = "Imbere preview"
 
 type ProcessProgress int
 
@@ -25,6 +45,11 @@ const (
 	PROCESS_PROGRESS_DEPLOYING
 	PROCESS_PROGRESS_COMPLETED
 	PROCESS_PROGRESS_UN_DEPLOYING
+	// new steps are added at the end to keep the values already stored,
+	// their position in the pipeline is given by utils.PROGRESS_STEPS
+	PROCESS_PROGRESS_LOADING_CONFIG
+	PROCESS_PROGRESS_SLEEPING  // the app was stopped after being idle, it is started again on the next request
+	PROCESS_PROGRESS_VERIFYING // the app was started, imbere waits for its health check to pass
 )
 
 type ProcessOutcome int
@@ -34,13 +59,100 @@ const (
 	PROCESS_OUTCOME_ONGOING
 	PROCESS_OUTCOME_SUCCEEDED
 	PROCESS_OUTCOME_FAILED
+	PROCESS_OUTCOME_TIMED_OUT // the step ran longer than its timeout, see config.TimeoutsConfig
+	PROCESS_OUTCOME_CANCELLED // the deployment was stopped before it finished (ie. superseded by a newer push)
+)
+
+// Where a log line of a deployment comes from
+type LogStream string
+
+const (
+	LOG_STREAM_STDOUT LogStream = "stdout"
+	LOG_STREAM_STDERR LogStream = "stderr"
+	LOG_STREAM_IMBERE LogStream = "imbere" // messages from imbere itself about the deployment
+)
+
+// Logs are kept for the last LOG_RETENTION_ATTEMPTS deployments of every PR, and never longer than LOG_RETENTION_DAYS
+const LOG_RETENTION_ATTEMPTS = 5
+const LOG_RETENTION_DAYS = 14
+
+// how long the link to the logs of an attempt posted on the PR works, anyone who can read the PR can follow it
+const LOGS_LINK_TTL_HOURS = 24
+
+// how many builds of a PR are kept, the one the preview runs included, the others can be rolled back to
+const KEPT_BUILDS = 3
+
+// how many of the last log lines are shown on the PR comment when a deployment fails
+const FAILED_COMMENT_LOG_LINES = 30
+
+// Status of a queued webhook event, see job_queue
+type JobStatus int
+
+const (
+	JOB_STATUS_QUEUED JobStatus = iota
+	JOB_STATUS_RUNNING
+	JOB_STATUS_SUCCEEDED
+	JOB_STATUS_FAILED
+	JOB_STATUS_CANCELLED // dropped before it ran, see OUTDATED_BY_PUSH_EVENT_ACTIONS
+)
+
+// What happened to a webhook delivery, used to answer redeliveries with the original result
+type DeliveryOutcome int
+
+const (
+	DELIVERY_OUTCOME_IGNORED DeliveryOutcome = iota
+	DELIVERY_OUTCOME_QUEUED
+	DELIVERY_OUTCOME_SUCCEEDED
+	DELIVERY_OUTCOME_FAILED
+	DELIVERY_OUTCOME_CANCELLED
+)
+
+// how often the state of the PRs is reconciled with what really runs, see reconciler
+const RECONCILE_INTERVAL_MINUTES = 5
+
+// deployments wait for a build slot in their worker (see config.ConcurrencyConfig),
+// there are more workers than builds so that the events of other PRs (ie. closing one) are not stuck behind them
+const JOB_WORKERS = 8
+
+// how many times a job interrupted by a restart is picked up again before it is marked as failed
+const MAX_JOB_ATTEMPTS = 3
+
+// Events imbere queues itself, their action is one of INTERNAL_ACTION_*
+const INTERNAL_EVENT = "imbere"
+
+const (
+	INTERNAL_ACTION_WAKE     = "wake"
+	INTERNAL_ACTION_SLEEP    = "sleep"
+	INTERNAL_ACTION_ROLLBACK = "rollback" // the job payload is the commit to roll back to, see pull_request.PullRequestService.Rollback
+)
+
+// Comments on a PR starting with it are commands to imbere, ie. /imbere wake
+const COMMAND_PREFIX = "/imbere"
+
+const (
+	COMMAND_DEPLOY   = "deploy"
+	COMMAND_REDEPLOY = "redeploy"
+	COMMAND_STOP     = "stop"
+	COMMAND_WAKE     = INTERNAL_ACTION_WAKE
+	COMMAND_ROLLBACK = INTERNAL_ACTION_ROLLBACK
+	COMMAND_LOGS     = "logs"
+	COMMAND_STATUS   = "status"
 )
 
 var ALLOWED_EVENT_ACTIONS = map[string]bool{
-	"workflow_run.completed": true,
-	"pull_request.closed":    true,
-	"pull_request.opened":    true,
-	"pull_request.reopened":  true,
-	"pull_request.labeled":   true,
-	"pull_request.unlabeled": true,
+	"workflow_run.completed":   true,
+	"pull_request.closed":      true,
+	"pull_request.opened":      true,
+	"pull_request.reopened":    true,
+	"pull_request.labeled":     true,
+	"pull_request.unlabeled":   true,
+	"pull_request.synchronize": true,
+	"pull_request.edited":      true,
+	"issue_comment.created":    true, // only comments with a command are handled
+}
+
+// Events that only deploy the commit they are about, the ones still queued are dropped once a newer commit is pushed to the PR
+var OUTDATED_BY_PUSH_EVENT_ACTIONS = map[string]bool{
+	"pull_request.synchronize": true,
+	"workflow_run.completed":   true,
 }
@@ -0,0 +1,129 @@
+package credentials
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/rssb/imbere/pkg/client"
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+)
+
+// variable the installation token is given to git in, the credential helper reads it from there
+// so that the token is neither in the arguments of git nor in the configuration of the clone
+const tokenEnv = "IMBERE_GIT_TOKEN"
+
+// credentialHelper answers git with the installation token, only for "get" requests
+const credentialHelper = `!f() { test "$1" = get && echo username=x-access-token && echo "password=$` + tokenEnv + `"; }; f`
+
+// Credentials is what git needs to reach a repository, they are only valid for the commands of a deployment
+// and must be closed once it is done with them.
+//
+//	creds, err := credentials.ForPR(pr, settings, githubClient)
+//	defer creds.Close()
+//	cmd := creds.Command(ctx, "clone", creds.URL, dir)
+type Credentials struct {
+	URL  string   // address of the repository
+	args []string // configuration given to git for the command only
+	env  []string
+	key  string // file the deploy key was written to, outside of the clone
+}
+
+// ForPR gives the credentials to clone the repository of the PR with, as configured in its settings
+func ForPR(pr *db.PullRequest, settings *db.RepositorySettings, githubClient client.GithubClient) (*Credentials, error) {
+	credentials := &Credentials{
+		// git must fail instead of waiting for someone to type a password
+		env: []string{"GIT_TERMINAL_PROMPT=0"},
+	}
+
+	switch settings.GetCloneAuth() {
+	case constants.CLONE_AUTH_NONE:
+		credentials.URL = pr.RepoAddress
+	case constants.CLONE_AUTH_TOKEN:
+		token, err := githubClient.InstallationToken()
+		if err != nil {
+			return nil, err
+		}
+
+		credentials.URL = pr.RepoAddress
+		// the helpers configured on the host are reset first, they could store the token
+		credentials.args = []string{"-c", "credential.helper=", "-c", "credential.helper=" + credentialHelper}
+		credentials.env = append(credentials.env, tokenEnv+"="+token)
+	case constants.CLONE_AUTH_SSH:
+		if settings.DeployKey == "" {
+			return nil, fmt.Errorf("%s/%s is cloned over ssh but has no deploy key", pr.OwnerName, pr.RepoName)
+		}
+
+		key, err := writeKey(settings.DeployKey)
+		if err != nil {
+			return nil, err
+		}
+
+		credentials.URL = pr.SSHAddress
+		credentials.key = key
+		credentials.env = append(credentials.env,
+			fmt.Sprintf("GIT_SSH_COMMAND=ssh -i '%s' -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new -F /dev/null", key),
+		)
+	default:
+		return nil, fmt.Errorf("unknown clone auth %q for %s/%s", settings.CloneAuth, pr.OwnerName, pr.RepoName)
+	}
+
+	return credentials, nil
+}
+
+// Command gives a git command authenticated with the credentials
+func (credentials *Credentials) Command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "git", append(append([]string{}, credentials.args...), args...)...)
+	cmd.Env = append(os.Environ(), credentials.env...)
+
+	return cmd
+}
+
+// Close removes what was written for the credentials, ie. the deploy key
+func (credentials *Credentials) Close() {
+	if credentials.key != "" {
+		os.Remove(credentials.key)
+		credentials.key = ""
+	}
+}
+
+// writeKey writes the deploy key to a file only imbere can read, ssh does not take keys from the environment
+func writeKey(deployKey string) (string, error) {
+	file, err := os.CreateTemp("", "imbere-deploy-key-*")
+	if err != nil {
+		return "", fmt.Errorf("could not write deploy key: %v", err)
+	}
+	defer file.Close()
+
+	if !strings.HasSuffix(deployKey, "\n") {
+		deployKey += "\n" // ssh rejects keys without the final new line
+	}
+
+	if _, err := file.WriteString(deployKey); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("could not write deploy key: %v", err)
+	}
+
+	return file.Name(), nil
+}
+
+// IsValidCloneAuth tells if repositories can be cloned with the method, see constants.CLONE_AUTH_*
+func IsValidCloneAuth(method string) bool {
+	switch method {
+	case constants.CLONE_AUTH_TOKEN, constants.CLONE_AUTH_SSH, constants.CLONE_AUTH_NONE:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsValidDeployKey tells if the key looks like a private ssh key (pem or openssh format)
+func IsValidDeployKey(deployKey string) bool {
+	block, _ := pem.Decode([]byte(strings.TrimSpace(deployKey)))
+
+	return block != nil && strings.HasSuffix(block.Type, "PRIVATE KEY")
+}
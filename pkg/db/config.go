@@ -1,27 +1,56 @@
 package db
 
 import (
+	"sync"
+
 	_ "github.com/mattn/go-sqlite3"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-const file string = "./database/imbere.db"
+var (
+	con     *gorm.DB
+	conOnce sync.Once
+	dsn     string // set by DbInit, see config.Config.DatabaseDSN
+)
 
+// dbCon opens the database once and shares the connection between every repo,
+// jobs are processed by several workers at the same time and sqlite only allows a single writer
+// so we keep one open connection and let it serialize them.
 func dbCon() *gorm.DB {
-	db, err := gorm.Open(sqlite.Open(file), &gorm.Config{})
+	conOnce.Do(func() {
+		db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
 
-	if err != nil {
-		panic(err)
-	}
+		if err != nil {
+			panic(err)
+		}
+
+		sqlDB, err := db.DB()
+		if err != nil {
+			panic(err)
+		}
+		sqlDB.SetMaxOpenConns(1)
 
-	return db
+		con = db
+	})
+
+	return con
 }
 
 // Check database connection
 // and Create tables in db;
-func DbInit() {
+// key encrypts the secrets stored in the database (see config.Config.SecretKey), secrets that were stored in clear are encrypted with it.
+func DbInit(databaseDSN string, key []byte) {
+	dsn = databaseDSN
+	secretKey = key
 	db := dbCon()
 
-	db.AutoMigrate(&PullRequest{})
+	db.AutoMigrate(&PullRequest{}, &Job{}, &Delivery{}, &RepositorySettings{}, &LogLine{}, &Deployment{}, &DeploymentStep{})
+
+	if secretKey != nil {
+		settingsRepo := RepositorySettingsRepo{}
+		if err := settingsRepo.encryptDeployKeys(); err != nil {
+			panic(err)
+		}
+	}
 }
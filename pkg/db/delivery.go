@@ -0,0 +1,96 @@
+package db
+
+import (
+	"github.com/rssb/imbere/pkg/constants"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type DeliveryRepo struct {
+	db *gorm.DB
+}
+
+// Delivery records a webhook delivery by its X-GitHub-Delivery id, github redelivers
+// the same id on timeouts (or when asked to from the app settings), so we use it to process every event only once.
+type Delivery struct {
+	gorm.Model
+	DeliveryID  string                    `gorm:"type:text;not null;uniqueIndex"`
+	EventName   string                    `gorm:"type:text;not null"`
+	EventAction string                    `gorm:"type:text;not null"`
+	PrID        int64                     `gorm:"type:bigint;not null;default:0"`
+	JobID       uint                      `gorm:"not null;default:0"`
+	Outcome     constants.DeliveryOutcome `gorm:"type:int;not null;default:0"`
+	Message     string                    `gorm:"type:text"`
+}
+
+func (repo *DeliveryRepo) prepareDbConnection() {
+	repo.db = dbCon()
+}
+
+// Record stores the delivery unless one with the same id was already recorded,
+// in which case the existing record is returned alongside false.
+func (repo *DeliveryRepo) Record(delivery *Delivery) (*Delivery, bool, error) {
+	repo.prepareDbConnection()
+
+	result := repo.db.Clauses(clause.OnConflict{DoNothing: true}).Create(delivery)
+
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+
+	if result.RowsAffected == 1 {
+		return delivery, true, nil
+	}
+
+	existing, err := repo.GetByDeliveryID(delivery.DeliveryID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return existing, false, nil
+}
+
+func (repo *DeliveryRepo) GetByDeliveryID(deliveryId string) (*Delivery, error) {
+	repo.prepareDbConnection()
+
+	var delivery Delivery
+
+	result := repo.db.Where(&Delivery{DeliveryID: deliveryId}).First(&delivery)
+
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+
+		return nil, result.Error
+	}
+
+	return &delivery, nil
+}
+
+func (repo *DeliveryRepo) SetJob(delivery *Delivery, jobId uint) error {
+	repo.prepareDbConnection()
+
+	delivery.JobID = jobId
+
+	return repo.db.Model(delivery).Update("JobID", jobId).Error
+}
+
+func (repo *DeliveryRepo) SetOutcome(deliveryId string, outcome constants.DeliveryOutcome, message string) error {
+	repo.prepareDbConnection()
+
+	result := repo.db.Model(&Delivery{}).Where(&Delivery{DeliveryID: deliveryId}).Updates(map[string]interface{}{
+		"Outcome": outcome,
+		"Message": message,
+	})
+
+	return result.Error
+}
+
+// Forget removes the delivery, so that a redelivery is processed again
+// (ie. when we could not even queue it).
+func (repo *DeliveryRepo) Forget(delivery *Delivery) error {
+	repo.prepareDbConnection()
+
+	return repo.db.Unscoped().Delete(delivery).Error
+}
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"time"
+
+	"github.com/rssb/imbere/pkg/constants"
+	"gorm.io/gorm"
+)
+
+type DeploymentRepo struct {
+	db *gorm.DB
+}
+
+// Deployment is one attempt at deploying a PR, PullRequest only knows about the current state
+type Deployment struct {
+	gorm.Model
+	PullRequestID      uint      `gorm:"not null;index"`
+	PrID               int64     `gorm:"type:bigint;not null;index"`
+	Attempt            int64     `gorm:"type:bigint;not null"`           // see PullRequest.Attempts, logs are stored under it
+	Slot               int64     `gorm:"type:bigint;not null;default:0"` // build that was deployed, the one of the attempt unless it was a rollback
+	HeadSHA            string    `gorm:"type:text"`
+	TriggerEvent       string    `gorm:"type:text;not null"` // event that started the deployment, ie. workflow_run.completed
+	StartedAt          time.Time `gorm:"not null"`
+	FinishedAt         *time.Time
+	Outcome            constants.ProcessOutcome `gorm:"type:int;not null;default:0"`
+	FailureReason      string                   `gorm:"type:text"`
+	Port               int32                    `gorm:"type:bigint"`
+	GithubDeploymentID int64                    `gorm:"type:bigint"` // deployment shown in the environments of the PR
+	CheckRunID         int64                    `gorm:"type:bigint"` // check run reporting the deployment on the head sha, 0 when commit statuses are used instead
+	Steps              []DeploymentStep
+}
+
+// DeploymentStep is the timing and outcome of a step of a deployment
+type DeploymentStep struct {
+	gorm.Model
+	DeploymentID uint                      `gorm:"not null;index"`
+	Step         constants.ProcessProgress `gorm:"type:int;not null"`
+	StartedAt    time.Time                 `gorm:"not null"`
+	FinishedAt   *time.Time
+	Outcome      constants.ProcessOutcome `gorm:"type:int;not null;default:0"`
+}
+
+// GetSlot gives the build the deployment runs, see PullRequest.GetSlotDir
+func (deployment *Deployment) GetSlot() int64 {
+	if deployment.Slot == 0 {
+		return deployment.Attempt // recorded before rollbacks existed
+	}
+
+	return deployment.Slot
+}
+
+func (deployment *Deployment) Duration() time.Duration {
+	if deployment.FinishedAt == nil {
+		return time.Since(deployment.StartedAt)
+	}
+
+	return deployment.FinishedAt.Sub(deployment.StartedAt)
+}
+
+func (repo *DeploymentRepo) prepareDbConnection() {
+	repo.db = dbCon()
+}
+
+func (repo *DeploymentRepo) Create(deployment *Deployment) error {
+	repo.prepareDbConnection()
+
+	deployment.StartedAt = time.Now()
+	deployment.Outcome = constants.PROCESS_OUTCOME_ONGOING
+
+	return repo.db.Create(deployment).Error
+}
+
+// RecordStep keeps track of the progress of a step, it is started the first time it is recorded
+// and finished once it is recorded with an outcome other than ongoing.
+func (repo *DeploymentRepo) RecordStep(deployment *Deployment, step constants.ProcessProgress, outcome constants.ProcessOutcome) error {
+	repo.prepareDbConnection()
+
+	var deploymentStep DeploymentStep
+
+	result := repo.db.Where("deployment_id = ? AND step = ?", deployment.ID, step).Limit(1).Find(&deploymentStep)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	now := time.Now()
+
+	if result.RowsAffected == 0 {
+		deploymentStep = DeploymentStep{
+			DeploymentID: deployment.ID,
+			Step:         step,
+			StartedAt:    now,
+		}
+	}
+
+	deploymentStep.Outcome = outcome
+	if outcome != constants.PROCESS_OUTCOME_ONGOING && outcome != constants.PROCESS_OUTCOME_NOT_YET {
+		deploymentStep.FinishedAt = &now
+	}
+
+	return repo.db.Save(&deploymentStep).Error
+}
+
+func (repo *DeploymentRepo) SetPort(deployment *Deployment, port int32) error {
+	repo.prepareDbConnection()
+
+	deployment.Port = port
+
+	return repo.db.Model(deployment).Update("Port", port).Error
+}
+
+func (repo *DeploymentRepo) SetCheckRun(deployment *Deployment, checkRunID int64) error {
+	repo.prepareDbConnection()
+
+	deployment.CheckRunID = checkRunID
+
+	return repo.db.Model(deployment).Update("CheckRunID", checkRunID).Error
+}
+
+func (repo *DeploymentRepo) SetGithubDeployment(deployment *Deployment, githubDeploymentID int64) error {
+	repo.prepareDbConnection()
+
+	deployment.GithubDeploymentID = githubDeploymentID
+
+	return repo.db.Model(deployment).Update("GithubDeploymentID", githubDeploymentID).Error
+}
+
+// Finish records the final outcome of the deployment, with the reason it failed if it did
+func (repo *DeploymentRepo) Finish(deployment *Deployment, outcome constants.ProcessOutcome, failureReason string) error {
+	repo.prepareDbConnection()
+
+	now := time.Now()
+	deployment.FinishedAt = &now
+	deployment.Outcome = outcome
+	deployment.FailureReason = failureReason
+
+	return repo.db.Model(deployment).Updates(map[string]interface{}{
+		"FinishedAt":    deployment.FinishedAt,
+		"Outcome":       deployment.Outcome,
+		"FailureReason": deployment.FailureReason,
+	}).Error
+}
+
+// ListByPrID gives the deployments of a PR with their steps, latest first
+func (repo *DeploymentRepo) ListByPrID(prId int64, limit int) ([]Deployment, error) {
+	repo.prepareDbConnection()
+
+	var deployments []Deployment
+
+	result := repo.db.Preload("Steps", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Where(&Deployment{PrID: prId}).Order("attempt desc").Limit(limit).Find(&deployments)
+
+	return deployments, result.Error
+}
+
+// GetLatest gives the last deployment of a PR, or nil if it was never deployed
+func (repo *DeploymentRepo) GetLatest(prId int64) (*Deployment, error) {
+	deployments, err := repo.ListByPrID(prId, 1)
+	if err != nil || len(deployments) == 0 {
+		return nil, err
+	}
+
+	return &deployments[0], nil
+}
+
+// GetOngoing gives the deployments that did not finish, with their steps
+func (repo *DeploymentRepo) GetOngoing() ([]Deployment, error) {
+	repo.prepareDbConnection()
+
+	var deployments []Deployment
+
+	result := repo.db.Preload("Steps", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Where(&Deployment{Outcome: constants.PROCESS_OUTCOME_ONGOING}).Find(&deployments)
+
+	return deployments, result.Error
+}
+
+// GetLatestSucceeded gives the last deployment of a PR that went through, or nil if none did
+func (repo *DeploymentRepo) GetLatestSucceeded(prId int64) (*Deployment, error) {
+	repo.prepareDbConnection()
+
+	var deployments []Deployment
+
+	result := repo.db.Where(&Deployment{PrID: prId, Outcome: constants.PROCESS_OUTCOME_SUCCEEDED}).Order("attempt desc").Limit(1).Find(&deployments)
+	if result.Error != nil || len(deployments) == 0 {
+		return nil, result.Error
+	}
+
+	return &deployments[0], nil
+}
+
+// ListSucceeded gives the deployments of a PR that went through, latest first
+func (repo *DeploymentRepo) ListSucceeded(prId int64) ([]Deployment, error) {
+	repo.prepareDbConnection()
+
+	var deployments []Deployment
+
+	result := repo.db.Where(&Deployment{PrID: prId, Outcome: constants.PROCESS_OUTCOME_SUCCEEDED}).Order("attempt desc").Find(&deployments)
+
+	return deployments, result.Error
+}
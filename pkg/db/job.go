@@ -0,0 +1,178 @@
+package db
+
+import (
+	"time"
+
+	"github.com/rssb/imbere/pkg/constants"
+	"gorm.io/gorm"
+)
+
+type JobRepo struct {
+	db *gorm.DB
+}
+
+// Job is a webhook event waiting to be (or being) processed by the job queue.
+// The raw payload is kept so that the event can be handled again after a restart.
+type Job struct {
+	gorm.Model
+	PrID        int64               `gorm:"type:bigint;not null;index"`
+	DeliveryID  string              `gorm:"type:text"` // X-GitHub-Delivery of the webhook that queued the job
+	HeadSHA     string              `gorm:"type:text"` // commit the event is about, if any
+	EventName   string              `gorm:"type:text;not null"`
+	EventAction string              `gorm:"type:text;not null"`
+	Payload     string              `gorm:"type:text;not null"`
+	Status      constants.JobStatus `gorm:"type:int;not null;default:0;index"`
+	Attempts    int32               `gorm:"type:int;not null;default:0"`
+	Error       string              `gorm:"type:text"`
+	StartedAt   *time.Time
+	FinishedAt  *time.Time
+}
+
+func (repo *JobRepo) prepareDbConnection() {
+	repo.db = dbCon()
+}
+
+func (repo *JobRepo) Create(job *Job) error {
+	repo.prepareDbConnection()
+
+	job.Status = constants.JOB_STATUS_QUEUED
+
+	return repo.db.Create(job).Error
+}
+
+// NextQueued returns the oldest queued job that does not belong to one of the busy PRs,
+// or nil if there is nothing to pick up.
+func (repo *JobRepo) NextQueued(busyPrIDs []int64) (*Job, error) {
+	repo.prepareDbConnection()
+
+	var job Job
+
+	query := repo.db.Where("status = ?", constants.JOB_STATUS_QUEUED)
+
+	if len(busyPrIDs) > 0 {
+		query = query.Where("pr_id NOT IN ?", busyPrIDs)
+	}
+
+	result := query.Order("id").First(&job)
+
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+
+		return nil, result.Error
+	}
+
+	return &job, nil
+}
+
+func (repo *JobRepo) MarkRunning(job *Job) error {
+	repo.prepareDbConnection()
+
+	now := time.Now()
+	job.Status = constants.JOB_STATUS_RUNNING
+	job.Attempts++
+	job.StartedAt = &now
+
+	return repo.db.Model(job).Updates(map[string]interface{}{
+		"Status":    job.Status,
+		"Attempts":  job.Attempts,
+		"StartedAt": job.StartedAt,
+	}).Error
+}
+
+func (repo *JobRepo) MarkFinished(job *Job, jobErr error) error {
+	repo.prepareDbConnection()
+
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Status = constants.JOB_STATUS_SUCCEEDED
+	job.Error = ""
+
+	if jobErr != nil {
+		job.Status = constants.JOB_STATUS_FAILED
+		job.Error = jobErr.Error()
+	}
+
+	return repo.db.Model(job).Updates(map[string]interface{}{
+		"Status":     job.Status,
+		"Error":      job.Error,
+		"FinishedAt": job.FinishedAt,
+	}).Error
+}
+
+// CancelQueued marks the queued jobs of the PR about another commit than headSha as cancelled,
+// only the ones of the given events (ie. "pull_request.synchronize"). It gives the jobs it cancelled.
+func (repo *JobRepo) CancelQueued(prId int64, headSha string, eventActions map[string]bool) ([]Job, error) {
+	repo.prepareDbConnection()
+
+	var queued []Job
+
+	result := repo.db.Where("pr_id = ? AND status = ? AND head_sha <> '' AND head_sha <> ?", prId, constants.JOB_STATUS_QUEUED, headSha).
+		Order("id").Find(&queued)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	now := time.Now()
+	cancelled := []Job{}
+
+	for _, job := range queued {
+		if !eventActions[job.EventName+"."+job.EventAction] {
+			continue
+		}
+
+		job.Status = constants.JOB_STATUS_CANCELLED
+		job.Error = "superseded by " + headSha
+		job.FinishedAt = &now
+
+		// a worker may have picked it up in the meantime
+		result := repo.db.Model(&Job{}).Where("id = ? AND status = ?", job.ID, constants.JOB_STATUS_QUEUED).Updates(map[string]interface{}{
+			"Status":     job.Status,
+			"Error":      job.Error,
+			"FinishedAt": job.FinishedAt,
+		})
+		if result.Error != nil {
+			return cancelled, result.Error
+		}
+
+		if result.RowsAffected == 1 {
+			cancelled = append(cancelled, job)
+		}
+	}
+
+	return cancelled, nil
+}
+
+// HasPending tells if a job with the given event is waiting or running for the PR
+func (repo *JobRepo) HasPending(prId int64, eventName string, eventAction string) (bool, error) {
+	repo.prepareDbConnection()
+
+	var count int64
+
+	result := repo.db.Model(&Job{}).
+		Where("pr_id = ? AND event_name = ? AND event_action = ?", prId, eventName, eventAction).
+		Where("status IN ?", []constants.JobStatus{constants.JOB_STATUS_QUEUED, constants.JOB_STATUS_RUNNING}).
+		Count(&count)
+
+	return count > 0, result.Error
+}
+
+// GetInterrupted returns the jobs that were running when imbere stopped.
+func (repo *JobRepo) GetInterrupted() ([]Job, error) {
+	repo.prepareDbConnection()
+
+	var jobs []Job
+
+	result := repo.db.Where("status = ?", constants.JOB_STATUS_RUNNING).Order("id").Find(&jobs)
+
+	return jobs, result.Error
+}
+
+func (repo *JobRepo) Requeue(job *Job) error {
+	repo.prepareDbConnection()
+
+	job.Status = constants.JOB_STATUS_QUEUED
+
+	return repo.db.Model(job).Update("Status", job.Status).Error
+}
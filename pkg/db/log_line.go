@@ -0,0 +1,66 @@
+package db
+
+import (
+	"time"
+
+	"github.com/rssb/imbere/pkg/constants"
+	"gorm.io/gorm"
+)
+
+type LogLineRepo struct {
+	db *gorm.DB
+}
+
+// LogLine is a line printed while deploying a PR, by the pipeline commands or by imbere itself
+type LogLine struct {
+	ID        uint                      `gorm:"primarykey"`
+	CreatedAt time.Time                 `gorm:"index"`
+	PrID      int64                     `gorm:"type:bigint;not null;index:idx_log_lines_attempt"`
+	Attempt   int64                     `gorm:"type:bigint;not null;index:idx_log_lines_attempt"`
+	Step      constants.ProcessProgress `gorm:"type:int;not null"`
+	Stream    constants.LogStream       `gorm:"type:text;not null"`
+	Line      string                    `gorm:"type:text;not null"`
+}
+
+func (repo *LogLineRepo) prepareDbConnection() {
+	repo.db = dbCon()
+}
+
+func (repo *LogLineRepo) CreateMany(lines []LogLine) error {
+	repo.prepareDbConnection()
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	return repo.db.Create(&lines).Error
+}
+
+// Page gives the lines of an attempt in the order they were printed, pages start at 1
+func (repo *LogLineRepo) Page(prId int64, attempt int64, page int, perPage int) ([]LogLine, int64, error) {
+	repo.prepareDbConnection()
+
+	var lines []LogLine
+	var total int64
+
+	query := repo.db.Model(&LogLine{}).Where(&LogLine{PrID: prId, Attempt: attempt})
+
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	result := query.Order("id").Offset((page - 1) * perPage).Limit(perPage).Find(&lines)
+
+	return lines, total, result.Error
+}
+
+// Prune removes the logs of a PR attempts older than the given one, and every log older than the given time.
+func (repo *LogLineRepo) Prune(prId int64, oldestAttempt int64, before time.Time) error {
+	repo.prepareDbConnection()
+
+	if err := repo.db.Where("pr_id = ? AND attempt < ?", prId, oldestAttempt).Delete(&LogLine{}).Error; err != nil {
+		return err
+	}
+
+	return repo.db.Where("created_at < ?", before).Delete(&LogLine{}).Error
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"fmt"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -12,23 +13,34 @@ type PullRequestRepo struct {
 
 type PullRequest struct {
 	gorm.Model
-	PrID              int64  `gorm:"type:bigint;not null"`
-	PrNumber          int64  `gorm:"type:bigint;not null"`
-	BranchName        string `gorm:"type:text;not null"`
-	PrUrl             string `gorm:"type:text;not null"`
-	RepoName          string `gorm:"type:text;not null"`
-	RepoAddress       string `gorm:"type:text;not null"`
-	SSHAddress        string `gorm:"type:text;not null"`
-	InstallationID    int64  `gorm:"type:bigint;not null"`
-	OwnerName         string `gorm:"type:text;not null"`
-	OwnerID           int64  `gorm:"type:bigint;not null"`
-	CommentID         int64  `gorm:"type:bigint;not null;default:0"`
-	WorkflowSucceeded bool   `gorm:"type:bool;not null;default:false"` // did workflow succeed from github
-	LabeledToDeploy   bool   `gorm:"type:bool;not null;default:false"` // is PR labeled to be deployed on github
-	Active            bool   `gorm:"type:bool;not null;default:false"` // active pull request
-	IsDeploying       bool   `gorm:"type:bool;not null;default:false"` // is deploying
-	Deployed          bool   `gorm:"type:bool;not null;default:false"` // is deployed (accessible over internet)
-	DeploymentPort    int32  `gorm:"type:bigint"`                      // deployment service port
+	PrID              int64      `gorm:"type:bigint;not null"`
+	PrNumber          int64      `gorm:"type:bigint;not null"`
+	BranchName        string     `gorm:"type:text;not null"`
+	PrUrl             string     `gorm:"type:text;not null"`
+	RepoName          string     `gorm:"type:text;not null"`
+	RepoAddress       string     `gorm:"type:text;not null"`
+	SSHAddress        string     `gorm:"type:text;not null"`
+	InstallationID    int64      `gorm:"type:bigint;not null"`
+	OwnerName         string     `gorm:"type:text;not null"`
+	OwnerID           int64      `gorm:"type:bigint;not null"`
+	CommentID         int64      `gorm:"type:bigint;not null;default:0"`
+	HeadSHA           string     `gorm:"type:text"`                        // latest commit pushed to the PR
+	DeployedSHA       string     `gorm:"type:text"`                        // commit the preview runs, it is behind HeadSHA until the new commits are deployed
+	IsFork            bool       `gorm:"type:bool;not null;default:false"` // the PR comes from a fork, its code is not trusted
+	ApprovedSHA       string     `gorm:"type:text"`                        // commit of a fork a maintainer allowed to deploy, see constants.FORK_POLICY_LABEL
+	WorkflowSucceeded bool       `gorm:"type:bool;not null;default:false"` // did workflow succeed from github
+	LabeledToDeploy   bool       `gorm:"type:bool;not null;default:false"` // is PR labeled to be deployed on github
+	Active            bool       `gorm:"type:bool;not null;default:false"` // active pull request
+	Closed            bool       `gorm:"type:bool;not null;default:false"` // PR was closed (or merged) on github, its preview should not be running
+	IsDeploying       bool       `gorm:"type:bool;not null;default:false"` // is deploying
+	Deployed          bool       `gorm:"type:bool;not null;default:false"` // is deployed (accessible over internet)
+	DeploymentPort    int32      `gorm:"type:bigint"`                      // deployment service port
+	Deployer          string     `gorm:"type:text"`                        // runtime the PR is deployed with, see constants.DEPLOYER_*
+	Attempts          int64      `gorm:"type:bigint;not null;default:0"`   // number of deployments started for the PR, the last one identifies the current attempt
+	LogsToken         string     `gorm:"type:text"`                        // signs the links to the logs posted on the PR, see logs.URL
+	Sleeping          bool       `gorm:"type:bool;not null;default:false"` // deployed but stopped after being idle, see RepositorySettings.IdleTTLMinutes
+	DeployedSlot      int64      `gorm:"type:bigint;not null;default:0"`   // attempt whose build the preview runs, see GetSlotDir
+	LastActiveAt      *time.Time // last time the PR was deployed or its preview was requested
 }
 
 func (pr *PullRequest) GetPrId() string {
@@ -43,6 +55,41 @@ func (pr *PullRequest) GetDir() string {
 	return pr.RepoName + "/" + pr.BranchName + "_" + pr.GetPrNumber()
 }
 
+// GetSlotDir gives where the build of a deployment attempt is checked out, every attempt gets its own directory
+// so that the preview keeps running from the previous one while it is built.
+// Slot 0 is the directory of PRs deployed before slots existed.
+func (pr *PullRequest) GetSlotDir(slot int64) string {
+	if slot == 0 {
+		return pr.GetDir()
+	}
+
+	return fmt.Sprintf("%s@%d", pr.GetDir(), slot)
+}
+
+// GetAppName gives the name the app of a slot runs under on its runtime
+func (pr *PullRequest) GetAppName(slot int64) string {
+	if slot == 0 {
+		return pr.GetPrId()
+	}
+
+	return fmt.Sprintf("%s-%d", pr.GetPrId(), slot)
+}
+
+// GetDeployedAppName gives the name of the app the preview runs
+func (pr *PullRequest) GetDeployedAppName() string {
+	return pr.GetAppName(pr.DeployedSlot)
+}
+
+// GetHeadRef gives the ref the changes of the PR are fetched from, in the base repository.
+// Branches of forks are not in it, github keeps the head of every PR under refs/pull/<number>/head.
+func (pr *PullRequest) GetHeadRef() string {
+	if pr.IsFork {
+		return "refs/pull/" + pr.GetPrNumber() + "/head"
+	}
+
+	return "refs/heads/" + pr.BranchName
+}
+
 func (repo *PullRequestRepo) prepareDbConnection() {
 	repo.db = dbCon()
 }
@@ -72,12 +119,23 @@ func (repo *PullRequestRepo) Save(pr *PullRequest) error {
 			"WorkflowSucceeded": pr.WorkflowSucceeded,
 			"LabeledToDeploy":   pr.LabeledToDeploy,
 			"Active":            pr.Active,
+			"Closed":            pr.Closed,
 			"Deployed":          pr.Deployed,
 			"DeploymentPort":    pr.DeploymentPort,
 			"IsDeploying":       pr.IsDeploying,
 			"OwnerName":         pr.OwnerName,
 			"OwnerID":           pr.OwnerID,
 			"CommentID":         pr.CommentID,
+			"HeadSHA":           pr.HeadSHA,
+			"DeployedSHA":       pr.DeployedSHA,
+			"IsFork":            pr.IsFork,
+			"ApprovedSHA":       pr.ApprovedSHA,
+			"Deployer":          pr.Deployer,
+			"Attempts":          pr.Attempts,
+			"LogsToken":         pr.LogsToken,
+			"Sleeping":          pr.Sleeping,
+			"DeployedSlot":      pr.DeployedSlot,
+			"LastActiveAt":      pr.LastActiveAt,
 		})
 
 		if result.Error != nil {
@@ -106,7 +164,19 @@ func (repo *PullRequestRepo) GetByPrID(prId int64) (*PullRequest, error) {
 	return &pr, nil
 }
 
-func (repo *PullRequestRepo) Deploy(prId int64, port int32) (*PullRequest, error) {
+// GetByPrNumber gives the PRs with the given number, one per repository
+func (repo *PullRequestRepo) GetByPrNumber(prNumber int64) ([]PullRequest, error) {
+	repo.prepareDbConnection()
+
+	var prs []PullRequest
+
+	result := repo.db.Where(&PullRequest{PrNumber: prNumber}).Find(&prs)
+
+	return prs, result.Error
+}
+
+// Deploy switches the preview of the PR to the app of a slot, the proxy sends requests to its port from then on
+func (repo *PullRequestRepo) Deploy(prId int64, port int32, deployer string, sha string, slot int64) (*PullRequest, error) {
 
 	pr, err := repo.GetByPrID(prId)
 
@@ -114,9 +184,16 @@ func (repo *PullRequestRepo) Deploy(prId int64, port int32) (*PullRequest, error
 		return nil, err
 	}
 
+	now := time.Now()
+
 	pr.Deployed = true
 	pr.IsDeploying = false
+	pr.Sleeping = false
+	pr.LastActiveAt = &now
 	pr.DeploymentPort = port
+	pr.Deployer = deployer
+	pr.DeployedSHA = sha
+	pr.DeployedSlot = slot
 
 	err = repo.Save(pr)
 
@@ -137,7 +214,11 @@ func (repo *PullRequestRepo) UnDeploy(prId int64) (*PullRequest, error) {
 
 	pr.Deployed = false
 	pr.IsDeploying = false
+	pr.Sleeping = false
 	pr.DeploymentPort = 0
+	pr.Deployer = ""
+	pr.DeployedSHA = ""
+	pr.DeployedSlot = 0
 
 	err = repo.Save(pr)
 
@@ -147,3 +228,104 @@ func (repo *PullRequestRepo) UnDeploy(prId int64) (*PullRequest, error) {
 
 	return pr, nil
 }
+
+// Sleep records that the app of the PR was stopped while it stays deployed
+func (repo *PullRequestRepo) Sleep(prId int64) (*PullRequest, error) {
+	pr, err := repo.GetByPrID(prId)
+	if err != nil {
+		return nil, err
+	}
+
+	pr.Sleeping = true
+
+	if err := repo.Save(pr); err != nil {
+		return nil, err
+	}
+
+	return pr, nil
+}
+
+// Wake records that the app of the PR is running again, on the given port
+func (repo *PullRequestRepo) Wake(prId int64, port int32) (*PullRequest, error) {
+	pr, err := repo.GetByPrID(prId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	pr.Sleeping = false
+	pr.LastActiveAt = &now
+	pr.DeploymentPort = port
+
+	if err := repo.Save(pr); err != nil {
+		return nil, err
+	}
+
+	return pr, nil
+}
+
+// Touch records that the preview of the PR was just used
+func (repo *PullRequestRepo) Touch(prId int64) error {
+	repo.prepareDbConnection()
+
+	result := repo.db.Model(&PullRequest{}).Where(&PullRequest{PrID: prId}).Update("LastActiveAt", time.Now())
+
+	return result.Error
+}
+
+// GetByRepoAndNumber gives the PR with the given number in a repository, or nil if imbere does not know it
+func (repo *PullRequestRepo) GetByRepoAndNumber(ownerName string, repoName string, prNumber int64) (*PullRequest, error) {
+	repo.prepareDbConnection()
+
+	var prs []PullRequest
+
+	result := repo.db.Where(&PullRequest{OwnerName: ownerName, RepoName: repoName, PrNumber: prNumber}).Limit(1).Find(&prs)
+	if result.Error != nil || len(prs) == 0 {
+		return nil, result.Error
+	}
+
+	return &prs[0], nil
+}
+
+// ListByHeadSHA gives the PRs of a repository whose latest commit is sha, several PRs can be at the same commit (ie. forks of the same branch)
+func (repo *PullRequestRepo) ListByHeadSHA(ownerName string, repoName string, sha string) ([]PullRequest, error) {
+	repo.prepareDbConnection()
+
+	var prs []PullRequest
+
+	result := repo.db.Where(&PullRequest{OwnerName: ownerName, RepoName: repoName, HeadSHA: sha}).Order("updated_at desc").Find(&prs)
+
+	return prs, result.Error
+}
+
+// GetDeploying gives the PRs flagged as being deployed
+func (repo *PullRequestRepo) GetDeploying() ([]PullRequest, error) {
+	repo.prepareDbConnection()
+
+	var prs []PullRequest
+
+	result := repo.db.Where(&PullRequest{IsDeploying: true}).Find(&prs)
+
+	return prs, result.Error
+}
+
+// GetDeployed gives the PRs whose preview should be running
+func (repo *PullRequestRepo) GetDeployed() ([]PullRequest, error) {
+	repo.prepareDbConnection()
+
+	var prs []PullRequest
+
+	result := repo.db.Where(&PullRequest{Deployed: true}).Find(&prs)
+
+	return prs, result.Error
+}
+
+// ResetDeploying clears the IsDeploying flag of a PR whose deployment was interrupted,
+// otherwise every later deployment would be skipped.
+func (repo *PullRequestRepo) ResetDeploying(prId int64) error {
+	repo.prepareDbConnection()
+
+	result := repo.db.Model(&PullRequest{}).Where(&PullRequest{PrID: prId}).Update("IsDeploying", false)
+
+	return result.Error
+}
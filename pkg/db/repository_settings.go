@@ -0,0 +1,148 @@
+package db
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/rssb/imbere/pkg/constants"
+	"gorm.io/gorm"
+)
+
+type RepositorySettingsRepo struct {
+	db *gorm.DB
+}
+
+// RepositorySettings holds how imbere should behave for a given repository,
+// repositories without a record use the defaults (zero values).
+type RepositorySettings struct {
+	gorm.Model
+	OwnerName      string `gorm:"type:text;not null;uniqueIndex:idx_repository_settings_repo"`
+	RepoName       string `gorm:"type:text;not null;uniqueIndex:idx_repository_settings_repo"`
+	DeployOnPush   bool   `gorm:"type:bool;not null;default:false"` // deploy on every push instead of waiting for the workflow to succeed
+	Deployer       string `gorm:"type:text"`                        // runtime PRs are deployed with, see constants.DEPLOYER_*
+	IdleTTLMinutes int    `gorm:"type:int;not null;default:0"`      // previews idle for longer are put to sleep, 0 keeps them running
+	CloneAuth      string `gorm:"type:text"`                        // how the repository is cloned, see constants.CLONE_AUTH_*
+	DeployKey      string `gorm:"type:text"`                        // private ssh key of a deploy key of the repository, stored encrypted (see encrypt) and never returned by the api
+	ForkPolicy     string `gorm:"type:text"`                        // what is done with PRs from forks, see constants.FORK_POLICY_*
+}
+
+// GetDeployer gives the runtime PRs of the repository are deployed with
+func (settings *RepositorySettings) GetDeployer() string {
+	if settings.Deployer == "" {
+		return constants.DEFAULT_DEPLOYER
+	}
+
+	return settings.Deployer
+}
+
+// GetCloneAuth gives how the repository is cloned
+func (settings *RepositorySettings) GetCloneAuth() string {
+	if settings.CloneAuth == "" {
+		return constants.DEFAULT_CLONE_AUTH
+	}
+
+	return settings.CloneAuth
+}
+
+// GetForkPolicy gives what is done with PRs from forks
+func (settings *RepositorySettings) GetForkPolicy() string {
+	if settings.ForkPolicy == "" {
+		return constants.DEFAULT_FORK_POLICY
+	}
+
+	return settings.ForkPolicy
+}
+
+// IsSandboxed tells if the PR must be built and run in a sandbox, see constants.FORK_POLICY_SANDBOX
+func (settings *RepositorySettings) IsSandboxed(pr *PullRequest) bool {
+	return pr.IsFork && settings.GetForkPolicy() == constants.FORK_POLICY_SANDBOX
+}
+
+func (repo *RepositorySettingsRepo) prepareDbConnection() {
+	repo.db = dbCon()
+}
+
+// Get returns the settings of the repository, or the defaults if none were saved.
+func (repo *RepositorySettingsRepo) Get(ownerName string, repoName string) (*RepositorySettings, error) {
+	repo.prepareDbConnection()
+
+	var settings RepositorySettings
+
+	result := repo.db.Where(&RepositorySettings{OwnerName: ownerName, RepoName: repoName}).First(&settings)
+
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return &RepositorySettings{OwnerName: ownerName, RepoName: repoName}, nil
+		}
+
+		return nil, result.Error
+	}
+
+	deployKey, err := decrypt(settings.DeployKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the deploy key of %s/%s: %v", ownerName, repoName, err)
+	}
+
+	settings.DeployKey = deployKey
+
+	return &settings, nil
+}
+
+// Save stores the settings, the deploy key is encrypted in the database but stays readable in settings
+func (repo *RepositorySettingsRepo) Save(settings *RepositorySettings) error {
+	repo.prepareDbConnection()
+
+	deployKey, err := encrypt(settings.DeployKey)
+	if err != nil {
+		return err
+	}
+
+	if settings.ID == 0 {
+		stored := *settings
+		stored.DeployKey = deployKey
+
+		if err := repo.db.Create(&stored).Error; err != nil {
+			return err
+		}
+
+		settings.Model = stored.Model
+
+		return nil
+	}
+
+	return repo.db.Model(settings).Updates(map[string]interface{}{
+		"DeployOnPush":   settings.DeployOnPush,
+		"Deployer":       settings.Deployer,
+		"IdleTTLMinutes": settings.IdleTTLMinutes,
+		"CloneAuth":      settings.CloneAuth,
+		"DeployKey":      deployKey,
+		"ForkPolicy":     settings.ForkPolicy,
+	}).Error
+}
+
+// encryptDeployKeys encrypts the deploy keys that were stored in clear, before secret_key existed
+func (repo *RepositorySettingsRepo) encryptDeployKeys() error {
+	repo.prepareDbConnection()
+
+	var settings []RepositorySettings
+
+	result := repo.db.Where("deploy_key <> '' AND deploy_key NOT LIKE ?", encryptedPrefix+"%").Find(&settings)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	for i := range settings {
+		deployKey, err := encrypt(settings[i].DeployKey)
+		if err != nil {
+			return err
+		}
+
+		if err := repo.db.Model(&settings[i]).Update("DeployKey", deployKey).Error; err != nil {
+			return err
+		}
+
+		log.Printf("encrypted the deploy key of %s/%s", settings[i].OwnerName, settings[i].RepoName)
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// prefix of the values encrypted with secretKey, the ones without it were stored before secrets were encrypted
+const encryptedPrefix = "enc:v1:"
+
+// set by DbInit, see config.Config.SecretKey
+var secretKey []byte
+
+var ErrNoSecretKey = errors.New("secrets are stored encrypted, imbere needs a secret_key (IMBERE_SECRET_KEY) to store or read them")
+
+// encrypt seals a secret with AES-GCM before it is stored, an empty secret stays empty
+func encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	if secretKey == nil {
+		return "", ErrNoSecretKey
+	}
+
+	aead, err := newAEAD()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt opens a secret sealed by encrypt, secrets stored before they were encrypted are given as they are
+func decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+
+	if secretKey == nil {
+		return "", ErrNoSecretKey
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt secret: %v", err)
+	}
+
+	aead, err := newAEAD()
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("could not decrypt secret: it is truncated")
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt secret, was secret_key changed? %v", err)
+	}
+
+	return string(plaintext), nil
+}
+
+func newAEAD() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,95 @@
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/utils"
+)
+
+// RuntimeStatus is the state of a deployed app as seen by its runtime
+type RuntimeStatus string
+
+const (
+	RUNTIME_STATUS_RUNNING   RuntimeStatus = "running"
+	RUNTIME_STATUS_STOPPED   RuntimeStatus = "stopped"
+	RUNTIME_STATUS_ERRORED   RuntimeStatus = "errored"
+	RUNTIME_STATUS_NOT_FOUND RuntimeStatus = "not_found"
+)
+
+// DeploySpec describes the app a Deployer has to run
+type DeploySpec struct {
+	Name       string   // identifies the deployment in the runtime, one per PR
+	Dir        string   // directory the app runs from
+	Command    string   // command starting the app
+	Env        []string // variables of the app (without the environment of imbere)
+	Port       int32
+	Host       string // host the app is reached on, see config.PreviewConfig.Host
+	Dockerfile string // relative to Dir, only used by docker
+	Sandboxed  bool   // the code is not trusted (ie. a fork), only docker runs it and without privileges
+}
+
+// Deployer runs apps on a given runtime (pm2, docker, ...)
+type Deployer interface {
+	Start(ctx context.Context, spec DeploySpec) error
+	Stop(ctx context.Context, name string) error
+	Status(ctx context.Context, name string) (RuntimeStatus, error)
+	Logs(ctx context.Context, name string, lines int) ([]string, error)
+	List(ctx context.Context) ([]string, error) // names of the apps imbere runs on the runtime
+}
+
+// Output receives the output of the commands a Deployer runs, the process monitor of the deployment implements it
+type Output interface {
+	ListenToCmd(cmd *exec.Cmd)
+	AddLog(log string)
+}
+
+// NewDeployer gives the deployer of the given runtime, see constants.DEPLOYER_*
+// pm2Namespace is the pm2 namespace imbere runs apps in, see config.Config.PM2Namespace
+func NewDeployer(kind string, output Output, pm2Namespace string) (Deployer, error) {
+	switch kind {
+	case constants.DEPLOYER_PM2, "":
+		return &PM2Deployer{output: output, namespace: pm2Namespace}, nil
+	case constants.DEPLOYER_DOCKER:
+		return &DockerDeployer{output: output}, nil
+	case constants.DEPLOYER_PROCESS:
+		return &ProcessDeployer{output: output}, nil
+	default:
+		return nil, fmt.Errorf("unknown deployer %q", kind)
+	}
+}
+
+// IsValidDeployer tells if there is a deployer for the given runtime
+func IsValidDeployer(kind string) bool {
+	_, err := NewDeployer(kind, nil, "")
+	return err == nil
+}
+
+// runCommand runs a command of the runtime, streaming its output.
+// It is killed with what it started once its context is done (ie. a docker build that outlives the deploy timeout).
+func runCommand(output Output, cmd *exec.Cmd) error {
+	utils.KillProcessGroupOnCancel(cmd)
+	output.ListenToCmd(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", commandName(cmd), err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s failed: %v", commandName(cmd), err)
+	}
+
+	return nil
+}
+
+// commandName gives the program and its sub command (ie. "docker run"),
+// the other arguments can hold the values of environment variables and are never logged.
+func commandName(cmd *exec.Cmd) string {
+	if len(cmd.Args) < 2 {
+		return cmd.Args[0]
+	}
+
+	return cmd.Args[0] + " " + cmd.Args[1]
+}
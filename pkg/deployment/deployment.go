@@ -1,51 +1,119 @@
 package deployment
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
-	"strconv"
+	"path/filepath"
+	"time"
 
+	"github.com/rssb/imbere/pkg/config"
 	"github.com/rssb/imbere/pkg/constants"
 	"github.com/rssb/imbere/pkg/db"
 	"github.com/rssb/imbere/pkg/process_monitor"
+	"github.com/rssb/imbere/pkg/repo_config"
 	"github.com/rssb/imbere/pkg/utils"
 )
 
 type DeploymentService struct {
-	pr      *db.PullRequest
-	prRepo  db.PullRequestRepo
-	monitor *process_monitor.ProcessMonitor
+	pr        *db.PullRequest
+	prRepo    db.PullRequestRepo
+	monitor   *process_monitor.ProcessMonitor
+	config    *repo_config.RepoConfig // pipeline of the repository
+	appConfig *config.Config          // configuration imbere runs with
+	settings  *db.RepositorySettings  // settings of the repository, see repositorySettings
 }
 
-func NewDeploymentService(pr *db.PullRequest, monitor *process_monitor.ProcessMonitor) *DeploymentService {
+func NewDeploymentService(pr *db.PullRequest, monitor *process_monitor.ProcessMonitor, appConfig *config.Config) *DeploymentService {
 	return &DeploymentService{
-		pr:      pr,
-		monitor: monitor,
+		pr:        pr,
+		monitor:   monitor,
+		config:    repo_config.Default(),
+		appConfig: appConfig,
 	}
 }
 
+// RepositoryDirectory is where the changes of the PR were pulled, for the slot the service works on
+func (service *DeploymentService) RepositoryDirectory() string {
+	return filepath.Join(service.appConfig.BuildDir, service.pr.GetSlotDir(service.slot()))
+}
+
+// slot gives the build the service works on, the one of the deployment in progress or else the one the preview runs
+func (service *DeploymentService) slot() int64 {
+	if deployment := service.monitor.Deployment(); deployment != nil {
+		return deployment.GetSlot()
+	}
+
+	return service.pr.DeployedSlot
+}
+
+// WorkingDirectory is where the pipeline commands run, the repository itself unless its configuration says otherwise
 func (service *DeploymentService) WorkingDirectory() string {
-	return constants.BUILD_DIR + service.pr.GetDir()
+	return filepath.Join(service.RepositoryDirectory(), service.config.WorkingDirectory)
 }
-func (service *DeploymentService) InstallDependencies() error {
-	cmd := exec.Command("ni")
-	cmd.Dir = service.WorkingDirectory()
 
-	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_INSTALLING_DEPENDENCIES, constants.PROCESS_OUTCOME_ONGOING)
-	service.log("Started Installing Dependencies")
+// LoadConfig reads the pipeline of the repository from its .imbere.yml, repositories without one get the default pipeline.
+// Problems with the file are shown on the PR comment.
+func (service *DeploymentService) LoadConfig() error {
+	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_LOADING_CONFIG, constants.PROCESS_OUTCOME_ONGOING)
 
-	service.monitor.ListenToCmd(cmd)
+	config, err := repo_config.Load(service.RepositoryDirectory())
+	if err != nil {
+		service.log(fmt.Sprintf("loading configuration failed with %s", err))
+		service.monitor.SetError(err.Error())
+		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_LOADING_CONFIG, constants.PROCESS_OUTCOME_FAILED)
+		return err
+	}
 
-	if err := cmd.Start(); err != nil {
-		service.log(fmt.Sprintf("install command failed with %s in %s \n", err, service.WorkingDirectory()))
-		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_INSTALLING_DEPENDENCIES, constants.PROCESS_OUTCOME_FAILED)
+	service.config = config
+
+	settings, err := service.repositorySettings()
+	if err != nil {
+		service.log(fmt.Sprintf("loading repository settings failed with %s", err))
+		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_LOADING_CONFIG, constants.PROCESS_OUTCOME_FAILED)
+		return err
+	}
+
+	if settings.IsSandboxed(service.pr) {
+		service.log("The PR comes from a fork, it is built and run in a docker sandbox without the variables of the imbere host")
+	}
+
+	if info, err := os.Stat(service.WorkingDirectory()); err != nil || !info.IsDir() {
+		err = fmt.Errorf("working_directory %q does not exist in the repository", config.WorkingDirectory)
+		service.log(err.Error())
+		service.monitor.SetError(err.Error())
+		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_LOADING_CONFIG, constants.PROCESS_OUTCOME_FAILED)
 		return err
 	}
 
-	if err := cmd.Wait(); err != nil {
+	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_LOADING_CONFIG, constants.PROCESS_OUTCOME_SUCCEEDED)
+	service.log("Loaded Configuration")
+
+	return nil
+}
+
+func (service *DeploymentService) InstallDependencies(ctx context.Context) error {
+	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_INSTALLING_DEPENDENCIES, constants.PROCESS_OUTCOME_ONGOING)
+
+	if *service.config.Install == "" {
+		service.log("No install command, skipping")
+		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_INSTALLING_DEPENDENCIES, constants.PROCESS_OUTCOME_SUCCEEDED)
+		return nil
+	}
+
+	// the code of forks does not run on the host, the Dockerfile of the repository installs it in the image
+	if service.isSandboxed() {
+		service.log("Sandboxed, the install runs in the docker image")
+		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_INSTALLING_DEPENDENCIES, constants.PROCESS_OUTCOME_SUCCEEDED)
+		return nil
+	}
+
+	service.log("Started Installing Dependencies")
+
+	if err := service.runStepCommand(ctx, *service.config.Install, service.appConfig.Timeouts.Install); err != nil {
 		service.log(fmt.Sprintf("install command failed with %s in %s \n", err, service.WorkingDirectory()))
-		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_INSTALLING_DEPENDENCIES, constants.PROCESS_OUTCOME_FAILED)
+		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_INSTALLING_DEPENDENCIES, utils.StepOutcome(err))
 		return err
 	}
 
@@ -55,24 +123,27 @@ func (service *DeploymentService) InstallDependencies() error {
 	return nil
 }
 
-func (service *DeploymentService) Build() error {
-	cmd := exec.Command("nr", "build")
-	cmd.Dir = service.WorkingDirectory()
-
+func (service *DeploymentService) Build(ctx context.Context) error {
 	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_BUILDING_PROJECT, constants.PROCESS_OUTCOME_ONGOING)
-	service.log("Started Building")
 
-	service.monitor.ListenToCmd(cmd)
+	if *service.config.Build == "" {
+		service.log("No build command, skipping")
+		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_BUILDING_PROJECT, constants.PROCESS_OUTCOME_SUCCEEDED)
+		return nil
+	}
 
-	if err := cmd.Start(); err != nil {
-		service.log(fmt.Sprintf("build command failed with %s in %s \n", err, service.WorkingDirectory()))
-		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_BUILDING_PROJECT, constants.PROCESS_OUTCOME_FAILED)
-		return err
+	// the code of forks does not run on the host, the Dockerfile of the repository builds it in the image
+	if service.isSandboxed() {
+		service.log("Sandboxed, the build runs in the docker image")
+		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_BUILDING_PROJECT, constants.PROCESS_OUTCOME_SUCCEEDED)
+		return nil
 	}
 
-	if err := cmd.Wait(); err != nil {
+	service.log("Started Building")
+
+	if err := service.runStepCommand(ctx, *service.config.Build, service.appConfig.Timeouts.Build); err != nil {
 		service.log(fmt.Sprintf("build command failed with %s in %s \n", err, service.WorkingDirectory()))
-		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_BUILDING_PROJECT, constants.PROCESS_OUTCOME_FAILED)
+		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_BUILDING_PROJECT, utils.StepOutcome(err))
 		return err
 	}
 
@@ -82,86 +153,276 @@ func (service *DeploymentService) Build() error {
 	return nil
 }
 
-func (service *DeploymentService) Deploy() error {
-	var port int32
+// runStepCommand runs a command of the pipeline in the working directory, it is killed with everything it started
+// once it runs for longer than timeout minutes or the deployment is cancelled
+func (service *DeploymentService) runStepCommand(ctx context.Context, command string, timeout int) error {
+	stepTimeout := time.Duration(timeout) * time.Minute
+	ctx, cancel := context.WithTimeout(ctx, stepTimeout)
+	defer cancel()
 
-	if service.pr.Deployed {
-		port = service.pr.DeploymentPort
-	} else {
-		var portErr error
-		port, portErr = utils.GetFreePort()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = service.WorkingDirectory()
+	cmd.Env = service.config.Environ(0)
+	utils.KillProcessGroupOnCancel(cmd)
 
-		if portErr != nil {
-			service.log(fmt.Sprintf("deploy failed - failed to get port %s \n", portErr))
-			service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_DEPLOYING, constants.PROCESS_OUTCOME_FAILED)
-			return portErr
-		}
+	service.monitor.ListenToCmd(cmd)
 
+	if err := cmd.Start(); err != nil {
+		return err
 	}
 
-	err := service.deployToPM2(port)
+	return utils.StepError(ctx, stepTimeout, cmd.Wait())
+}
 
+// Deploy starts the app of the new build next to the one the preview runs, and switches the preview over
+// once it is ready. Until then, and if it never gets ready, the previous version keeps serving.
+func (service *DeploymentService) Deploy(ctx context.Context) error {
+	// the previous app still listens on its port
+	port, err := utils.GetFreePort()
 	if err != nil {
+		service.log(fmt.Sprintf("deploy failed - failed to get port %s \n", err))
+		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_DEPLOYING, constants.PROCESS_OUTCOME_FAILED)
 		return err
 	}
 
-	// update db record , indicating that the pr is currently deployed
-	pr, deployErr := service.prRepo.Deploy(service.pr.PrID, port)
-	// Assign the latest port to the new pull request. This update will be reflected across all instances, ensuring that external clients receive the most recent port information.
-	service.pr = pr
+	deployerKind, err := service.deployerKind()
+	if err != nil {
+		service.log(fmt.Sprintf("deploy failed - failed to get repository settings %s \n", err))
+		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_DEPLOYING, constants.PROCESS_OUTCOME_FAILED)
+		return err
+	}
+
+	// the app is stopped even if the deployment timed out or was cancelled, the preview must not run it
+	cleanupCtx := context.WithoutCancel(ctx)
+
+	timeout := time.Duration(service.appConfig.Timeouts.Deploy) * time.Minute
+	deployCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err = service.deployToRuntime(deployCtx, deployerKind, port)
+	started := err == nil
+
+	if started {
+		err = service.verify(deployCtx, deployerKind, port)
+	}
+
+	if err != nil {
+		err = utils.StepError(deployCtx, timeout, err)
+		service.monitor.UpdateProgress(service.monitor.Progress, utils.StepOutcome(err))
+
+		// a start that was interrupted may have left the app running
+		if started || deployCtx.Err() != nil {
+			service.stopFailed(cleanupCtx, deployerKind)
+		}
+
+		return err
+	}
+
+	deployedSHA := service.pr.HeadSHA
+	if deployment := service.monitor.Deployment(); deployment != nil {
+		deployedSHA = deployment.HeadSHA
+	}
+
+	previous := *service.pr
+
+	// update db record , indicating that the pr is currently deployed, the preview proxy sends the next requests to the new app
+	pr, deployErr := service.prRepo.Deploy(service.pr.PrID, port, deployerKind, deployedSHA, service.slot())
 
 	if deployErr != nil {
 		service.log(fmt.Sprintf("saving deployment status failed with %s in %s \n", deployErr, service.WorkingDirectory()))
 		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_DEPLOYING, constants.PROCESS_OUTCOME_FAILED)
+		service.stopFailed(cleanupCtx, deployerKind)
 		return deployErr
 	}
 
+	// Assign the latest port to the new pull request. This update will be reflected across all instances, ensuring that external clients receive the most recent port information.
+	*service.pr = *pr
+
+	if deployment := service.monitor.Deployment(); deployment != nil {
+		deploymentRepo := db.DeploymentRepo{}
+		if err := deploymentRepo.SetPort(deployment, port); err != nil {
+			service.log(fmt.Sprintf("saving deployment port failed with %s \n", err))
+		}
+	}
+
+	// a sleeping app was already stopped
+	if previous.Deployed && !previous.Sleeping {
+		service.stopPrevious(cleanupCtx, &previous)
+	}
+
 	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_COMPLETED, constants.PROCESS_OUTCOME_SUCCEEDED)
 	service.log("Finished Deploying")
 
 	return nil
 }
 
-func (service *DeploymentService) deployToPM2(port int32) error {
-	var cmd *exec.Cmd
+// repositorySettings gives the settings of the repository of the PR, they are read once per deployment
+func (service *DeploymentService) repositorySettings() (*db.RepositorySettings, error) {
+	if service.settings != nil {
+		return service.settings, nil
+	}
+
+	settingsRepo := db.RepositorySettingsRepo{}
+
+	settings, err := settingsRepo.Get(service.pr.OwnerName, service.pr.RepoName)
+	if err != nil {
+		return nil, err
+	}
+
+	service.settings = settings
+
+	return settings, nil
+}
+
+// isSandboxed tells if the PR is an untrusted fork that must only run in a container, see constants.FORK_POLICY_SANDBOX
+func (service *DeploymentService) isSandboxed() bool {
+	settings, err := service.repositorySettings()
+	if err != nil {
+		return service.pr.IsFork // without the settings the safest is to keep forks in the sandbox
+	}
+
+	return settings.IsSandboxed(service.pr)
+}
+
+// deployerKind gives the runtime the repository wants its PRs deployed with, sandboxed forks always run on docker
+func (service *DeploymentService) deployerKind() (string, error) {
+	settings, err := service.repositorySettings()
+	if err != nil {
+		return "", err
+	}
+
+	if settings.IsSandboxed(service.pr) {
+		return constants.DEPLOYER_DOCKER, nil
+	}
+
+	return settings.GetDeployer(), nil
+}
+
+// deployedWith gives the runtime the PR is currently deployed with,
+// PRs deployed before runtimes were configurable are on pm2
+func (service *DeploymentService) deployedWith() string {
+	if service.pr.Deployer == "" {
+		return constants.DEFAULT_DEPLOYER
+	}
+
+	return service.pr.Deployer
+}
 
-	// If there's an active deployment, we restart it. This approach ensures
-	// that we only have a single instance of the app running, even when there
-	// are changes to the pull request.
-	if service.pr.Deployed {
-		cmd = exec.Command("sh", "-c", "pm2 restart "+service.pr.GetPrId())
-	} else {
-		cmd = exec.Command("sh", "-c", "pm2 start 'nr start' --name "+service.pr.GetPrId()+" --namespace "+constants.PM2_NAMESPACE)
+func (service *DeploymentService) deploySpec(port int32) DeploySpec {
+	spec := DeploySpec{
+		Name:       service.pr.GetAppName(service.slot()),
+		Dir:        service.WorkingDirectory(),
+		Command:    service.config.Start,
+		Env:        service.config.AppEnv(port),
+		Port:       port,
+		Host:       service.appConfig.Preview.Host,
+		Dockerfile: service.config.Dockerfile,
 	}
 
+	// required_env would hand the variables of the host to the fork
+	if service.isSandboxed() {
+		spec.Env = service.config.SandboxEnv(port)
+		spec.Sandboxed = true
+	}
+
+	return spec
+}
+
+func (service *DeploymentService) deployToRuntime(ctx context.Context, deployerKind string, port int32) error {
 	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_DEPLOYING, constants.PROCESS_OUTCOME_ONGOING)
-	service.log("Started Deploying")
+	service.log(fmt.Sprintf("Started Deploying with %s", deployerKind))
 
-	cmd.Dir = service.WorkingDirectory()
+	deployer, err := NewDeployer(deployerKind, service.monitor, service.appConfig.PM2Namespace)
+	if err != nil {
+		service.log(fmt.Sprintf("deploy failed - %s \n", err))
+		return err
+	}
 
-	service.pr.DeploymentPort = port
-	service.monitor.SetPort(port)
-	cmd.Env = append(os.Environ(), "PORT="+strconv.Itoa(int(port)))
+	// the app of the new build runs next to the previous one, which is stopped once the preview is switched over
+	err = deployer.Start(ctx, service.deploySpec(port))
 
-	service.monitor.ListenToCmd(cmd)
+	if err != nil {
+		service.log(fmt.Sprintf("deploy command failed with %s in %s \n", err, service.WorkingDirectory()))
+		return err
+	}
 
-	if startErr := cmd.Start(); startErr != nil {
-		service.log(fmt.Sprintf("start deploy command failed with %s in %s \n", startErr, service.WorkingDirectory()))
-		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_DEPLOYING, constants.PROCESS_OUTCOME_FAILED)
-		return startErr
+	return nil
+}
+
+// verify waits for the app to pass its health check before the deployment is reported as done,
+// when it does not the last lines of the app are shown on the PR comment. Deploy reports the failure on the step.
+func (service *DeploymentService) verify(ctx context.Context, deployerKind string, port int32) error {
+	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_DEPLOYING, constants.PROCESS_OUTCOME_SUCCEEDED)
+	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_VERIFYING, constants.PROCESS_OUTCOME_ONGOING)
+
+	deployer, err := NewDeployer(deployerKind, service.monitor, service.appConfig.PM2Namespace)
+	if err != nil {
+		return err
 	}
 
-	if waitErr := cmd.Wait(); waitErr != nil {
-		service.log(fmt.Sprintf("wait deploy command failed with %s in %s \n", waitErr, service.WorkingDirectory()))
-		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_DEPLOYING, constants.PROCESS_OUTCOME_FAILED)
-		return waitErr
+	spec := service.deploySpec(port)
+	health := &healthCheck{
+		check:    service.config.HealthCheck,
+		host:     service.appConfig.Preview.Host,
+		spec:     spec,
+		deployer: deployer,
+		output:   service.monitor,
+	}
+
+	if err := health.wait(ctx); err != nil {
+		service.log(fmt.Sprintf("health check failed with %s", err))
+
+		if lines, logsErr := deployer.Logs(ctx, spec.Name, constants.FAILED_COMMENT_LOG_LINES); logsErr == nil && len(lines) > 0 {
+			service.log("Last lines of the app:")
+
+			for _, line := range lines {
+				service.log(line)
+			}
+		}
+
+		service.monitor.SetError(err.Error())
+		return err
 	}
 
+	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_VERIFYING, constants.PROCESS_OUTCOME_SUCCEEDED)
+
 	return nil
 }
 
-func (service *DeploymentService) UnDeploy() error {
-	err := service.unDeployFromPM2()
+// stopFailed stops the app started by a deployment that failed, the preview keeps running the previous one
+func (service *DeploymentService) stopFailed(ctx context.Context, deployerKind string) {
+	deployer, err := NewDeployer(deployerKind, service.monitor, service.appConfig.PM2Namespace)
+	if err == nil {
+		err = deployer.Stop(ctx, service.pr.GetAppName(service.slot()))
+	}
+
+	if err != nil {
+		service.log(fmt.Sprintf("could not stop the app that failed on %s: %s", deployerKind, err))
+	}
+}
+
+// stopPrevious stops the app the preview ran before it was switched to the new one
+func (service *DeploymentService) stopPrevious(ctx context.Context, previous *db.PullRequest) {
+	kind := previous.Deployer
+	if kind == "" {
+		kind = constants.DEFAULT_DEPLOYER
+	}
+
+	deployer, err := NewDeployer(kind, service.monitor, service.appConfig.PM2Namespace)
+	if err == nil {
+		err = deployer.Stop(ctx, previous.GetDeployedAppName())
+	}
+
+	if err != nil {
+		service.log(fmt.Sprintf("could not stop the previous app on %s: %s", kind, err))
+		return
+	}
+
+	service.log(fmt.Sprintf("Stopped the previous app %s on %s", previous.GetDeployedAppName(), kind))
+}
+
+func (service *DeploymentService) UnDeploy(ctx context.Context) error {
+	err := service.unDeployFromRuntime(ctx)
 
 	if err != nil {
 		return err
@@ -175,42 +436,114 @@ func (service *DeploymentService) UnDeploy() error {
 		return fmt.Errorf(err)
 	}
 
-	service.pr = pr
+	*service.pr = *pr
 	service.log(fmt.Sprintf("successful undeployed pr ID: %d", pr.PrID))
 	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_UN_DEPLOYING, constants.PROCESS_OUTCOME_SUCCEEDED)
+	service.monitor.DeactivateEnvironment()
 
 	return nil
 }
 
-func (service *DeploymentService) log(content string) {
-	service.monitor.AddLog(content)
+// Sleep stops the app of the PR without un deploying it, its directory is kept so that Wake can start it again
+func (service *DeploymentService) Sleep(ctx context.Context) error {
+	if !service.pr.Deployed || service.pr.Sleeping {
+		return nil
+	}
 
+	if err := service.stopOnRuntime(ctx); err != nil {
+		service.log(fmt.Sprintf("error while putting to sleep on %s : %s", service.deployedWith(), err))
+		return err
+	}
+
+	pr, err := service.prRepo.Sleep(service.pr.PrID)
+	if err != nil {
+		return err
+	}
+
+	*service.pr = *pr
+	service.log(fmt.Sprintf("put pr ID: %d to sleep", pr.PrID))
+	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_SLEEPING, constants.PROCESS_OUTCOME_SUCCEEDED)
+
+	return nil
 }
 
-func (service *DeploymentService) unDeployFromPM2() error {
-	var cmd *exec.Cmd
+// Wake starts again the app of a sleeping PR, from what was built when it was deployed
+func (service *DeploymentService) Wake(ctx context.Context) error {
+	if !service.pr.Deployed || !service.pr.Sleeping {
+		return nil
+	}
 
-	if service.pr.Deployed {
-		cmd = exec.Command("sh", "-c", "pm2 delete "+service.pr.GetPrId())
-	} else {
-		err := fmt.Sprintf("there was no deployment with name %s to delete from pm2", service.pr.GetPrId())
-		service.log(err)
-		return fmt.Errorf(err)
+	config, err := repo_config.Load(service.RepositoryDirectory())
+	if err != nil {
+		return err
 	}
 
-	service.monitor.ListenToCmd(cmd)
+	service.config = config
+
+	// the port may have been taken while the app was sleeping
+	port := service.pr.DeploymentPort
+	if !utils.IsPortFree(port) {
+		if port, err = utils.GetFreePort(); err != nil {
+			return err
+		}
+	}
+
+	deployer, err := NewDeployer(service.deployedWith(), service.monitor, service.appConfig.PM2Namespace)
+	if err != nil {
+		return err
+	}
 
-	if startErr := cmd.Start(); startErr != nil {
-		err := fmt.Sprintf("error while starting command to undeploy on pm2 : %s", startErr)
+	service.log(fmt.Sprintf("Waking up on %s", service.deployedWith()))
+
+	if err := deployer.Start(ctx, service.deploySpec(port)); err != nil {
+		service.log(fmt.Sprintf("wake up failed with %s in %s \n", err, service.WorkingDirectory()))
+		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_DEPLOYING, constants.PROCESS_OUTCOME_FAILED)
+		return err
+	}
+
+	pr, err := service.prRepo.Wake(service.pr.PrID, port)
+	if err != nil {
+		return err
+	}
+
+	*service.pr = *pr
+	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_COMPLETED, constants.PROCESS_OUTCOME_SUCCEEDED)
+
+	return nil
+}
+
+func (service *DeploymentService) log(content string) {
+	service.monitor.AddLog(content)
+
+}
+
+func (service *DeploymentService) unDeployFromRuntime(ctx context.Context) error {
+	if !service.pr.Deployed {
+		err := fmt.Sprintf("there was no deployment with name %s to delete from %s", service.pr.GetPrId(), service.deployedWith())
 		service.log(err)
 		return fmt.Errorf(err)
 	}
 
-	if waitErr := cmd.Wait(); waitErr != nil {
-		err := fmt.Sprintf("error while executing command to undeploy on pm2 : %s", waitErr)
+	// a sleeping app was already stopped
+	if service.pr.Sleeping {
+		return nil
+	}
+
+	if err := service.stopOnRuntime(ctx); err != nil {
+		err := fmt.Sprintf("error while undeploying from %s : %s", service.deployedWith(), err)
 		service.log(err)
 		return fmt.Errorf(err)
 	}
 
 	return nil
 }
+
+// stopOnRuntime stops the app on the runtime it is currently deployed with
+func (service *DeploymentService) stopOnRuntime(ctx context.Context) error {
+	deployer, err := NewDeployer(service.deployedWith(), service.monitor, service.appConfig.PM2Namespace)
+	if err != nil {
+		return err
+	}
+
+	return deployer.Stop(ctx, service.pr.GetDeployedAppName())
+}
@@ -0,0 +1,192 @@
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DockerDeployer builds an image from the Dockerfile of the repository and runs it,
+// publishing the allocated port. The container only gets the variables of the app, not the ones of imbere.
+// Every build of a PR (slot) has its own image, it is kept while the build is so that rollbacks and waking up
+// a sleeping preview run it again without building it, see RemoveImage.
+type DockerDeployer struct {
+	output Output
+}
+
+func containerName(name string) string {
+	return "imbere-" + name
+}
+
+func (deployer *DockerDeployer) Start(ctx context.Context, spec DeploySpec) error {
+	image := containerName(spec.Name)
+
+	if imageExists(ctx, image) {
+		deployer.output.AddLog(fmt.Sprintf("Running the image %s that was already built", image))
+	} else {
+		build := exec.CommandContext(ctx, "docker", "build", "-t", image, "-f", filepath.Join(spec.Dir, spec.Dockerfile), spec.Dir)
+		if err := runCommand(deployer.output, build); err != nil {
+			return err
+		}
+	}
+
+	address, err := bindAddress(ctx, spec.Host)
+	if err != nil {
+		return err
+	}
+
+	// the app is only published where imbere reaches it, not on every interface of the host
+	port := strconv.Itoa(int(spec.Port))
+	args := []string{"run", "-d", "--name", containerName(spec.Name), "--restart", "unless-stopped", "-p", address + ":" + port + ":" + port}
+
+	if spec.Sandboxed {
+		args = append(args, "--cap-drop", "ALL", "--security-opt", "no-new-privileges", "--pids-limit", "512")
+	}
+
+	// on the command line the values would be visible to anyone listing the processes of the host
+	envFile, err := writeEnvFile(spec.Env)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(envFile)
+
+	args = append(args, "--env-file", envFile, image)
+
+	return runCommand(deployer.output, exec.CommandContext(ctx, "docker", args...))
+}
+
+// bindAddress gives the address docker publishes the port of the app on, the one of the host apps are reached on
+func bindAddress(ctx context.Context, host string) (string, error) {
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil || len(ips) == 0 {
+		return "", fmt.Errorf("could not resolve the preview host %q to publish the app on: %v", host, err)
+	}
+
+	// docker and the apps usually listen on ipv4, ie. localhost is 127.0.0.1 rather than ::1
+	ip := ips[0]
+	for _, candidate := range ips {
+		if candidate.To4() != nil {
+			ip = candidate
+			break
+		}
+	}
+
+	if ip.To4() == nil {
+		return "[" + ip.String() + "]", nil
+	}
+
+	return ip.String(), nil
+}
+
+// imageExists tells if docker has the image
+func imageExists(ctx context.Context, image string) bool {
+	return exec.CommandContext(ctx, "docker", "image", "inspect", image).Run() == nil
+}
+
+// RemoveImage removes the image built for the app of a build once the build itself is removed.
+// There is nothing to remove on hosts without docker, or when the build was not deployed with it.
+func RemoveImage(ctx context.Context, output Output, name string) error {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return nil
+	}
+
+	image := containerName(name)
+	if !imageExists(ctx, image) {
+		return nil
+	}
+
+	return runCommand(output, exec.CommandContext(ctx, "docker", "rmi", image))
+}
+
+// writeEnvFile writes the variables of the app to a file only imbere can read (CreateTemp makes it 0600),
+// it is removed once the container is created
+func writeEnvFile(env []string) (string, error) {
+	file, err := os.CreateTemp("", "imbere-env-*")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	for _, variable := range env {
+		if strings.ContainsAny(variable, "\r\n") {
+			os.Remove(file.Name())
+			return "", fmt.Errorf("the value of %s spans several lines, docker env files can not hold it", strings.SplitN(variable, "=", 2)[0])
+		}
+
+		if _, err := fmt.Fprintln(file, variable); err != nil {
+			os.Remove(file.Name())
+			return "", err
+		}
+	}
+
+	return file.Name(), nil
+}
+
+// Stop removes the container, its image is kept with the build (see RemoveImage)
+func (deployer *DockerDeployer) Stop(ctx context.Context, name string) error {
+	return deployer.removeContainer(ctx, name)
+}
+
+func (deployer *DockerDeployer) Status(ctx context.Context, name string) (RuntimeStatus, error) {
+	cmd := exec.CommandContext(ctx, "docker", "inspect", "-f", "{{.State.Status}}", containerName(name))
+
+	output, err := cmd.Output()
+	if err != nil {
+		// docker inspect fails when there is no such container
+		if _, ok := err.(*exec.ExitError); ok {
+			return RUNTIME_STATUS_NOT_FOUND, nil
+		}
+
+		return "", err
+	}
+
+	switch strings.TrimSpace(string(output)) {
+	case "running", "restarting":
+		return RUNTIME_STATUS_RUNNING, nil
+	case "dead":
+		return RUNTIME_STATUS_ERRORED, nil
+	default:
+		return RUNTIME_STATUS_STOPPED, nil
+	}
+}
+
+func (deployer *DockerDeployer) Logs(ctx context.Context, name string, lines int) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "docker", "logs", "--tail", strconv.Itoa(lines), containerName(name))
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, err
+	}
+
+	return splitLines(string(output)), nil
+}
+
+func (deployer *DockerDeployer) List(ctx context.Context) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "docker", "ps", "--all", "--filter", "name=^"+containerName(""), "--format", "{{.Names}}")
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, container := range splitLines(string(output)) {
+		names = append(names, strings.TrimPrefix(container, containerName("")))
+	}
+
+	return names, nil
+}
+
+func (deployer *DockerDeployer) removeContainer(ctx context.Context, name string) error {
+	status, err := deployer.Status(ctx, name)
+	if err != nil || status == RUNTIME_STATUS_NOT_FOUND {
+		return err
+	}
+
+	return runCommand(deployer.output, exec.CommandContext(ctx, "docker", "rm", "-f", containerName(name)))
+}
@@ -0,0 +1,134 @@
+package deployment
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testOutput keeps what the deployer logs, the output of the commands is not read
+type testOutput struct{}
+
+func (output testOutput) AddLog(line string) {}
+
+func (output testOutput) ListenToCmd(cmd *exec.Cmd) {}
+
+// fakeDocker puts a docker on the PATH that records its commands, it has the images listed in images
+func fakeDocker(t *testing.T, images ...string) func() []string {
+	t.Helper()
+
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+
+	script := `#!/bin/sh
+echo "$*" >> "` + calls + `"
+if [ "$1 $2" = "image inspect" ]; then
+	for image in ` + strings.Join(images, " ") + `; do
+		[ "$image" = "$3" ] && exit 0
+	done
+	exit 1
+fi
+`
+
+	if err := os.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return func() []string {
+		content, _ := os.ReadFile(calls)
+		return strings.Split(strings.TrimSpace(string(content)), "\n")
+	}
+}
+
+// commandsOf gives the sub commands docker was called with, ie. "run"
+func commandsOf(calls []string) []string {
+	commands := []string{}
+	for _, call := range calls {
+		commands = append(commands, strings.Fields(call)[0])
+	}
+
+	return commands
+}
+
+func TestDockerStartReusesTheImageOfTheBuild(t *testing.T) {
+	tests := []struct {
+		name   string
+		images []string
+		want   []string
+	}{
+		{"new build", nil, []string{"image", "build", "run"}},
+		{"build that was already deployed", []string{"imbere-7-2"}, []string{"image", "run"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := fakeDocker(t, test.images...)
+			deployer := &DockerDeployer{output: testOutput{}}
+
+			spec := DeploySpec{Name: "7-2", Dir: t.TempDir(), Port: 4321, Host: "127.0.0.1", Dockerfile: "Dockerfile"}
+			if err := deployer.Start(context.Background(), spec); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.Join(commandsOf(calls()), " "); got != strings.Join(test.want, " ") {
+				t.Errorf("docker commands = %q, want %q", got, strings.Join(test.want, " "))
+			}
+		})
+	}
+}
+
+func TestDockerStopKeepsTheImage(t *testing.T) {
+	calls := fakeDocker(t, "imbere-7-2")
+	deployer := &DockerDeployer{output: testOutput{}}
+
+	if err := deployer.Stop(context.Background(), "7-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, call := range calls() {
+		if strings.HasPrefix(call, "rmi") {
+			t.Errorf("Stop() removed the image: %q", call)
+		}
+	}
+
+	if err := RemoveImage(context.Background(), testOutput{}, "7-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if last := calls()[len(calls())-1]; last != "rmi imbere-7-2" {
+		t.Errorf("RemoveImage() ran %q, want rmi imbere-7-2", last)
+	}
+}
+
+func TestDockerPublishesOnThePreviewHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"127.0.0.1", "127.0.0.1:4321:4321"},
+		{"localhost", "127.0.0.1:4321:4321"},
+		{"::1", "[::1]:4321:4321"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			calls := fakeDocker(t, "imbere-7-2")
+			deployer := &DockerDeployer{output: testOutput{}}
+
+			spec := DeploySpec{Name: "7-2", Dir: t.TempDir(), Port: 4321, Host: test.host}
+			if err := deployer.Start(context.Background(), spec); err != nil {
+				t.Fatal(err)
+			}
+
+			run := calls()[len(calls())-1]
+			if !strings.Contains(run, " -p "+test.want+" ") {
+				t.Errorf("docker %s, want the port published on %s", run, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/rssb/imbere/pkg/repo_config"
+	"github.com/rssb/imbere/pkg/utils"
+)
+
+// healthCheck probes a deployed app until it is ready, see repo_config.HealthCheck
+type healthCheck struct {
+	check    repo_config.HealthCheck
+	host     string // host the apps listen on, see config.PreviewConfig.Host
+	spec     DeploySpec
+	deployer Deployer // tells when the app crashed, so that the retries are not waited for
+	output   Output
+}
+
+// wait probes the app until it answers, it gives the reason of the last failed probe once the retries run out
+func (health *healthCheck) wait(ctx context.Context) error {
+	interval := time.Duration(health.check.Interval) * time.Second
+
+	var err error
+
+	for probe := 1; probe <= health.check.Retries; probe++ {
+		if err = health.probe(ctx); err == nil {
+			health.output.AddLog(fmt.Sprintf("%s is ready (probe %d/%d)", health.describe(), probe, health.check.Retries))
+			return nil
+		}
+
+		health.output.AddLog(fmt.Sprintf("%s is not ready (probe %d/%d): %s", health.describe(), probe, health.check.Retries, err))
+
+		if status, statusErr := health.deployer.Status(ctx, health.spec.Name); statusErr == nil && (status == RUNTIME_STATUS_ERRORED || status == RUNTIME_STATUS_NOT_FOUND) {
+			return fmt.Errorf("the app is %s on its runtime: %v", status, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+
+	return fmt.Errorf("the app was not ready after %d probes: %v", health.check.Retries, err)
+}
+
+// probe checks the app once, within the timeout of the health check
+func (health *healthCheck) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(health.check.Timeout)*time.Second)
+	defer cancel()
+
+	address := net.JoinHostPort(health.host, strconv.Itoa(int(health.spec.Port)))
+
+	switch {
+	case health.check.Command != "":
+		return health.probeCommand(ctx)
+	case health.check.Path != "":
+		return health.probeHTTP(ctx, "http://"+address+health.check.Path)
+	default:
+		dialer := net.Dialer{}
+
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}
+}
+
+func (health *healthCheck) probeHTTP(ctx context.Context, url string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != health.check.ExpectedStatus {
+		return fmt.Errorf("GET %s answered %d instead of %d", health.check.Path, response.StatusCode, health.check.ExpectedStatus)
+	}
+
+	return nil
+}
+
+// probeCommand runs the command of the health check, sandboxed apps are checked from inside their container
+func (health *healthCheck) probeCommand(ctx context.Context) error {
+	var cmd *exec.Cmd
+
+	if health.spec.Sandboxed {
+		cmd = exec.CommandContext(ctx, "docker", "exec", containerName(health.spec.Name), "sh", "-c", health.check.Command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", health.check.Command)
+		cmd.Dir = health.spec.Dir
+		cmd.Env = append(repo_config.HostEnv(), health.spec.Env...)
+	}
+
+	utils.KillProcessGroupOnCancel(cmd)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, lastLine(string(output)))
+	}
+
+	return nil
+}
+
+func (health *healthCheck) describe() string {
+	switch {
+	case health.check.Command != "":
+		return "health check command"
+	case health.check.Path != "":
+		return "GET " + health.check.Path
+	default:
+		return fmt.Sprintf("port %d", health.spec.Port)
+	}
+}
+
+func lastLine(output string) string {
+	lines := splitLines(output)
+	if len(lines) == 0 {
+		return ""
+	}
+
+	return lines[len(lines)-1]
+}
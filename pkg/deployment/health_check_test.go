@@ -0,0 +1,165 @@
+package deployment
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rssb/imbere/pkg/repo_config"
+)
+
+// statusDeployer is a runtime that always reports the app with the same status
+type statusDeployer struct {
+	status RuntimeStatus
+}
+
+func (deployer statusDeployer) Start(ctx context.Context, spec DeploySpec) error { return nil }
+
+func (deployer statusDeployer) Stop(ctx context.Context, name string) error { return nil }
+
+func (deployer statusDeployer) Status(ctx context.Context, name string) (RuntimeStatus, error) {
+	return deployer.status, nil
+}
+
+func (deployer statusDeployer) Logs(ctx context.Context, name string, lines int) ([]string, error) {
+	return nil, nil
+}
+
+func (deployer statusDeployer) List(ctx context.Context) ([]string, error) { return nil, nil }
+
+func newTestHealthCheck(t *testing.T, check repo_config.HealthCheck, port int32) *healthCheck {
+	t.Helper()
+
+	if check.ExpectedStatus == 0 {
+		check.ExpectedStatus = repo_config.DEFAULT_HEALTH_CHECK_STATUS
+	}
+	check.Timeout = 1
+	check.Retries = max(check.Retries, 1)
+
+	return &healthCheck{
+		check:    check,
+		host:     "127.0.0.1",
+		spec:     DeploySpec{Name: "health", Dir: t.TempDir(), Port: port, Env: []string{"PORT=" + strconv.Itoa(int(port))}},
+		deployer: statusDeployer{RUNTIME_STATUS_RUNNING},
+		output:   testOutput{},
+	}
+}
+
+// portOf gives the port the test server listens on
+func portOf(t *testing.T, server *httptest.Server) int32 {
+	t.Helper()
+
+	address, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.Atoi(address.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return int32(port)
+}
+
+// closedPort gives a port nothing listens on
+func closedPort(t *testing.T) int32 {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	return int32(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			w.WriteHeader(http.StatusOK)
+		case "/teapot":
+			w.WriteHeader(http.StatusTeapot)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	up := portOf(t, server)
+	down := closedPort(t)
+
+	tests := []struct {
+		name  string
+		check repo_config.HealthCheck
+		port  int32
+		ready bool
+	}{
+		{"path answering the expected status", repo_config.HealthCheck{Path: "/health"}, up, true},
+		{"path answering another status", repo_config.HealthCheck{Path: "/starting"}, up, false},
+		{"path answering a custom expected status", repo_config.HealthCheck{Path: "/teapot", ExpectedStatus: http.StatusTeapot}, up, true},
+		{"app not listening", repo_config.HealthCheck{Path: "/health"}, down, false},
+		{"port accepting connections", repo_config.HealthCheck{}, up, true},
+		{"port refusing connections", repo_config.HealthCheck{}, down, false},
+		{"command succeeding with the port of the app", repo_config.HealthCheck{Command: `test "$PORT" = ` + strconv.Itoa(int(up))}, up, true},
+		{"command failing", repo_config.HealthCheck{Command: "exit 1"}, up, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := newTestHealthCheck(t, test.check, test.port).probe(context.Background())
+
+			if test.ready && err != nil {
+				t.Errorf("probe() = %v, want the app ready", err)
+			}
+
+			if !test.ready && err == nil {
+				t.Error("probe() reported the app ready")
+			}
+		})
+	}
+}
+
+func TestProbeCommandDoesNotSeeImbereSecrets(t *testing.T) {
+	t.Setenv("IMBERE_WEBHOOK_SECRET", "secret")
+
+	health := newTestHealthCheck(t, repo_config.HealthCheck{Command: `echo "webhook secret: $IMBERE_WEBHOOK_SECRET"; exit 1`}, closedPort(t))
+
+	err := health.probe(context.Background())
+	if err == nil || strings.Contains(err.Error(), "secret: secret") {
+		t.Errorf("probe() = %v, want it failed without the secret of imbere", err)
+	}
+}
+
+func TestWait(t *testing.T) {
+	down := closedPort(t)
+
+	// the retries are not waited for once the runtime reports the app crashed
+	crashed := newTestHealthCheck(t, repo_config.HealthCheck{Retries: 1000, Interval: 60}, down)
+	crashed.deployer = statusDeployer{RUNTIME_STATUS_ERRORED}
+
+	if err := crashed.wait(context.Background()); err == nil || !strings.Contains(err.Error(), "errored") {
+		t.Errorf("wait() of a crashed app = %v, want it to fail right away", err)
+	}
+
+	exhausted := newTestHealthCheck(t, repo_config.HealthCheck{Retries: 2}, down)
+
+	if err := exhausted.wait(context.Background()); err == nil || !strings.Contains(err.Error(), "not ready after 2 probes") {
+		t.Errorf("wait() once the retries run out = %v, want it failed after 2 probes", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cancelled := newTestHealthCheck(t, repo_config.HealthCheck{Retries: 1000, Interval: 60}, down)
+	if err := cancelled.wait(ctx); err == nil {
+		t.Error("wait() of a cancelled deployment went through")
+	}
+}
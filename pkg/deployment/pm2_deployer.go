@@ -0,0 +1,137 @@
+package deployment
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/rssb/imbere/pkg/repo_config"
+)
+
+// PM2Deployer runs apps with pm2, in the namespace of imbere
+type PM2Deployer struct {
+	output    Output
+	namespace string
+}
+
+// what we need from `pm2 jlist`
+type pm2Process struct {
+	Name   string `json:"name"`
+	PM2Env struct {
+		Status    string `json:"status"`
+		Namespace string `json:"namespace"`
+	} `json:"pm2_env"`
+}
+
+func (deployer *PM2Deployer) Start(ctx context.Context, spec DeploySpec) error {
+	cmd := deployer.command(ctx, "start", spec.Command, "--name", spec.Name, "--namespace", deployer.namespace)
+	cmd.Dir = spec.Dir
+	cmd.Env = append(cmd.Env, spec.Env...)
+
+	return runCommand(deployer.output, cmd)
+}
+
+func (deployer *PM2Deployer) Stop(ctx context.Context, name string) error {
+	cmd := deployer.command(ctx, "delete", name)
+
+	return runCommand(deployer.output, cmd)
+}
+
+func (deployer *PM2Deployer) Status(ctx context.Context, name string) (RuntimeStatus, error) {
+	processes, err := deployer.list(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, process := range processes {
+		if process.Name != name {
+			continue
+		}
+
+		switch process.PM2Env.Status {
+		case "online", "launching":
+			return RUNTIME_STATUS_RUNNING, nil
+		case "errored":
+			return RUNTIME_STATUS_ERRORED, nil
+		default:
+			return RUNTIME_STATUS_STOPPED, nil
+		}
+	}
+
+	return RUNTIME_STATUS_NOT_FOUND, nil
+}
+
+func (deployer *PM2Deployer) Logs(ctx context.Context, name string, lines int) ([]string, error) {
+	cmd := deployer.command(ctx, "logs", name, "--lines", strconv.Itoa(lines), "--nostream", "--raw")
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return splitLines(string(output)), nil
+}
+
+func (deployer *PM2Deployer) List(ctx context.Context) ([]string, error) {
+	processes, err := deployer.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, process := range processes {
+		names = append(names, process.Name)
+	}
+
+	return names, nil
+}
+
+// list gives the processes of the imbere namespace
+func (deployer *PM2Deployer) list(ctx context.Context) ([]pm2Process, error) {
+	output, err := deployer.command(ctx, "jlist").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []pm2Process
+	if err := json.Unmarshal(output, &processes); err != nil {
+		return nil, err
+	}
+
+	namespaced := []pm2Process{}
+	for _, process := range processes {
+		if process.PM2Env.Namespace == deployer.namespace {
+			namespaced = append(namespaced, process)
+		}
+	}
+
+	return namespaced, nil
+}
+
+func splitLines(output string) []string {
+	lines := []string{}
+
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+// command gives a pm2 command, it may start the pm2 daemon whose environment the apps inherit:
+// it only gets the variables of the host that PRs can see, and the directory of the daemon
+func (deployer *PM2Deployer) command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "pm2", args...)
+	cmd.Env = repo_config.HostEnv()
+
+	if home, ok := os.LookupEnv("PM2_HOME"); ok {
+		cmd.Env = append(cmd.Env, "PM2_HOME="+home)
+	}
+
+	return cmd
+}
@@ -0,0 +1,258 @@
+package deployment
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rssb/imbere/pkg/repo_config"
+	"github.com/rssb/imbere/pkg/utils"
+)
+
+// how many lines of output are kept for each app
+const processLogLines = 1000
+
+// how many times in a row an app is restarted after it crashes before it is considered errored
+const processMaxRestarts = 5
+
+// how long a stopped app gets to exit before it is killed
+const processStopTimeout = 10 * time.Second
+
+// ProcessDeployer runs apps as child processes of imbere, restarting them when they crash.
+// It does not need any external daemon, but apps do not survive a restart of imbere.
+type ProcessDeployer struct {
+	output Output
+}
+
+// supervised apps by name, shared by every ProcessDeployer
+var supervised = struct {
+	sync.Mutex
+	processes map[string]*supervisedProcess
+}{processes: map[string]*supervisedProcess{}}
+
+type supervisedProcess struct {
+	spec   DeploySpec
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	status   RuntimeStatus
+	restarts int
+	logs     []string
+}
+
+func (deployer *ProcessDeployer) Start(ctx context.Context, spec DeploySpec) error {
+	supervised.Lock()
+	defer supervised.Unlock()
+
+	if existing, ok := supervised.processes[spec.Name]; ok && existing.getStatus() == RUNTIME_STATUS_RUNNING {
+		return fmt.Errorf("%s is already running", spec.Name)
+	}
+
+	// the app outlives the deployment, it is not bound to its context
+	processCtx, cancel := context.WithCancel(context.Background())
+	process := &supervisedProcess{
+		spec:   spec,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		status: RUNTIME_STATUS_RUNNING,
+	}
+
+	started := make(chan error, 1)
+	go process.supervise(processCtx, started)
+
+	if err := <-started; err != nil {
+		cancel()
+		return err
+	}
+
+	supervised.processes[spec.Name] = process
+	deployer.output.AddLog(fmt.Sprintf("started %s in %s", spec.Name, spec.Dir))
+
+	return nil
+}
+
+func (deployer *ProcessDeployer) Stop(ctx context.Context, name string) error {
+	supervised.Lock()
+	process, ok := supervised.processes[name]
+	delete(supervised.processes, name)
+	supervised.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	process.stop()
+	deployer.output.AddLog(fmt.Sprintf("stopped %s", name))
+
+	return nil
+}
+
+func (deployer *ProcessDeployer) Status(ctx context.Context, name string) (RuntimeStatus, error) {
+	supervised.Lock()
+	process, ok := supervised.processes[name]
+	supervised.Unlock()
+
+	if !ok {
+		return RUNTIME_STATUS_NOT_FOUND, nil
+	}
+
+	return process.getStatus(), nil
+}
+
+func (deployer *ProcessDeployer) Logs(ctx context.Context, name string, lines int) ([]string, error) {
+	supervised.Lock()
+	process, ok := supervised.processes[name]
+	supervised.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%s is not deployed", name)
+	}
+
+	process.mu.Lock()
+	defer process.mu.Unlock()
+
+	start := len(process.logs) - lines
+	if start < 0 {
+		start = 0
+	}
+
+	return append([]string{}, process.logs[start:]...), nil
+}
+
+// List returns the names of the supervised apps
+func (deployer *ProcessDeployer) List(ctx context.Context) ([]string, error) {
+	supervised.Lock()
+	defer supervised.Unlock()
+
+	names := []string{}
+	for name := range supervised.processes {
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// supervise runs the app until it is stopped, restarting it when it exits on its own.
+// The outcome of the first start is sent on started.
+func (process *supervisedProcess) supervise(ctx context.Context, started chan<- error) {
+	defer close(process.done)
+
+	for {
+		cmd := exec.Command("sh", "-c", process.spec.Command)
+		cmd.Dir = process.spec.Dir
+		cmd.Env = append(repo_config.HostEnv(), process.spec.Env...)
+		utils.SetProcessGroup(cmd)
+
+		stdout, _ := cmd.StdoutPipe()
+		stderr, _ := cmd.StderrPipe()
+
+		err := cmd.Start()
+
+		if started != nil {
+			started <- err
+			started = nil
+		}
+
+		if err != nil {
+			process.setStatus(RUNTIME_STATUS_ERRORED)
+			return
+		}
+
+		process.mu.Lock()
+		process.cmd = cmd
+		process.status = RUNTIME_STATUS_RUNNING
+		process.mu.Unlock()
+
+		// Wait closes the pipes, the last lines of an app that crashed (the ones that tell why) are read first
+		collected := sync.WaitGroup{}
+		collected.Add(2)
+		go process.collect(stdout, &collected)
+		go process.collect(stderr, &collected)
+		collected.Wait()
+
+		waitErr := cmd.Wait()
+
+		select {
+		case <-ctx.Done():
+			process.setStatus(RUNTIME_STATUS_STOPPED)
+			return
+		default:
+		}
+
+		process.mu.Lock()
+		process.restarts++
+		restarts := process.restarts
+		process.logs = append(process.logs, fmt.Sprintf("[imbere] app exited (%v), restart %d/%d", waitErr, restarts, processMaxRestarts))
+		process.mu.Unlock()
+
+		if restarts > processMaxRestarts {
+			process.setStatus(RUNTIME_STATUS_ERRORED)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			process.setStatus(RUNTIME_STATUS_STOPPED)
+			return
+		case <-time.After(time.Duration(restarts) * time.Second):
+		}
+	}
+}
+
+// stop asks the app to exit, and kills it if it does not in time
+func (process *supervisedProcess) stop() {
+	process.cancel()
+
+	process.mu.Lock()
+	cmd := process.cmd
+	process.mu.Unlock()
+
+	if cmd != nil {
+		utils.SignalProcessGroup(cmd, syscall.SIGTERM)
+	}
+
+	select {
+	case <-process.done:
+	case <-time.After(processStopTimeout):
+		if cmd != nil {
+			utils.SignalProcessGroup(cmd, syscall.SIGKILL)
+		}
+		<-process.done
+	}
+}
+
+func (process *supervisedProcess) collect(reader io.Reader, collected *sync.WaitGroup) {
+	defer collected.Done()
+
+	scanner := bufio.NewScanner(reader)
+
+	for scanner.Scan() {
+		process.mu.Lock()
+		process.logs = append(process.logs, scanner.Text())
+		if len(process.logs) > processLogLines {
+			process.logs = process.logs[len(process.logs)-processLogLines:]
+		}
+		process.mu.Unlock()
+	}
+}
+
+func (process *supervisedProcess) getStatus() RuntimeStatus {
+	process.mu.Lock()
+	defer process.mu.Unlock()
+
+	return process.status
+}
+
+func (process *supervisedProcess) setStatus(status RuntimeStatus) {
+	process.mu.Lock()
+	defer process.mu.Unlock()
+
+	process.status = status
+}
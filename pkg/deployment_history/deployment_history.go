@@ -0,0 +1,152 @@
+package deployment_history
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+	"github.com/rssb/imbere/pkg/job_queue"
+	"github.com/rssb/imbere/pkg/utils"
+)
+
+const defaultLimit = 20
+const maxLimit = 100
+
+type stepResponse struct {
+	Step       string     `json:"step"`
+	Outcome    string     `json:"outcome"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+type deploymentResponse struct {
+	Attempt       int64          `json:"attempt"`
+	Slot          int64          `json:"slot"` // attempt whose build was deployed, see HandleRollback
+	HeadSHA       string         `json:"head_sha"`
+	TriggerEvent  string         `json:"trigger_event"`
+	Outcome       string         `json:"outcome"`
+	FailureReason string         `json:"failure_reason,omitempty"`
+	Port          int32          `json:"port,omitempty"`
+	StartedAt     time.Time      `json:"started_at"`
+	FinishedAt    *time.Time     `json:"finished_at"`
+	DurationMs    int64          `json:"duration_ms"`
+	Steps         []stepResponse `json:"steps"`
+}
+
+// HandleGetDeployments gives the deployments of a PR with the timing of their steps, latest first, at most ?limit= of them
+func HandleGetDeployments(c *gin.Context) {
+	prId, err := strconv.ParseInt(c.Param("pr_id"), 10, 64)
+	if err != nil {
+		utils.ReturnError(c, "invalid pr id")
+		return
+	}
+
+	limit := defaultLimit
+	if value := c.Query("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			utils.ReturnError(c, "invalid limit")
+			return
+		}
+
+		limit = min(limit, maxLimit)
+	}
+
+	deploymentRepo := db.DeploymentRepo{}
+
+	deployments, err := deploymentRepo.ListByPrID(prId, limit)
+	if err != nil {
+		utils.ReturnError(c, err.Error())
+		return
+	}
+
+	response := []deploymentResponse{}
+	for _, deployment := range deployments {
+		response = append(response, toResponse(deployment))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"deployments": response,
+	})
+}
+
+// Body of the rollback, without a sha the latest build of another commit than the live one is deployed
+type rollbackRequest struct {
+	SHA string `json:"sha"`
+}
+
+// HandleRollback queues the rollback of a PR to a previous successful build, see pull_request.PullRequestService.Rollback.
+// How it went is shown on the PR comment and in the deployments of the PR.
+func HandleRollback(queue *job_queue.JobQueue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		prId, err := strconv.ParseInt(c.Param("pr_id"), 10, 64)
+		if err != nil {
+			utils.ReturnError(c, "invalid pr id")
+			return
+		}
+
+		var request rollbackRequest
+
+		// the body is optional
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&request); err != nil {
+				utils.ReturnError(c, err.Error())
+				return
+			}
+		}
+
+		prRepo := db.PullRequestRepo{}
+
+		pr, err := prRepo.GetByPrID(prId)
+		if err != nil {
+			utils.ReturnError(c, err.Error())
+			return
+		}
+
+		if pr == nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"message": "pull request not found",
+			})
+			return
+		}
+
+		if err := queue.EnqueueActionWith(prId, constants.INTERNAL_ACTION_ROLLBACK, strings.ToLower(request.SHA)); err != nil {
+			utils.ReturnError(c, err.Error())
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "rollback queued",
+		})
+	}
+}
+
+func toResponse(deployment db.Deployment) deploymentResponse {
+	steps := []stepResponse{}
+	for _, step := range deployment.Steps {
+		steps = append(steps, stepResponse{
+			Step:       utils.GetProgressStepName(step.Step),
+			Outcome:    utils.GetOutcomeName(step.Outcome),
+			StartedAt:  step.StartedAt,
+			FinishedAt: step.FinishedAt,
+		})
+	}
+
+	return deploymentResponse{
+		Attempt:       deployment.Attempt,
+		Slot:          deployment.GetSlot(),
+		HeadSHA:       deployment.HeadSHA,
+		TriggerEvent:  deployment.TriggerEvent,
+		Outcome:       utils.GetOutcomeName(deployment.Outcome),
+		FailureReason: deployment.FailureReason,
+		Port:          deployment.Port,
+		StartedAt:     deployment.StartedAt,
+		FinishedAt:    deployment.FinishedAt,
+		DurationMs:    deployment.Duration().Milliseconds(),
+		Steps:         steps,
+	}
+}
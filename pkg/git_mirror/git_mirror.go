@@ -0,0 +1,277 @@
+package git_mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rssb/imbere/pkg/credentials"
+	"github.com/rssb/imbere/pkg/utils"
+)
+
+// Output receives what git does, see process_monitor.ProcessMonitor
+type Output interface {
+	AddLog(line string)
+	ListenToCmd(cmd *exec.Cmd)
+}
+
+// a mirror is changed by one deployment at a time, PRs of a repository can be deployed at the same time
+var (
+	locksMu sync.Mutex
+	locks   = map[string]*sync.Mutex{}
+)
+
+// fetchError is an error getting the commit from the repository, as opposed to a broken mirror or worktree
+type fetchError struct {
+	err error
+}
+
+func (e *fetchError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fetchError) Unwrap() error {
+	return e.err
+}
+
+// Mirror is a bare repository shared by the PRs of a repository, each PR is checked out in a worktree of it
+// which is updated in place so that what the build leaves (ie. node_modules) is kept between deployments.
+type Mirror struct {
+	Dir    string
+	output Output
+}
+
+// New gives the mirror of a repository, under buildDir next to the directories of the PRs
+func New(buildDir string, owner string, repo string, output Output) *Mirror {
+	return &Mirror{
+		Dir:    filepath.Join(buildDir, ".mirrors", owner, repo+".git"),
+		output: output,
+	}
+}
+
+// Checkout brings the worktree in dir to the exact commit sha, ref is fetched first from the repository.
+// A worktree that can not be updated is created again from scratch, so is the mirror if it is corrupt.
+func (mirror *Mirror) Checkout(ctx context.Context, creds *credentials.Credentials, ref string, sha string, dir string) error {
+	lock := mirror.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	err := mirror.update(ctx, creds, ref, sha, dir)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+
+	// the repository could not be reached or the commit is gone, cloning again would not help
+	var fetchErr *fetchError
+	if errors.As(err, &fetchErr) && mirror.isHealthy(ctx) {
+		return err
+	}
+
+	mirror.output.AddLog(fmt.Sprintf("could not update %s incrementally (%s), cloning it again", dir, err))
+
+	if err := mirror.remove(ctx, dir); err != nil {
+		return err
+	}
+
+	return mirror.update(ctx, creds, ref, sha, dir)
+}
+
+func (mirror *Mirror) update(ctx context.Context, creds *credentials.Credentials, ref string, sha string, dir string) error {
+	if err := mirror.init(ctx); err != nil {
+		return err
+	}
+
+	// every PR fetches into its own ref, worktrees of the other PRs are not affected
+	localRef := "refs/imbere/" + strings.TrimPrefix(ref, "refs/")
+	fetch := creds.Command(ctx, "-C", mirror.Dir, "fetch", "--no-tags", "--prune", creds.URL, "+"+ref+":"+localRef)
+
+	if err := mirror.run(fetch); err != nil {
+		return &fetchError{err}
+	}
+
+	if sha == "" {
+		sha = localRef
+	} else if err := mirror.git(ctx, "-C", mirror.Dir, "cat-file", "-e", sha+"^{commit}"); err != nil {
+		return &fetchError{fmt.Errorf("commit %s is not on %s anymore", sha, ref)}
+	}
+
+	if mirror.isWorktree(ctx, dir) {
+		if err := mirror.git(ctx, "-C", dir, "reset", "--hard", sha); err != nil {
+			return err
+		}
+
+		// ignored files (dependencies, build cache) are kept, they are what makes the next build faster
+		return mirror.git(ctx, "-C", dir, "clean", "-fd")
+	}
+
+	// a directory left by a full clone (or half removed) is replaced by a worktree
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	if err := mirror.git(ctx, "-C", mirror.Dir, "worktree", "prune"); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+
+	return mirror.git(ctx, "-C", mirror.Dir, "worktree", "add", "--detach", "--force", dir, sha)
+}
+
+// init creates the bare repository, if it does not exist yet
+func (mirror *Mirror) init(ctx context.Context) error {
+	if _, err := os.Stat(filepath.Join(mirror.Dir, "HEAD")); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(mirror.Dir, 0755); err != nil {
+		return err
+	}
+
+	mirror.output.AddLog(fmt.Sprintf("creating mirror %s", mirror.Dir))
+
+	return mirror.git(ctx, "init", "--bare", "--quiet", mirror.Dir)
+}
+
+// isHealthy tells if the objects of the mirror can all be read
+func (mirror *Mirror) isHealthy(ctx context.Context) bool {
+	return exec.CommandContext(ctx, "git", "-C", mirror.Dir, "fsck", "--connectivity-only", "--no-dangling").Run() == nil
+}
+
+// isWorktree tells if dir is a healthy worktree of the mirror
+func (mirror *Mirror) isWorktree(ctx context.Context, dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		return false
+	}
+
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "--git-common-dir").Output()
+	if err != nil {
+		return false
+	}
+
+	commonDir := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(commonDir) {
+		commonDir = filepath.Join(dir, commonDir)
+	}
+
+	return sameDir(commonDir, mirror.Dir) && exec.CommandContext(ctx, "git", "-C", dir, "status", "--porcelain").Run() == nil
+}
+
+// Head gives the commit checked out in dir
+func (mirror *Mirror) Head(ctx context.Context, dir string) (string, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", fmt.Errorf("could not read the commit checked out in %s: %v", dir, err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// RemoveWorktree deletes the checkout of a PR, the mirror is kept for the other PRs
+func (mirror *Mirror) RemoveWorktree(ctx context.Context, dir string) error {
+	lock := mirror.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(mirror.Dir); err != nil {
+		return nil // PRs cloned before mirrors existed
+	}
+
+	return mirror.git(ctx, "-C", mirror.Dir, "worktree", "prune")
+}
+
+// MoveWorktree moves the checkout of a PR to another directory with everything git ignores in it (ie. node_modules).
+// Directories that are not worktrees of the mirror (ie. full clones) are moved as they are.
+func (mirror *Mirror) MoveWorktree(ctx context.Context, from string, to string) error {
+	lock := mirror.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !mirror.isWorktree(ctx, from) {
+		return os.Rename(from, to)
+	}
+
+	return mirror.git(ctx, "-C", mirror.Dir, "worktree", "move", "--force", from, to)
+}
+
+// remove deletes the worktree, it is created again on the next update. The mirror holds the worktrees
+// of the other PRs, it is only deleted too when it is corrupt.
+func (mirror *Mirror) remove(ctx context.Context, dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	if !mirror.isHealthy(ctx) {
+		mirror.output.AddLog(fmt.Sprintf("mirror %s is corrupt, cloning it again", mirror.Dir))
+		return os.RemoveAll(mirror.Dir)
+	}
+
+	return mirror.git(ctx, "-C", mirror.Dir, "worktree", "prune")
+}
+
+func (mirror *Mirror) lock() *sync.Mutex {
+	locksMu.Lock()
+	defer locksMu.Unlock()
+
+	if locks[mirror.Dir] == nil {
+		locks[mirror.Dir] = &sync.Mutex{}
+	}
+
+	return locks[mirror.Dir]
+}
+
+// git runs a git command that does not need credentials
+func (mirror *Mirror) git(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	return mirror.run(cmd)
+}
+
+// run runs a git command, it is killed with what it started (ie. ssh) once its context is done
+func (mirror *Mirror) run(cmd *exec.Cmd) error {
+	utils.KillProcessGroupOnCancel(cmd)
+	mirror.output.ListenToCmd(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", commandName(cmd), err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s failed: %v", commandName(cmd), err)
+	}
+
+	return nil
+}
+
+// commandName gives the git sub command (ie. "git fetch"), the arguments before it hold the credential helper
+func commandName(cmd *exec.Cmd) string {
+	for i := 1; i < len(cmd.Args); i++ {
+		if cmd.Args[i] == "-c" || cmd.Args[i] == "-C" {
+			i++ // skip the value of the option
+			continue
+		}
+
+		return "git " + cmd.Args[i]
+	}
+
+	return "git"
+}
+
+func sameDir(a string, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+
+	return errA == nil && errB == nil && filepath.Clean(absA) == filepath.Clean(absB)
+}
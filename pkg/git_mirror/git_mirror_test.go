@@ -0,0 +1,160 @@
+package git_mirror
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/credentials"
+	"github.com/rssb/imbere/pkg/db"
+)
+
+// testOutput keeps what the mirror logs, the output of git is not read
+type testOutput struct {
+	logs []string
+}
+
+func (output *testOutput) AddLog(line string) {
+	output.logs = append(output.logs, line)
+}
+
+func (output *testOutput) ListenToCmd(cmd *exec.Cmd) {}
+
+// newTestRepository creates a git repository with a commit on main, it gives its path and the sha of the commit
+func newTestRepository(t *testing.T) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	git(t, dir, "init", "--quiet", "--initial-branch", "main")
+
+	if err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("node_modules\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	git(t, dir, "add", ".gitignore")
+	git(t, dir, "commit", "--quiet", "-m", "init")
+
+	return dir, git(t, dir, "rev-parse", "HEAD")
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=imbere", "GIT_AUTHOR_EMAIL=imbere@example.com", "GIT_COMMITTER_NAME=imbere", "GIT_COMMITTER_EMAIL=imbere@example.com")
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, output)
+	}
+
+	return strings.TrimSpace(string(output))
+}
+
+func newTestCredentials(t *testing.T, repository string) *credentials.Credentials {
+	t.Helper()
+
+	creds, err := credentials.ForPR(&db.PullRequest{RepoAddress: repository}, &db.RepositorySettings{CloneAuth: constants.CLONE_AUTH_NONE}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return creds
+}
+
+func TestBrokenWorktreeKeepsTheOthers(t *testing.T) {
+	repository, sha := newTestRepository(t)
+	creds := newTestCredentials(t, repository)
+	ctx := context.Background()
+
+	buildDir := t.TempDir()
+	output := &testOutput{}
+	mirror := New(buildDir, "rssb", "app", output)
+
+	broken := filepath.Join(buildDir, "app", "feature_1@1")
+	live := filepath.Join(buildDir, "app", "other_2@1")
+
+	for _, dir := range []string{broken, live} {
+		if err := mirror.Checkout(ctx, creds, "refs/heads/main", sha, dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// what the build of the live PR left, it is lost if its worktree is checked out again
+	installed := filepath.Join(live, "node_modules", "installed")
+	if err := os.MkdirAll(filepath.Dir(installed), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(installed, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a lock left by a killed git: the worktree looks fine but can not be reset
+	lockFile := filepath.Join(git(t, broken, "rev-parse", "--absolute-git-dir"), "index.lock")
+	if err := os.WriteFile(lockFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output.logs = nil
+
+	if err := mirror.Checkout(ctx, creds, "refs/heads/main", sha, broken); err != nil {
+		t.Fatalf("Checkout() of the broken worktree failed: %s", err)
+	}
+
+	if !mirror.isWorktree(ctx, broken) || !mirror.isWorktree(ctx, live) {
+		t.Errorf("worktrees after the broken one is checked out again: broken %v, live %v, want both", mirror.isWorktree(ctx, broken), mirror.isWorktree(ctx, live))
+	}
+
+	if _, err := os.Stat(installed); err != nil {
+		t.Errorf("the build of the live PR is gone: %s", err)
+	}
+
+	if head, err := mirror.Head(ctx, live); err != nil || head != sha {
+		t.Errorf("Head() of the live PR = %q, %v, want %s", head, err, sha)
+	}
+
+	for _, line := range output.logs {
+		if strings.Contains(line, "creating mirror") || strings.Contains(line, "corrupt") {
+			t.Errorf("the mirror was cloned again: %q", line)
+		}
+	}
+}
+
+func TestCorruptMirrorIsClonedAgain(t *testing.T) {
+	repository, sha := newTestRepository(t)
+	creds := newTestCredentials(t, repository)
+	ctx := context.Background()
+
+	buildDir := t.TempDir()
+	mirror := New(buildDir, "rssb", "app", &testOutput{})
+	dir := filepath.Join(buildDir, "app", "feature_1@1")
+
+	if err := mirror.Checkout(ctx, creds, "refs/heads/main", sha, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// the objects of the mirror are lost
+	if err := os.RemoveAll(filepath.Join(mirror.Dir, "objects")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(mirror.Dir, "objects"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mirror.Checkout(ctx, creds, "refs/heads/main", sha, dir); err != nil {
+		t.Fatalf("Checkout() with a corrupt mirror failed: %s", err)
+	}
+
+	if !mirror.isHealthy(ctx) {
+		t.Error("the mirror is still corrupt")
+	}
+
+	if head, err := mirror.Head(ctx, dir); err != nil || head != sha {
+		t.Errorf("Head() = %q, %v, want %s", head, err, sha)
+	}
+}
@@ -0,0 +1,484 @@
+package github_fake
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rssb/imbere/pkg/client"
+)
+
+// Server is an in-process github api answering the requests imbere makes, and recording them
+// so that deployments can be run and checked without reaching github.
+//
+//	fake := github_fake.NewServer()
+//	defer fake.Close()
+//	handler := pull_request.NewJobHandler(appConfig, fake.Factory(), scheduler.New(appConfig.Concurrency))
+type Server struct {
+	server *httptest.Server
+
+	mu                 sync.Mutex
+	nextID             int64
+	comments           []Comment
+	checkRuns          []CheckRun
+	statuses           []Status
+	deployments        []Deployment
+	deploymentStatuses []DeploymentStatus
+	reactions          []Reaction
+	permissions        map[string]string // by owner/repo/user, users that are not in it have no permission
+}
+
+type Comment struct {
+	ID       int64
+	Owner    string
+	Repo     string
+	Number   int64
+	Body     string
+	Edits    int
+	EditedAt time.Time
+}
+
+type CheckRun struct {
+	ID         int64
+	Owner      string
+	Repo       string
+	HeadSHA    string
+	Name       string
+	Status     string
+	Conclusion string
+	Title      string
+	Summary    string
+	DetailsURL string
+	Updates    int
+}
+
+type Status struct {
+	Owner       string
+	Repo        string
+	SHA         string
+	Context     string
+	State       string
+	Description string
+	TargetURL   string
+}
+
+type Deployment struct {
+	ID          int64
+	Owner       string
+	Repo        string
+	Ref         string
+	Environment string
+	Transient   bool
+}
+
+type DeploymentStatus struct {
+	DeploymentID   int64
+	State          string
+	Description    string
+	EnvironmentURL string
+	LogURL         string
+}
+
+type Reaction struct {
+	CommentID int64
+	Owner     string
+	Repo      string
+	Content   string
+}
+
+func NewServer() *Server {
+	fake := &Server{
+		permissions: map[string]string{},
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+
+	router.POST("/repos/:owner/:repo/issues/:number/comments", fake.createComment)
+	router.PATCH("/repos/:owner/:repo/issues/comments/:id", fake.editComment)
+	router.POST("/repos/:owner/:repo/check-runs", fake.createCheckRun)
+	router.PATCH("/repos/:owner/:repo/check-runs/:id", fake.updateCheckRun)
+	router.POST("/repos/:owner/:repo/statuses/:sha", fake.createStatus)
+	router.POST("/repos/:owner/:repo/deployments", fake.createDeployment)
+	router.POST("/repos/:owner/:repo/deployments/:id/statuses", fake.createDeploymentStatus)
+	router.GET("/repos/:owner/:repo/collaborators/:user/permission", fake.getPermissionLevel)
+	router.POST("/repos/:owner/:repo/issues/comments/:id/reactions", fake.createReaction)
+
+	fake.server = httptest.NewServer(router)
+
+	return fake
+}
+
+// URL is the base url of the api
+func (fake *Server) URL() string {
+	return fake.server.URL
+}
+
+func (fake *Server) Close() {
+	fake.server.Close()
+}
+
+// Client gives a client of the fake api, the same one is used for every installation
+func (fake *Server) Client() client.GithubClient {
+	githubClient, err := client.NewGithubClientWithBaseURL(fake.server.Client(), fake.server.URL)
+	if err != nil {
+		// the url of an httptest server is always valid
+		panic(err)
+	}
+
+	return githubClient
+}
+
+// Factory can be injected in place of client.NewGithubClient
+func (fake *Server) Factory() client.Factory {
+	return func(installationID int64) (client.GithubClient, error) {
+		return fake.Client(), nil
+	}
+}
+
+func (fake *Server) Comments() []Comment {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return append([]Comment{}, fake.comments...)
+}
+
+func (fake *Server) CheckRuns() []CheckRun {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return append([]CheckRun{}, fake.checkRuns...)
+}
+
+func (fake *Server) Statuses() []Status {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return append([]Status{}, fake.statuses...)
+}
+
+func (fake *Server) Deployments() []Deployment {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return append([]Deployment{}, fake.deployments...)
+}
+
+// DeploymentStatuses gives the statuses posted on a deployment, in order
+func (fake *Server) DeploymentStatuses(deploymentID int64) []DeploymentStatus {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	statuses := []DeploymentStatus{}
+	for _, status := range fake.deploymentStatuses {
+		if status.DeploymentID == deploymentID {
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses
+}
+
+func (fake *Server) Reactions() []Reaction {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return append([]Reaction{}, fake.reactions...)
+}
+
+// SetPermission gives a user a permission on a repository, one of admin, write, read or none
+func (fake *Server) SetPermission(owner string, repo string, user string, permission string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.permissions[owner+"/"+repo+"/"+user] = permission
+}
+
+// newID must be called with the lock held
+func (fake *Server) newID() int64 {
+	fake.nextID++
+	return fake.nextID
+}
+
+func (fake *Server) createComment(c *gin.Context) {
+	var request struct {
+		Body string `json:"body"`
+	}
+
+	if !bind(c, &request) {
+		return
+	}
+
+	number, err := strconv.ParseInt(c.Param("number"), 10, 64)
+	if err != nil {
+		notFound(c)
+		return
+	}
+
+	fake.mu.Lock()
+	comment := Comment{
+		ID:     fake.newID(),
+		Owner:  c.Param("owner"),
+		Repo:   c.Param("repo"),
+		Number: number,
+		Body:   request.Body,
+	}
+	fake.comments = append(fake.comments, comment)
+	fake.mu.Unlock()
+
+	c.JSON(http.StatusCreated, gin.H{"id": comment.ID, "body": comment.Body})
+}
+
+func (fake *Server) editComment(c *gin.Context) {
+	var request struct {
+		Body string `json:"body"`
+	}
+
+	if !bind(c, &request) {
+		return
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	for i := range fake.comments {
+		comment := &fake.comments[i]
+		if strconv.FormatInt(comment.ID, 10) == c.Param("id") && comment.Owner == c.Param("owner") && comment.Repo == c.Param("repo") {
+			comment.Body = request.Body
+			comment.Edits++
+			comment.EditedAt = time.Now()
+
+			c.JSON(http.StatusOK, gin.H{"id": comment.ID, "body": comment.Body})
+			return
+		}
+	}
+
+	notFound(c)
+}
+
+type checkRunRequest struct {
+	Name       string  `json:"name"`
+	HeadSHA    *string `json:"head_sha"`
+	Status     *string `json:"status"`
+	Conclusion *string `json:"conclusion"`
+	DetailsURL *string `json:"details_url"`
+	Output     *struct {
+		Title   string `json:"title"`
+		Summary string `json:"summary"`
+	} `json:"output"`
+}
+
+func (request checkRunRequest) apply(checkRun *CheckRun) {
+	checkRun.Name = request.Name
+	if request.HeadSHA != nil {
+		checkRun.HeadSHA = *request.HeadSHA
+	}
+	if request.Status != nil {
+		checkRun.Status = *request.Status
+	}
+	if request.Conclusion != nil {
+		checkRun.Conclusion = *request.Conclusion
+	}
+	if request.DetailsURL != nil {
+		checkRun.DetailsURL = *request.DetailsURL
+	}
+	if request.Output != nil {
+		checkRun.Title = request.Output.Title
+		checkRun.Summary = request.Output.Summary
+	}
+}
+
+func (fake *Server) createCheckRun(c *gin.Context) {
+	var request checkRunRequest
+
+	if !bind(c, &request) {
+		return
+	}
+
+	checkRun := CheckRun{
+		Owner:  c.Param("owner"),
+		Repo:   c.Param("repo"),
+		Status: "queued",
+	}
+	request.apply(&checkRun)
+
+	fake.mu.Lock()
+	checkRun.ID = fake.newID()
+	fake.checkRuns = append(fake.checkRuns, checkRun)
+	fake.mu.Unlock()
+
+	c.JSON(http.StatusCreated, gin.H{"id": checkRun.ID, "status": checkRun.Status})
+}
+
+func (fake *Server) updateCheckRun(c *gin.Context) {
+	var request checkRunRequest
+
+	if !bind(c, &request) {
+		return
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	for i := range fake.checkRuns {
+		checkRun := &fake.checkRuns[i]
+		if strconv.FormatInt(checkRun.ID, 10) == c.Param("id") && checkRun.Owner == c.Param("owner") && checkRun.Repo == c.Param("repo") {
+			request.apply(checkRun)
+			checkRun.Updates++
+
+			c.JSON(http.StatusOK, gin.H{"id": checkRun.ID, "status": checkRun.Status})
+			return
+		}
+	}
+
+	notFound(c)
+}
+
+func (fake *Server) createStatus(c *gin.Context) {
+	var request struct {
+		State       string `json:"state"`
+		TargetURL   string `json:"target_url"`
+		Description string `json:"description"`
+		Context     string `json:"context"`
+	}
+
+	if !bind(c, &request) {
+		return
+	}
+
+	fake.mu.Lock()
+	id := fake.newID()
+	fake.statuses = append(fake.statuses, Status{
+		Owner:       c.Param("owner"),
+		Repo:        c.Param("repo"),
+		SHA:         c.Param("sha"),
+		Context:     request.Context,
+		State:       request.State,
+		Description: request.Description,
+		TargetURL:   request.TargetURL,
+	})
+	fake.mu.Unlock()
+
+	c.JSON(http.StatusCreated, gin.H{"id": id, "state": request.State})
+}
+
+func (fake *Server) createDeployment(c *gin.Context) {
+	var request struct {
+		Ref                  string `json:"ref"`
+		Environment          string `json:"environment"`
+		TransientEnvironment bool   `json:"transient_environment"`
+	}
+
+	if !bind(c, &request) {
+		return
+	}
+
+	fake.mu.Lock()
+	deployment := Deployment{
+		ID:          fake.newID(),
+		Owner:       c.Param("owner"),
+		Repo:        c.Param("repo"),
+		Ref:         request.Ref,
+		Environment: request.Environment,
+		Transient:   request.TransientEnvironment,
+	}
+	fake.deployments = append(fake.deployments, deployment)
+	fake.mu.Unlock()
+
+	c.JSON(http.StatusCreated, gin.H{"id": deployment.ID, "ref": deployment.Ref, "environment": deployment.Environment})
+}
+
+func (fake *Server) createDeploymentStatus(c *gin.Context) {
+	var request struct {
+		State          string `json:"state"`
+		Description    string `json:"description"`
+		EnvironmentURL string `json:"environment_url"`
+		LogURL         string `json:"log_url"`
+	}
+
+	if !bind(c, &request) {
+		return
+	}
+
+	deploymentID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		notFound(c)
+		return
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	for _, deployment := range fake.deployments {
+		if deployment.ID == deploymentID {
+			fake.deploymentStatuses = append(fake.deploymentStatuses, DeploymentStatus{
+				DeploymentID:   deploymentID,
+				State:          request.State,
+				Description:    request.Description,
+				EnvironmentURL: request.EnvironmentURL,
+				LogURL:         request.LogURL,
+			})
+
+			c.JSON(http.StatusCreated, gin.H{"id": fake.newID(), "state": request.State})
+			return
+		}
+	}
+
+	notFound(c)
+}
+
+func (fake *Server) getPermissionLevel(c *gin.Context) {
+	fake.mu.Lock()
+	permission, ok := fake.permissions[c.Param("owner")+"/"+c.Param("repo")+"/"+c.Param("user")]
+	fake.mu.Unlock()
+
+	if !ok {
+		permission = "none"
+	}
+
+	c.JSON(http.StatusOK, gin.H{"permission": permission, "user": gin.H{"login": c.Param("user")}})
+}
+
+func (fake *Server) createReaction(c *gin.Context) {
+	var request struct {
+		Content string `json:"content"`
+	}
+
+	if !bind(c, &request) {
+		return
+	}
+
+	commentID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		notFound(c)
+		return
+	}
+
+	fake.mu.Lock()
+	id := fake.newID()
+	fake.reactions = append(fake.reactions, Reaction{
+		CommentID: commentID,
+		Owner:     c.Param("owner"),
+		Repo:      c.Param("repo"),
+		Content:   request.Content,
+	})
+	fake.mu.Unlock()
+
+	c.JSON(http.StatusCreated, gin.H{"id": id, "content": request.Content})
+}
+
+func bind(c *gin.Context, request interface{}) bool {
+	if err := c.ShouldBindJSON(request); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": err.Error()})
+		return false
+	}
+
+	return true
+}
+
+func notFound(c *gin.Context) {
+	c.JSON(http.StatusNotFound, gin.H{"message": "Not Found"})
+}
@@ -0,0 +1,315 @@
+package job_queue
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+)
+
+// how often idle workers look for queued jobs when they were not woken up
+const pollInterval = 5 * time.Second
+
+// Handler processes a single job, the returned error is recorded on the job.
+// The context is cancelled when the job is superseded by a newer one.
+type Handler func(ctx context.Context, job *db.Job) error
+
+type runningJob struct {
+	job    *db.Job
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// JobQueue decouples webhook deliveries from the (long) deployments they trigger.
+// Webhooks only store the event as a job, and a pool of workers processes them in the background.
+// Jobs are stored in the database so they survive a restart, and jobs for the same PR
+// are processed one at a time in the order they were received.
+type JobQueue struct {
+	workers      int
+	handler      Handler
+	jobRepo      *db.JobRepo
+	prRepo       *db.PullRequestRepo
+	deliveryRepo *db.DeliveryRepo
+
+	mu       sync.Mutex
+	running  map[int64]*runningJob // running jobs by PR ID, there is at most one per PR
+	reserved map[int64]bool        // PRs whose jobs must wait, see Reserve
+	wake     chan struct{}
+}
+
+func NewJobQueue(workers int, handler Handler) *JobQueue {
+	return &JobQueue{
+		workers:      workers,
+		handler:      handler,
+		jobRepo:      &db.JobRepo{},
+		prRepo:       &db.PullRequestRepo{},
+		deliveryRepo: &db.DeliveryRepo{},
+		running:      map[int64]*runningJob{},
+		reserved:     map[int64]bool{},
+		wake:         make(chan struct{}, workers),
+	}
+}
+
+// Enqueue stores the event to be processed later by one of the workers.
+// The outcome of the job is reported back on the delivery it came from.
+func (q *JobQueue) Enqueue(job *db.Job) error {
+	if err := q.jobRepo.Create(job); err != nil {
+		return err
+	}
+
+	log.Printf("job %d queued for %s.%s on PR ID: %d", job.ID, job.EventName, job.EventAction, job.PrID)
+	q.notify()
+
+	return nil
+}
+
+// EnqueueAction queues an action imbere takes on its own on a PR (see constants.INTERNAL_ACTION_*),
+// unless the same action is already waiting or running for it.
+func (q *JobQueue) EnqueueAction(prId int64, action string) error {
+	pending, err := q.jobRepo.HasPending(prId, constants.INTERNAL_EVENT, action)
+	if err != nil || pending {
+		return err
+	}
+
+	return q.Enqueue(&db.Job{
+		PrID:        prId,
+		EventName:   constants.INTERNAL_EVENT,
+		EventAction: action,
+	})
+}
+
+// EnqueueActionWith queues an action asked for on a PR with its argument (ie. the commit to roll back to) as the payload,
+// it is queued even if the same action is already waiting.
+func (q *JobQueue) EnqueueActionWith(prId int64, action string, argument string) error {
+	return q.Enqueue(&db.Job{
+		PrID:        prId,
+		EventName:   constants.INTERNAL_EVENT,
+		EventAction: action,
+		Payload:     argument,
+	})
+}
+
+// CancelOutdated cancels the running job of the PR if it is about another commit than the given one,
+// there is no point finishing a build for code that was already replaced by a new push.
+// The queued jobs that would build an older commit (see constants.OUTDATED_BY_PUSH_EVENT_ACTIONS) are dropped too.
+func (q *JobQueue) CancelOutdated(prId int64, headSha string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// workers claim jobs with the lock held, none of these can start meanwhile
+	cancelled, err := q.jobRepo.CancelQueued(prId, headSha, constants.OUTDATED_BY_PUSH_EVENT_ACTIONS)
+	if err != nil {
+		log.Printf("could not cancel the queued jobs of PR ID: %d: %s", prId, err)
+	}
+
+	for _, job := range cancelled {
+		log.Printf("dropped job %d for PR ID: %d, %s was superseded by %s", job.ID, prId, job.HeadSHA, headSha)
+
+		if job.DeliveryID == "" {
+			continue
+		}
+
+		if err := q.deliveryRepo.SetOutcome(job.DeliveryID, constants.DELIVERY_OUTCOME_CANCELLED, job.Error); err != nil {
+			log.Printf("could not save outcome of job %d: %s", job.ID, err)
+		}
+	}
+
+	running, ok := q.running[prId]
+	if !ok || running.job.HeadSHA == "" || running.job.HeadSHA == headSha {
+		return
+	}
+
+	log.Printf("cancelling job %d for PR ID: %d, %s was superseded by %s", running.job.ID, prId, running.job.HeadSHA, headSha)
+	running.cancel()
+}
+
+// Reserve keeps the jobs of a PR from running until release is called, so that its state can be changed safely
+// outside of a job (ie. by the reconciler). It fails if a job of the PR is already running.
+func (q *JobQueue) Reserve(prId int64) (release func(), ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, running := q.running[prId]; running || q.reserved[prId] {
+		return nil, false
+	}
+
+	q.reserved[prId] = true
+
+	return func() {
+		q.mu.Lock()
+		delete(q.reserved, prId)
+		q.mu.Unlock()
+
+		q.notify()
+	}, true
+}
+
+// Start recovers jobs interrupted by the last shutdown and starts the workers.
+func (q *JobQueue) Start() error {
+	if err := q.recover(); err != nil {
+		return err
+	}
+
+	for i := 0; i < q.workers; i++ {
+		go q.work(i)
+	}
+
+	q.notify()
+
+	return nil
+}
+
+// recover handles jobs that were running when imbere stopped, they are queued again
+// unless they were already attempted too many times, in which case they are marked as failed.
+func (q *JobQueue) recover() error {
+	jobs, err := q.jobRepo.GetInterrupted()
+	if err != nil {
+		return err
+	}
+
+	for i := range jobs {
+		job := &jobs[i]
+
+		// the interrupted deployment left the PR flagged as deploying, which would make it skip the retry
+		if err := q.prRepo.ResetDeploying(job.PrID); err != nil {
+			return err
+		}
+
+		if job.Attempts >= constants.MAX_JOB_ATTEMPTS {
+			log.Printf("job %d was interrupted %d times, marking it as failed", job.ID, job.Attempts)
+			err = q.finish(job, fmt.Errorf("interrupted after %d attempts", job.Attempts))
+		} else {
+			log.Printf("job %d was interrupted, resuming it", job.ID)
+			err = q.jobRepo.Requeue(job)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (q *JobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *JobQueue) work(worker int) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		running, err := q.claim()
+		if err != nil {
+			log.Printf("worker %d could not pick a job: %s", worker, err)
+		}
+
+		if running == nil {
+			select {
+			case <-q.wake:
+			case <-ticker.C:
+			}
+			continue
+		}
+
+		q.run(worker, running)
+	}
+}
+
+// claim picks the next job that can run and marks its PR as busy,
+// so no other worker picks a job for the same PR until this one is done.
+func (q *JobQueue) claim() (*runningJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	busyPrIDs := []int64{}
+	for prId := range q.running {
+		busyPrIDs = append(busyPrIDs, prId)
+	}
+	for prId := range q.reserved {
+		busyPrIDs = append(busyPrIDs, prId)
+	}
+
+	job, err := q.jobRepo.NextQueued(busyPrIDs)
+	if err != nil || job == nil {
+		return nil, err
+	}
+
+	if err := q.jobRepo.MarkRunning(job); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	running := &runningJob{
+		job:    job,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	q.running[job.PrID] = running
+
+	return running, nil
+}
+
+func (q *JobQueue) run(worker int, running *runningJob) {
+	job := running.job
+
+	log.Printf("worker %d started job %d (%s.%s) for PR ID: %d", worker, job.ID, job.EventName, job.EventAction, job.PrID)
+
+	jobErr := q.handle(running.ctx, job)
+	running.cancel()
+
+	if jobErr != nil {
+		log.Printf("job %d failed: %s", job.ID, jobErr)
+	} else {
+		log.Printf("job %d succeeded", job.ID)
+	}
+
+	if err := q.finish(job, jobErr); err != nil {
+		log.Printf("could not save outcome of job %d: %s", job.ID, err)
+	}
+
+	q.mu.Lock()
+	delete(q.running, job.PrID)
+	q.mu.Unlock()
+
+	// a job for the same PR might have been waiting for this one
+	q.notify()
+}
+
+// finish records the outcome on the job and on the delivery that queued it,
+// later redeliveries of the same event are answered with it.
+func (q *JobQueue) finish(job *db.Job, jobErr error) error {
+	if err := q.jobRepo.MarkFinished(job, jobErr); err != nil {
+		return err
+	}
+
+	if job.DeliveryID == "" {
+		return nil
+	}
+
+	if jobErr != nil {
+		return q.deliveryRepo.SetOutcome(job.DeliveryID, constants.DELIVERY_OUTCOME_FAILED, jobErr.Error())
+	}
+
+	return q.deliveryRepo.SetOutcome(job.DeliveryID, constants.DELIVERY_OUTCOME_SUCCEEDED, "")
+}
+
+// handle runs the handler, making sure a panic in a deployment does not take the worker down with it.
+func (q *JobQueue) handle(ctx context.Context, job *db.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	return q.handler(ctx, job)
+}
@@ -0,0 +1,258 @@
+package job_queue
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "imbere-job-queue-test-*")
+	if err != nil {
+		panic(err)
+	}
+
+	db.DbInit(filepath.Join(dir, "imbere.db"), nil)
+
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// nextPrID gives every test its own PRs, they share the database
+var lastPrID int64 = 1000
+
+func nextPrID() int64 {
+	lastPrID++
+	return lastPrID
+}
+
+func noopHandler(ctx context.Context, job *db.Job) error {
+	return nil
+}
+
+// interrupt creates a job of the PR that was running attempts times when imbere stopped
+func interrupt(t *testing.T, prId int64, deliveryId string, attempts int) *db.Job {
+	t.Helper()
+
+	jobRepo := db.JobRepo{}
+	job := &db.Job{PrID: prId, DeliveryID: deliveryId, EventName: "pull_request", EventAction: "synchronize"}
+
+	if err := jobRepo.Create(job); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < attempts; i++ {
+		if err := jobRepo.MarkRunning(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return job
+}
+
+func TestRecover(t *testing.T) {
+	prRepo := db.PullRequestRepo{}
+	jobRepo := db.JobRepo{}
+	deliveryRepo := db.DeliveryRepo{}
+
+	resumed := nextPrID()
+	failed := nextPrID()
+
+	for _, prId := range []int64{resumed, failed} {
+		if err := prRepo.Save(&db.PullRequest{PrID: prId, PrNumber: prId, BranchName: "feature", RepoName: "app", OwnerName: "rssb", IsDeploying: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliveryId := "delivery-recover"
+	if _, _, err := deliveryRepo.Record(&db.Delivery{DeliveryID: deliveryId, EventName: "pull_request", EventAction: "synchronize", PrID: failed}); err != nil {
+		t.Fatal(err)
+	}
+
+	interrupt(t, resumed, "", 1)
+	interrupt(t, failed, deliveryId, constants.MAX_JOB_ATTEMPTS)
+
+	if err := NewJobQueue(1, noopHandler).recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prId := range []int64{resumed, failed} {
+		pr, err := prRepo.GetByPrID(prId)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pr.IsDeploying {
+			t.Errorf("PR %d is still flagged as deploying, its retry would be skipped", prId)
+		}
+	}
+
+	if pending, err := jobRepo.HasPending(resumed, "pull_request", "synchronize"); err != nil || !pending {
+		t.Errorf("the interrupted job was not queued again (pending %v, %v)", pending, err)
+	}
+
+	if pending, err := jobRepo.HasPending(failed, "pull_request", "synchronize"); err != nil || pending {
+		t.Errorf("the job interrupted %d times was queued again (pending %v, %v)", constants.MAX_JOB_ATTEMPTS, pending, err)
+	}
+
+	delivery, err := deliveryRepo.GetByDeliveryID(deliveryId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if delivery.Outcome != constants.DELIVERY_OUTCOME_FAILED || !strings.Contains(delivery.Message, "interrupted") {
+		t.Errorf("delivery outcome = %v %q, want it failed as interrupted", delivery.Outcome, delivery.Message)
+	}
+}
+
+// claimAll claims every job that can run, it gives the PRs they belong to
+func claimAll(t *testing.T, q *JobQueue) map[int64]bool {
+	t.Helper()
+
+	claimed := map[int64]bool{}
+
+	for {
+		running, err := q.claim()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if running == nil {
+			return claimed
+		}
+
+		claimed[running.job.PrID] = true
+	}
+}
+
+func TestReserve(t *testing.T) {
+	q := NewJobQueue(1, noopHandler)
+
+	reserved := nextPrID()
+	busy := nextPrID()
+
+	if err := q.Enqueue(&db.Job{PrID: busy, EventName: "pull_request", EventAction: "opened"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !claimAll(t, q)[busy] {
+		t.Fatalf("the job of PR %d was not claimed", busy)
+	}
+
+	if _, ok := q.Reserve(busy); ok {
+		t.Error("Reserve() went through while a job of the PR is running")
+	}
+
+	release, ok := q.Reserve(reserved)
+	if !ok {
+		t.Fatal("Reserve() of an idle PR failed")
+	}
+
+	if _, ok := q.Reserve(reserved); ok {
+		t.Error("Reserve() went through twice for the same PR")
+	}
+
+	if err := q.Enqueue(&db.Job{PrID: reserved, EventName: "pull_request", EventAction: "synchronize"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if claimAll(t, q)[reserved] {
+		t.Error("a job of the reserved PR was claimed")
+	}
+
+	release()
+
+	if !claimAll(t, q)[reserved] {
+		t.Error("the job of the PR was not claimed once released")
+	}
+}
+
+func TestHandleRecoversPanics(t *testing.T) {
+	q := NewJobQueue(1, func(ctx context.Context, job *db.Job) error {
+		panic("nil map")
+	})
+
+	err := q.handle(context.Background(), &db.Job{})
+	if err == nil || !strings.Contains(err.Error(), "nil map") {
+		t.Errorf("handle() = %v, want the panic as an error", err)
+	}
+}
+
+func TestCancelOutdated(t *testing.T) {
+	q := NewJobQueue(1, noopHandler)
+	jobRepo := db.JobRepo{}
+	deliveryRepo := db.DeliveryRepo{}
+
+	prId := nextPrID()
+	running := nextPrID()
+
+	var err error
+	if _, _, err = deliveryRepo.Record(&db.Delivery{DeliveryID: "delivery-outdated", EventName: "pull_request", EventAction: "synchronize", PrID: prId}); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := []*db.Job{
+		{PrID: running, HeadSHA: "old", EventName: "pull_request", EventAction: "synchronize"},
+		{PrID: prId, HeadSHA: "old", DeliveryID: "delivery-outdated", EventName: "pull_request", EventAction: "synchronize"},
+		{PrID: prId, HeadSHA: "old", EventName: "workflow_run", EventAction: "completed"},
+		{PrID: prId, HeadSHA: "old", EventName: "pull_request", EventAction: "unlabeled"},
+		{PrID: prId, EventName: "pull_request", EventAction: "closed"},
+	}
+
+	for _, job := range jobs {
+		if err := q.Enqueue(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the job of the other PR runs, the ones of the PR wait
+	q.reserved[prId] = true
+
+	var started *runningJob
+	for started == nil || started.job.PrID != running {
+		if started, err = q.claim(); err != nil || started == nil {
+			t.Fatalf("claim() = %v, %v, want the job of PR %d", started, err, running)
+		}
+	}
+
+	q.CancelOutdated(prId, "new")
+	q.CancelOutdated(running, "new")
+
+	pending := func(eventName string, eventAction string) bool {
+		pending, err := jobRepo.HasPending(prId, eventName, eventAction)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return pending
+	}
+
+	if pending("pull_request", "synchronize") || pending("workflow_run", "completed") {
+		t.Error("the push and the workflow run of the outdated commit are still queued")
+	}
+
+	// they are about the PR rather than the commit
+	if !pending("pull_request", "unlabeled") || !pending("pull_request", "closed") {
+		t.Error("other events of the PR were dropped")
+	}
+
+	delivery, err := deliveryRepo.GetByDeliveryID("delivery-outdated")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if delivery.Outcome != constants.DELIVERY_OUTCOME_CANCELLED || !strings.Contains(delivery.Message, "new") {
+		t.Errorf("delivery outcome = %v %q, want it cancelled as superseded by the new commit", delivery.Outcome, delivery.Message)
+	}
+
+	if started.ctx.Err() == nil {
+		t.Error("the running job of the outdated commit was not cancelled")
+	}
+}
@@ -0,0 +1,150 @@
+package logs
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+	"github.com/rssb/imbere/pkg/utils"
+)
+
+const defaultPerPage = 200
+const maxPerPage = 1000
+
+// NewToken generates the secret the links to the logs of a PR are signed with, it is never posted itself
+func NewToken() (string, error) {
+	bytes := make([]byte, 16)
+
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bytes), nil
+}
+
+// URL gives the link to the logs of an attempt, or an empty string if imbere does not know its public url
+// (see config.Config.PublicURL). The link only gives access to that attempt, for constants.LOGS_LINK_TTL_HOURS.
+func URL(publicURL string, pr *db.PullRequest, attempt int64) string {
+	publicURL = strings.TrimSuffix(publicURL, "/")
+
+	if publicURL == "" || pr.LogsToken == "" {
+		return ""
+	}
+
+	expires := time.Now().Add(constants.LOGS_LINK_TTL_HOURS * time.Hour).Unix()
+
+	return fmt.Sprintf("%s/api/v1/pull_requests/%s/logs?attempt=%d&expires=%d&signature=%s", publicURL, pr.GetPrId(), attempt, expires, sign(pr, attempt, expires))
+}
+
+// sign gives the signature of a link to the logs of an attempt, made with the secret of the PR
+func sign(pr *db.PullRequest, attempt int64, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(pr.LogsToken))
+	fmt.Fprintf(mac, "%d:%d:%d", pr.PrID, attempt, expires)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HandleGetLogs gives the logs of a deployment attempt of a PR (the latest one unless ?attempt= is given), paginated with ?page= and ?per_page=.
+// Access is granted with the api token, or with a link to the attempt posted on the PR until it expires, see URL.
+func HandleGetLogs(apiToken string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		prId, err := strconv.ParseInt(c.Param("pr_id"), 10, 64)
+		if err != nil {
+			utils.ReturnError(c, "invalid pr id")
+			return
+		}
+
+		prRepo := db.PullRequestRepo{}
+
+		pr, err := prRepo.GetByPrID(prId)
+		if err != nil {
+			utils.ReturnError(c, err.Error())
+			return
+		}
+
+		attempt := int64(0)
+		if pr != nil {
+			attempt = pr.Attempts
+		}
+
+		if value := c.Query("attempt"); value != "" {
+			attempt, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				utils.ReturnError(c, "invalid attempt")
+				return
+			}
+		}
+
+		if pr == nil || !isAuthorized(c, apiToken, pr, attempt) {
+			// not telling unauthorized requests whether the PR exists
+			c.JSON(http.StatusNotFound, gin.H{
+				"message": "pull request not found",
+			})
+			return
+		}
+
+		page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || page < 1 {
+			utils.ReturnError(c, "invalid page")
+			return
+		}
+
+		perPage, err := strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(defaultPerPage)))
+		if err != nil || perPage < 1 || perPage > maxPerPage {
+			utils.ReturnError(c, fmt.Sprintf("invalid per_page, expected a number between 1 and %d", maxPerPage))
+			return
+		}
+
+		logRepo := db.LogLineRepo{}
+
+		lines, total, err := logRepo.Page(pr.PrID, attempt, page, perPage)
+		if err != nil {
+			utils.ReturnError(c, err.Error())
+			return
+		}
+
+		response := []gin.H{}
+		for _, line := range lines {
+			response = append(response, gin.H{
+				"time":   line.CreatedAt,
+				"stream": line.Stream,
+				"step":   utils.GetProgressStepName(line.Step),
+				"line":   line.Line,
+			})
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"pr_id":    pr.PrID,
+			"attempt":  attempt,
+			"attempts": pr.Attempts,
+			"page":     page,
+			"per_page": perPage,
+			"total":    total,
+			"lines":    response,
+		})
+	}
+}
+
+func isAuthorized(c *gin.Context, apiToken string, pr *db.PullRequest, attempt int64) bool {
+	sent := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if apiToken != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(apiToken)) == 1 {
+		return true
+	}
+
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || pr.LogsToken == "" || time.Now().Unix() > expires {
+		return false
+	}
+
+	return hmac.Equal([]byte(c.Query("signature")), []byte(sign(pr, attempt, expires)))
+}
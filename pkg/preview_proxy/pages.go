@@ -0,0 +1,61 @@
+package preview_proxy
+
+import (
+	"html/template"
+	"net/http"
+)
+
+type page struct {
+	Title   string
+	Message string
+	Refresh bool // reload until the preview is up
+}
+
+var (
+	pageDeploying = page{
+		Title:   "Deploying",
+		Message: "This preview is being deployed, the page will reload once it is up.",
+		Refresh: true,
+	}
+	pageWaking = page{
+		Title:   "Waking up",
+		Message: "This preview was put to sleep after being idle, it is starting again and the page will reload once it is up.",
+		Refresh: true,
+	}
+	pageFailed = page{
+		Title:   "Preview unavailable",
+		Message: "This preview is not running, its last deployment failed. Check the status on the pull request.",
+	}
+	pageNotFound = page{
+		Title:   "Preview not found",
+		Message: "There is no preview here, label the pull request with IMBERE_DEPLOY to get one.",
+	}
+)
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>{{.Title}} - Imbere</title>
+	{{if .Refresh}}<meta http-equiv="refresh" content="10">{{end}}
+	<style>
+		body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; display: flex; align-items: center; justify-content: center; height: 100vh; margin: 0; background: #f6f8fa; color: #24292f; }
+		main { text-align: center; max-width: 32rem; padding: 2rem; }
+	</style>
+</head>
+<body>
+	<main>
+		<h1>{{.Title}}</h1>
+		<p>{{.Message}}</p>
+	</main>
+</body>
+</html>
+`))
+
+func renderPage(w http.ResponseWriter, status int, content page) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	pageTemplate.Execute(w, content)
+}
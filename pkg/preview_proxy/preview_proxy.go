@@ -0,0 +1,227 @@
+package preview_proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rssb/imbere/pkg/config"
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+)
+
+// a dns label can not be longer than that
+const maxSubdomainLength = 63
+
+// the activity of a preview is recorded at most that often, not on every request
+const touchInterval = time.Minute
+
+var nonAlphanumeric = regexp.MustCompile(`[^a-z0-9]+`)
+var subdomainPattern = regexp.MustCompile(`^pr-([0-9]+)-([a-z0-9-]+-)?([0-9a-f]{8})$`)
+
+// Subdomain gives the name a PR is previewed on, ie. pr-12-my-app-1a2b3c4d. The hash of the owner and the name
+// of the repository keeps apart the previews of repositories whose names give the same slug (acme/api and other/api, my_app and my-app).
+func Subdomain(pr *db.PullRequest) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(pr.OwnerName + "/" + pr.RepoName)))
+	hash := hex.EncodeToString(sum[:])[:8]
+
+	prefix := "pr-" + pr.GetPrNumber() + "-"
+	slug := strings.Trim(nonAlphanumeric.ReplaceAllString(strings.ToLower(pr.RepoName), "-"), "-")
+
+	// the slug is only there for people, it is what gets shortened
+	if room := maxSubdomainLength - len(prefix) - len(hash) - 1; len(slug) > room {
+		slug = strings.TrimRight(slug[:max(room, 0)], "-")
+	}
+
+	if slug == "" {
+		return prefix + hash
+	}
+
+	return prefix + slug + "-" + hash
+}
+
+// URL gives the link reviewers open to see the PR, on its subdomain when a preview domain is configured
+func URL(previewConfig config.PreviewConfig, pr *db.PullRequest) string {
+	if previewConfig.Domain == "" {
+		return "http://" + previewConfig.Host + ":" + strconv.Itoa(int(pr.DeploymentPort))
+	}
+
+	return previewConfig.Scheme + "://" + Subdomain(pr) + "." + previewConfig.Domain
+}
+
+// Waker queues the wake up of a sleeping preview, see job_queue.JobQueue.EnqueueAction
+type Waker interface {
+	EnqueueAction(prId int64, action string) error
+}
+
+// Proxy serves the previews on their subdomains of the base domain,
+// every other request goes to the next handler (the api).
+type Proxy struct {
+	domain string
+	host   string // host the apps listen on
+	next   http.Handler
+	waker  Waker
+	prRepo *db.PullRequestRepo
+
+	mu        sync.Mutex
+	touchedAt map[int64]time.Time // last time the activity of a PR was recorded
+}
+
+func NewProxy(previewConfig config.PreviewConfig, waker Waker, next http.Handler) *Proxy {
+	return &Proxy{
+		domain:    strings.ToLower(previewConfig.Domain),
+		host:      previewConfig.Host,
+		next:      next,
+		waker:     waker,
+		prRepo:    &db.PullRequestRepo{},
+		touchedAt: map[int64]time.Time{},
+	}
+}
+
+func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	subdomain, ok := proxy.subdomain(r.Host)
+	if !ok {
+		proxy.next.ServeHTTP(w, r)
+		return
+	}
+
+	pr, err := proxy.find(subdomain)
+	if err != nil {
+		log.Printf("could not find preview %s: %s", subdomain, err)
+		renderPage(w, http.StatusInternalServerError, pageFailed)
+		return
+	}
+
+	if pr == nil {
+		renderPage(w, http.StatusNotFound, pageNotFound)
+		return
+	}
+
+	if !pr.Deployed {
+		if pr.IsDeploying {
+			renderPage(w, http.StatusServiceUnavailable, pageDeploying)
+		} else if pr.LabeledToDeploy {
+			renderPage(w, http.StatusServiceUnavailable, pageFailed)
+		} else {
+			renderPage(w, http.StatusNotFound, pageNotFound)
+		}
+		return
+	}
+
+	if pr.Sleeping {
+		if err := proxy.waker.EnqueueAction(pr.PrID, constants.INTERNAL_ACTION_WAKE); err != nil {
+			log.Printf("could not wake preview %s up: %s", subdomain, err)
+			renderPage(w, http.StatusInternalServerError, pageFailed)
+			return
+		}
+
+		renderPage(w, http.StatusServiceUnavailable, pageWaking)
+		return
+	}
+
+	proxy.touch(pr)
+
+	target := &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(proxy.host, strconv.Itoa(int(pr.DeploymentPort))),
+	}
+
+	reverseProxy := httputil.NewSingleHostReverseProxy(target)
+	reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("preview %s is not reachable on port %d: %s", subdomain, pr.DeploymentPort, err)
+
+		// the app is restarted while a new version is deployed
+		if pr.IsDeploying {
+			renderPage(w, http.StatusServiceUnavailable, pageDeploying)
+			return
+		}
+
+		renderPage(w, http.StatusBadGateway, pageFailed)
+	}
+
+	reverseProxy.ServeHTTP(w, r)
+}
+
+// touch records that the preview is in use, so that it is not put to sleep
+func (proxy *Proxy) touch(pr *db.PullRequest) {
+	now := time.Now()
+
+	proxy.mu.Lock()
+	if now.Sub(proxy.touchedAt[pr.PrID]) < touchInterval {
+		proxy.mu.Unlock()
+		return
+	}
+	proxy.touchedAt[pr.PrID] = now
+	proxy.mu.Unlock()
+
+	if err := proxy.prRepo.Touch(pr.PrID); err != nil {
+		log.Printf("could not record activity of PR ID: %s: %s", pr.GetPrId(), err)
+	}
+}
+
+// subdomain extracts the preview subdomain from the host, if the host is one
+func (proxy *Proxy) subdomain(host string) (string, bool) {
+	if proxy.domain == "" {
+		return "", false
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	suffix := "." + proxy.domain
+	host = strings.ToLower(host)
+
+	if !strings.HasSuffix(host, suffix) {
+		return "", false
+	}
+
+	subdomain := strings.TrimSuffix(host, suffix)
+
+	return subdomain, !strings.Contains(subdomain, ".")
+}
+
+// find gives the PR previewed on the subdomain, or nil if there is none
+func (proxy *Proxy) find(subdomain string) (*db.PullRequest, error) {
+	matches := subdomainPattern.FindStringSubmatch(subdomain)
+	if matches == nil {
+		return nil, nil
+	}
+
+	prNumber, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+
+	prs, err := proxy.prRepo.GetByPrNumber(prNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	// a PR of the repository may have been recreated (ie. the repository was deleted and pushed again),
+	// the one that is deployed wins, else the newest
+	var found *db.PullRequest
+
+	for i := range prs {
+		pr := &prs[i]
+
+		if Subdomain(pr) != subdomain {
+			continue
+		}
+
+		if found == nil || pr.Deployed && !found.Deployed || pr.Deployed == found.Deployed && pr.ID > found.ID {
+			found = pr
+		}
+	}
+
+	return found, nil
+}
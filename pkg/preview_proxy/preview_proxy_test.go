@@ -0,0 +1,169 @@
+package preview_proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rssb/imbere/pkg/config"
+	"github.com/rssb/imbere/pkg/db"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "imbere-preview-proxy-test-*")
+	if err != nil {
+		panic(err)
+	}
+
+	db.DbInit(filepath.Join(dir, "imbere.db"), nil)
+
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func lastActiveAt(t *testing.T, prId int64) time.Time {
+	t.Helper()
+
+	prRepo := db.PullRequestRepo{}
+
+	pr, err := prRepo.GetByPrID(prId)
+	if err != nil || pr == nil {
+		t.Fatalf("could not get PR ID: %d: %v", prId, err)
+	}
+
+	if pr.LastActiveAt == nil {
+		return time.Time{}
+	}
+
+	return *pr.LastActiveAt
+}
+
+func TestTouchIsThrottled(t *testing.T) {
+	prRepo := db.PullRequestRepo{}
+
+	prs := []*db.PullRequest{
+		{PrID: 1, PrNumber: 1, BranchName: "a", RepoName: "app", OwnerName: "rssb", Deployed: true},
+		{PrID: 2, PrNumber: 2, BranchName: "b", RepoName: "app", OwnerName: "rssb", Deployed: true},
+	}
+
+	for _, pr := range prs {
+		if err := prRepo.Save(pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	proxy := NewProxy(config.PreviewConfig{Domain: "preview.example.com"}, nil, nil)
+
+	proxy.touch(prs[0])
+	first := lastActiveAt(t, 1)
+	if first.IsZero() {
+		t.Fatal("the first request did not record the activity of the preview")
+	}
+
+	// requests within touchInterval are not recorded
+	proxy.touch(prs[0])
+	if again := lastActiveAt(t, 1); !again.Equal(first) {
+		t.Errorf("activity recorded again after %s, want at most every %s", again.Sub(first), touchInterval)
+	}
+
+	// other previews are throttled on their own
+	proxy.touch(prs[1])
+	if lastActiveAt(t, 2).IsZero() {
+		t.Error("the activity of another preview was not recorded")
+	}
+
+	// once touchInterval went by, the activity is recorded again
+	proxy.mu.Lock()
+	proxy.touchedAt[1] = proxy.touchedAt[1].Add(-touchInterval)
+	proxy.mu.Unlock()
+
+	proxy.touch(prs[0])
+	if later := lastActiveAt(t, 1); !later.After(first) {
+		t.Errorf("activity not recorded after %s, last one is still %s", touchInterval, later)
+	}
+}
+
+func TestSubdomain(t *testing.T) {
+	prs := []*db.PullRequest{
+		{PrNumber: 7, RepoName: "api", OwnerName: "acme"},
+		{PrNumber: 7, RepoName: "api", OwnerName: "other"},
+		{PrNumber: 7, RepoName: "my_app", OwnerName: "acme"},
+		{PrNumber: 7, RepoName: "my-app", OwnerName: "acme"},
+		{PrNumber: 7, RepoName: strings.Repeat("very-long-name", 10), OwnerName: "acme"},
+		{PrNumber: 7, RepoName: "___", OwnerName: "acme"},
+	}
+
+	seen := map[string]*db.PullRequest{}
+
+	for _, pr := range prs {
+		subdomain := Subdomain(pr)
+
+		if other, ok := seen[subdomain]; ok {
+			t.Errorf("%s/%s and %s/%s are both previewed on %s", pr.OwnerName, pr.RepoName, other.OwnerName, other.RepoName, subdomain)
+		}
+		seen[subdomain] = pr
+
+		if len(subdomain) > maxSubdomainLength || !subdomainPattern.MatchString(subdomain) {
+			t.Errorf("Subdomain() of %s/%s = %q, want a dns label the proxy recognizes", pr.OwnerName, pr.RepoName, subdomain)
+		}
+	}
+
+	if subdomain := Subdomain(prs[0]); !strings.HasPrefix(subdomain, "pr-7-api-") {
+		t.Errorf("Subdomain() = %q, want it to start with the number and the name of the repository", subdomain)
+	}
+}
+
+func TestFind(t *testing.T) {
+	prRepo := db.PullRequestRepo{}
+
+	// PR 7 of two repositories named alike, and of acme/api again once the repository was recreated
+	prs := []*db.PullRequest{
+		{PrID: 701, PrNumber: 7, BranchName: "a", RepoName: "api", OwnerName: "acme", Deployed: true},
+		{PrID: 702, PrNumber: 7, BranchName: "b", RepoName: "api", OwnerName: "other", Deployed: true},
+		{PrID: 703, PrNumber: 7, BranchName: "c", RepoName: "api", OwnerName: "acme", Closed: true},
+		{PrID: 704, PrNumber: 8, BranchName: "d", RepoName: "web", OwnerName: "acme"},
+		{PrID: 705, PrNumber: 8, BranchName: "e", RepoName: "web", OwnerName: "acme"},
+	}
+
+	for _, pr := range prs {
+		if err := prRepo.Save(pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	proxy := NewProxy(config.PreviewConfig{Domain: "preview.example.com"}, nil, nil)
+
+	tests := []struct {
+		name      string
+		subdomain string
+		want      int64 // PR ID, 0 when no PR is previewed there
+	}{
+		{"deployed PR over a newer closed one", Subdomain(prs[0]), 701},
+		{"repository with the same name", Subdomain(prs[1]), 702},
+		{"newest PR when none is deployed", Subdomain(prs[3]), 705},
+		{"unknown repository", "pr-7-api-00000000", 0},
+		{"not a preview", "www", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pr, err := proxy.find(test.subdomain)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got int64
+			if pr != nil {
+				got = pr.PrID
+			}
+
+			if got != test.want {
+				t.Errorf("find(%q) = PR %d, want %d", test.subdomain, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package process_monitor
+
+import (
+	"fmt"
+
+	"github.com/rssb/imbere/pkg/client"
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+	"github.com/rssb/imbere/pkg/logs"
+	"github.com/rssb/imbere/pkg/preview_proxy"
+	"github.com/rssb/imbere/pkg/utils"
+)
+
+// checkState maps the progress of the deployment to the status and conclusion of its check run
+func checkState(progress constants.ProcessProgress, status constants.ProcessOutcome) (checkStatus string, conclusion string, title string) {
+	switch status {
+	case constants.PROCESS_OUTCOME_FAILED:
+		return "completed", "failure", failureTitle(progress, status)
+	case constants.PROCESS_OUTCOME_TIMED_OUT:
+		return "completed", "timed_out", failureTitle(progress, status)
+	case constants.PROCESS_OUTCOME_CANCELLED:
+		return "completed", "cancelled", failureTitle(progress, status)
+	}
+
+	if progress == constants.PROCESS_PROGRESS_COMPLETED && status == constants.PROCESS_OUTCOME_SUCCEEDED {
+		return "completed", "success", "Deployed"
+	}
+
+	if progress == constants.PROCESS_PROGRESS_STARTED && status == constants.PROCESS_OUTCOME_NOT_YET {
+		return "queued", "", "Queued"
+	}
+
+	return "in_progress", "", utils.GetProgressStepName(progress)
+}
+
+// failureTitle tells at which step the deployment did not go through, and why
+func failureTitle(progress constants.ProcessProgress, status constants.ProcessOutcome) string {
+	switch status {
+	case constants.PROCESS_OUTCOME_TIMED_OUT:
+		return fmt.Sprintf("Timed out while %s", utils.GetProgressStepName(progress))
+	case constants.PROCESS_OUTCOME_CANCELLED:
+		return fmt.Sprintf("Cancelled while %s", utils.GetProgressStepName(progress))
+	default:
+		return fmt.Sprintf("Failed while %s", utils.GetProgressStepName(progress))
+	}
+}
+
+// commitState maps the status and conclusion of a check run to the state of a commit status
+func commitState(checkStatus string, conclusion string) string {
+	if checkStatus != "completed" {
+		return "pending"
+	}
+
+	if conclusion == "success" {
+		return "success"
+	}
+
+	return "failure"
+}
+
+// reportCheck shows the progress of the deployment in the checks of the PR, on its head sha.
+// A check run is created for every deployment, if the app is not allowed to (it needs the checks permission)
+// the progress is reported with a commit status of the same name instead.
+func (p *ProcessMonitor) reportCheck(deployment *db.Deployment, progress constants.ProcessProgress, status constants.ProcessOutcome) {
+	if deployment.HeadSHA == "" {
+		return
+	}
+
+	checkStatus, conclusion, title := checkState(progress, status)
+	appURL := preview_proxy.URL(p.appConfig.Preview, p.pr)
+
+	summary := utils.ParseProgressToMD(progress, status)
+	summary.PlainText("")
+	summary.PlainTextf("Preview: %s", appURL)
+
+	text := ""
+	if p.errorMsg != "" {
+		text += "## Error\n```text\n" + p.errorMsg + "\n```\n"
+	}
+
+	if logsURL := logs.URL(p.appConfig.PublicURL, p.pr, deployment.Attempt); logsURL != "" {
+		text += fmt.Sprintf("[Full logs of attempt #%d](%s)\n", deployment.Attempt, logsURL)
+	}
+
+	check := client.CheckRun{
+		Name:       constants.CHECK_RUN_NAME,
+		Status:     checkStatus,
+		Conclusion: conclusion,
+		Title:      title,
+		Summary:    summary.String(),
+		Text:       text,
+		DetailsURL: appURL,
+	}
+
+	owner := p.pr.OwnerName
+	repo := p.pr.RepoName
+
+	if !p.useCommitStatus {
+		if deployment.CheckRunID != 0 {
+			if _, err := p.client.UpdateCheckRun(deployment.CheckRunID, owner, repo, check); err != nil {
+				fmt.Printf("Process ID: %d, could not update check run %d: %s\n", p.ID, deployment.CheckRunID, err)
+			}
+			return
+		}
+
+		id, err := p.client.CreateCheckRun(owner, repo, p.pr.BranchName, deployment.HeadSHA, check)
+		if err == nil {
+			if saveErr := p.deploymentRepo.SetCheckRun(deployment, *id); saveErr != nil {
+				fmt.Printf("Process ID: %d, could not save check run %d: %s\n", p.ID, *id, saveErr)
+			}
+			return
+		}
+
+		fmt.Printf("Process ID: %d, reporting with a commit status instead of a check run: %s\n", p.ID, err)
+		p.useCommitStatus = true
+	}
+
+	err := p.client.CreateStatus(owner, repo, deployment.HeadSHA, constants.CHECK_RUN_NAME, commitState(checkStatus, conclusion), title, appURL)
+	if err != nil {
+		fmt.Printf("Process ID: %d, could not report the deployment on %s: %s\n", p.ID, deployment.HeadSHA, err)
+	}
+}
@@ -0,0 +1,98 @@
+package process_monitor
+
+import (
+	"fmt"
+
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+	"github.com/rssb/imbere/pkg/logs"
+	"github.com/rssb/imbere/pkg/preview_proxy"
+	"github.com/rssb/imbere/pkg/utils"
+)
+
+// Environment gives the name of the github environment the previews of a PR are deployed to
+func Environment(pr *db.PullRequest) string {
+	return fmt.Sprintf("preview-pr-%d", pr.PrNumber)
+}
+
+// environmentState maps the progress of the deployment to the state of its github deployment
+func environmentState(progress constants.ProcessProgress, status constants.ProcessOutcome) string {
+	switch status {
+	case constants.PROCESS_OUTCOME_FAILED:
+		return "failure"
+	case constants.PROCESS_OUTCOME_TIMED_OUT:
+		return "error"
+	case constants.PROCESS_OUTCOME_CANCELLED:
+		return "inactive" // a newer deployment replaces it
+	}
+
+	if progress == constants.PROCESS_PROGRESS_COMPLETED && status == constants.PROCESS_OUTCOME_SUCCEEDED {
+		return "success"
+	}
+
+	if progress == constants.PROCESS_PROGRESS_STARTED && status == constants.PROCESS_OUTCOME_NOT_YET {
+		return "queued"
+	}
+
+	return "in_progress"
+}
+
+// reportEnvironment shows the deployment in the environments of the PR, a github deployment is created for every attempt
+// and its status is only posted when it changes. Github marks the previous deployments inactive once one succeeds.
+func (p *ProcessMonitor) reportEnvironment(deployment *db.Deployment, progress constants.ProcessProgress, status constants.ProcessOutcome) {
+	state := environmentState(progress, status)
+	if state == p.environmentState {
+		return
+	}
+
+	owner := p.pr.OwnerName
+	repo := p.pr.RepoName
+
+	if deployment.GithubDeploymentID == 0 {
+		ref := deployment.HeadSHA
+		if ref == "" {
+			ref = p.pr.BranchName
+		}
+
+		id, err := p.client.CreateDeployment(owner, repo, ref, Environment(p.pr), fmt.Sprintf("Preview of PR #%d, attempt #%d", p.pr.PrNumber, deployment.Attempt))
+		if err != nil {
+			fmt.Printf("Process ID: %d, could not create github deployment: %s\n", p.ID, err)
+			return
+		}
+
+		if err := p.deploymentRepo.SetGithubDeployment(deployment, *id); err != nil {
+			fmt.Printf("Process ID: %d, could not save github deployment %d: %s\n", p.ID, *id, err)
+		}
+	}
+
+	description := utils.GetProgressStepName(progress)
+	if utils.IsOutcomeFailure(status) {
+		description = failureTitle(progress, status)
+	}
+
+	err := p.client.CreateDeploymentStatus(deployment.GithubDeploymentID, owner, repo, state, description, preview_proxy.URL(p.appConfig.Preview, p.pr), logs.URL(p.appConfig.PublicURL, p.pr, deployment.Attempt))
+	if err != nil {
+		fmt.Printf("Process ID: %d, could not report github deployment %d as %s: %s\n", p.ID, deployment.GithubDeploymentID, state, err)
+		return
+	}
+
+	p.environmentState = state
+}
+
+// DeactivateEnvironment marks the live deployment of the PR inactive, once it is un deployed
+func (p *ProcessMonitor) DeactivateEnvironment() {
+	deployment, err := p.deploymentRepo.GetLatestSucceeded(p.pr.PrID)
+	if err != nil {
+		fmt.Printf("Process ID: %d, could not find the live deployment: %s\n", p.ID, err)
+		return
+	}
+
+	if deployment == nil || deployment.GithubDeploymentID == 0 {
+		return
+	}
+
+	err = p.client.CreateDeploymentStatus(deployment.GithubDeploymentID, p.pr.OwnerName, p.pr.RepoName, "inactive", "Un Deployed", "", "")
+	if err != nil {
+		fmt.Printf("Process ID: %d, could not mark github deployment %d inactive: %s\n", p.ID, deployment.GithubDeploymentID, err)
+	}
+}
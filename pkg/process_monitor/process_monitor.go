@@ -5,34 +5,74 @@ import (
 	"fmt"
 	"log"
 	"os/exec"
-	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	md "github.com/nao1215/markdown"
 	"github.com/rssb/imbere/pkg/client"
+	"github.com/rssb/imbere/pkg/config"
 	"github.com/rssb/imbere/pkg/constants"
 	"github.com/rssb/imbere/pkg/db"
+	"github.com/rssb/imbere/pkg/logs"
+	"github.com/rssb/imbere/pkg/preview_proxy"
 	"github.com/rssb/imbere/pkg/utils"
 )
 
+// how many log lines are saved at once, and how long a line waits to be saved at most
+const logBatchSize = 100
+const logFlushInterval = 500 * time.Millisecond
+
+type LogEntry struct {
+	Line   string
+	Stream constants.LogStream
+	Step   constants.ProcessProgress
+	Time   time.Time
+}
+
 type ProcessMonitor struct {
-	ID       int64
-	Progress constants.ProcessProgress
-	Status   constants.ProcessOutcome
-	Logs     chan string
-	client   *client.GithubClient
-	pr       *db.PullRequest
-	prRepo   *db.PullRequestRepo
+	ID               int64
+	Progress         constants.ProcessProgress
+	Status           constants.ProcessOutcome
+	Logs             chan LogEntry
+	client           client.GithubClient
+	appConfig        *config.Config
+	pr               *db.PullRequest
+	prRepo           *db.PullRequestRepo
+	logRepo          *db.LogLineRepo
+	deploymentRepo   *db.DeploymentRepo
+	deployment       *db.Deployment // record of the deployment in progress, its steps are recorded as the progress is updated
+	environmentState string         // last state posted on the github deployment, see reportEnvironment
+	useCommitStatus  bool           // the check run could not be created, see reportCheck
+	errorMsg         string         // shown on the PR comment, ie. why the configuration of the repository is invalid
+	attempt          int64          // deployment attempt the logs belong to
+	queuedAhead      int            // builds ahead of the deployment while it waits for a build slot, see SetQueued
+
+	mu   sync.Mutex
+	tail []string // last log lines, shown on the PR comment when the deployment fails
+
+	closing chan struct{} // closed by Close, the logs that are left are saved and HandleLogs returns
+	closed  chan struct{} // closed once HandleLogs returned
+	close   sync.Once
 }
 
-func NewProcessMonitor(pr *db.PullRequest) *ProcessMonitor {
+// NewProcessMonitor follows the deployment of a PR and reports it on github with githubClient
+func NewProcessMonitor(pr *db.PullRequest, githubClient client.GithubClient, appConfig *config.Config) *ProcessMonitor {
 	prRepo := &db.PullRequestRepo{}
 	processMonitor := &ProcessMonitor{
-		ID:       pr.PrID,
-		Progress: constants.PROCESS_PROGRESS_STARTED,
-		Status:   constants.PROCESS_OUTCOME_ONGOING,
-		Logs:     make(chan string),
-		client:   client.NewGithubClient(pr.InstallationID),
-		pr:       pr,
-		prRepo:   prRepo,
+		ID:             pr.PrID,
+		Progress:       constants.PROCESS_PROGRESS_STARTED,
+		Status:         constants.PROCESS_OUTCOME_ONGOING,
+		Logs:           make(chan LogEntry),
+		client:         githubClient,
+		appConfig:      appConfig,
+		pr:             pr,
+		prRepo:         prRepo,
+		logRepo:        &db.LogLineRepo{},
+		deploymentRepo: &db.DeploymentRepo{},
+		attempt:        pr.Attempts,
+		closing:        make(chan struct{}),
+		closed:         make(chan struct{}),
 	}
 
 	processMonitor.HandleLogs() // immediately start listening to logs
@@ -40,35 +80,125 @@ func NewProcessMonitor(pr *db.PullRequest) *ProcessMonitor {
 	return processMonitor
 }
 
-func (p *ProcessMonitor) SetPort(port int32) {
-	p.pr.DeploymentPort = port
+// SetDeployment marks the start of a new deployment attempt, following logs and steps are stored under it
+func (p *ProcessMonitor) SetDeployment(deployment *db.Deployment) {
+	p.mu.Lock()
+	p.deployment = deployment
+	p.attempt = deployment.Attempt
+	p.tail = nil
+	p.mu.Unlock()
+
+	p.environmentState = ""
+	p.reportCheck(deployment, constants.PROCESS_PROGRESS_STARTED, constants.PROCESS_OUTCOME_NOT_YET)
+	p.reportEnvironment(deployment, constants.PROCESS_PROGRESS_STARTED, constants.PROCESS_OUTCOME_NOT_YET)
+}
+
+// Deployment gives the record of the deployment in progress, nil when the monitor is not following one (ie. un deploying)
+func (p *ProcessMonitor) Deployment() *db.Deployment {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.deployment
+}
+
+// SetQueued shows that the deployment waits for a build slot, behind ahead other builds (see scheduler.Scheduler)
+func (p *ProcessMonitor) SetQueued(ahead int) {
+	p.mu.Lock()
+	p.queuedAhead = ahead
+	p.mu.Unlock()
+
+	p.UpdateProgress(constants.PROCESS_PROGRESS_STARTED, constants.PROCESS_OUTCOME_NOT_YET)
+}
+
+// SetError attaches an error to the progress, it is shown on the PR comment until it is cleared with an empty message
+func (p *ProcessMonitor) SetError(message string) {
+	p.errorMsg = message
 }
 
 func (p *ProcessMonitor) UpdateProgress(progress constants.ProcessProgress, status constants.ProcessOutcome) {
+	p.mu.Lock()
 	p.Progress = progress
 	p.Status = status
+	deployment := p.deployment
+	p.mu.Unlock()
 
-	appURL := "http://" + constants.IP_ADDRESS + ":" + strconv.Itoa(int(p.pr.DeploymentPort))
+	if deployment != nil {
+		if err := p.deploymentRepo.RecordStep(deployment, progress, status); err != nil {
+			fmt.Printf("Process ID: %d, could not record step %d of deployment %d: %s\n", p.ID, progress, deployment.ID, err)
+		}
+	}
+
+	appURL := preview_proxy.URL(p.appConfig.Preview, p.pr)
 
 	progressMarkdown := utils.ParseProgressToMD(p.Progress, p.Status)
 	progressMarkdown.PlainText("")
 	progressMarkdown.H2("Deployment Url")
 	progressMarkdown.PlainText(appURL)
+
+	// the commit being deployed, or the one the preview runs
+	sha := p.pr.DeployedSHA
+	if deployment != nil {
+		sha = deployment.HeadSHA
+	}
+
+	if sha != "" {
+		progressMarkdown.H2("Commit")
+		progressMarkdown.PlainTextf("[`%s`](%s)", utils.ShortSHA(sha), strings.TrimSuffix(p.pr.RepoAddress, "/")+"/commit/"+sha)
+
+		if deployment != nil && deployment.GetSlot() != deployment.Attempt {
+			progressMarkdown.PlainText("")
+			progressMarkdown.PlainTextf("Rolled back to the build of attempt #%d", deployment.GetSlot())
+		}
+	}
+
 	progressMarkdown.H2("Status")
 
-	isDeployed := (p.Progress == constants.PROCESS_PROGRESS_DEPLOYING && p.Status == constants.PROCESS_OUTCOME_SUCCEEDED) || (p.Progress == constants.PROCESS_PROGRESS_COMPLETED)
+	// the app is only deployed once it passed its health check, see deployment.DeploymentService.verify
+	isDeployed := p.Progress == constants.PROCESS_PROGRESS_COMPLETED && p.Status == constants.PROCESS_OUTCOME_SUCCEEDED
 	isUnDeployed := p.Progress == constants.PROCESS_PROGRESS_UN_DEPLOYING && p.Status == constants.PROCESS_OUTCOME_SUCCEEDED
 
 	if isDeployed {
 		progressMarkdown.GreenBadgef("Deployed")
 	} else if p.Status == constants.PROCESS_OUTCOME_FAILED {
 		progressMarkdown.RedBadgef("Failed")
+	} else if p.Status == constants.PROCESS_OUTCOME_TIMED_OUT {
+		progressMarkdown.RedBadgef("Timed out")
+	} else if p.Status == constants.PROCESS_OUTCOME_CANCELLED {
+		progressMarkdown.YellowBadgef("Cancelled")
 	} else if isUnDeployed {
 		progressMarkdown.YellowBadgef("Undeployed")
+	} else if p.Progress == constants.PROCESS_PROGRESS_SLEEPING {
+		progressMarkdown.YellowBadgef("Sleeping")
+		progressMarkdown.PlainText("")
+		progressMarkdown.PlainTextf("The preview was idle and is sleeping, open it or comment `%s %s` to wake it up.", constants.COMMAND_PREFIX, constants.INTERNAL_ACTION_WAKE)
+	} else if p.Progress == constants.PROCESS_PROGRESS_STARTED && p.Status == constants.PROCESS_OUTCOME_NOT_YET {
+		p.mu.Lock()
+		ahead := p.queuedAhead
+		p.mu.Unlock()
+
+		progressMarkdown.YellowBadgef("Queued")
+		progressMarkdown.PlainText("")
+		progressMarkdown.PlainTextf("Queued, %d ahead. The build starts once other PRs are done building.", ahead)
 	} else {
 		progressMarkdown.YellowBadgef("Deploying")
 	}
 
+	if p.errorMsg != "" {
+		progressMarkdown.PlainText("")
+		progressMarkdown.H2("Error")
+		progressMarkdown.CodeBlocks(md.SyntaxHighlightText, p.errorMsg)
+	}
+
+	// a failed deployment does not replace the running preview, see deployment.DeploymentService.Deploy
+	if utils.IsOutcomeFailure(p.Status) && deployment != nil && p.pr.Deployed && !p.pr.Sleeping && p.pr.DeployedSHA != "" {
+		progressMarkdown.PlainText("")
+		progressMarkdown.PlainTextf("The previous version ([`%s`](%s)) keeps serving the preview.", utils.ShortSHA(p.pr.DeployedSHA), strings.TrimSuffix(p.pr.RepoAddress, "/")+"/commit/"+p.pr.DeployedSHA)
+	}
+
+	if utils.IsOutcomeFailure(p.Status) {
+		p.addLogsToMarkdown(progressMarkdown)
+	}
+
 	owner := p.pr.OwnerName
 	repo := p.pr.RepoName
 	prNumber := p.pr.PrNumber
@@ -76,33 +206,139 @@ func (p *ProcessMonitor) UpdateProgress(progress constants.ProcessProgress, stat
 
 	log.Printf("CommentId: %d, Owner: %s, Repo: %s, PR Number: %d, Comment: %s\n", commentId, owner, repo, prNumber, progressMarkdown.String())
 
-	var err error
-	var id *int64
 	if commentId == 0 {
-		id, err = p.client.CreateComment(owner, repo, prNumber, progressMarkdown.String())
-		pullRequest := p.pr
+		id, err := p.client.CreateComment(owner, repo, prNumber, progressMarkdown.String())
+		if err != nil {
+			log.Printf("Could not create comment: %s", err)
+		} else {
+			pullRequest := p.pr
 
-		pullRequest.CommentID = *id
-		p.prRepo.Save(pullRequest)
-	} else {
-		id, err = p.client.EditComment(commentId, owner, repo, progressMarkdown.String())
+			pullRequest.CommentID = *id
+			p.prRepo.Save(pullRequest)
+		}
+	} else if _, err := p.client.EditComment(commentId, owner, repo, progressMarkdown.String()); err != nil {
+		log.Printf("Could not edit comment %d: %s", commentId, err)
 	}
 
-	log.Printf("Id was created %d, or Error  %s", *id, err)
+	if deployment != nil {
+		p.reportCheck(deployment, progress, status)
+		p.reportEnvironment(deployment, progress, status)
+	}
 
 	fmt.Printf("Process ID: %d, Progress: %d, Status: %d\n", p.ID, p.Progress, p.Status)
 	// To communicate the status to github
 }
 
+// addLogsToMarkdown adds the last lines of the logs, and a link to all of them
+func (p *ProcessMonitor) addLogsToMarkdown(markdown *md.Markdown) {
+	p.mu.Lock()
+	tail := append([]string{}, p.tail...)
+	attempt := p.attempt
+	p.mu.Unlock()
+
+	logsURL := logs.URL(p.appConfig.PublicURL, p.pr, attempt)
+	if logsURL == "" && len(tail) == 0 {
+		return
+	}
+
+	markdown.PlainText("")
+	markdown.H2("Logs")
+
+	if logsURL != "" {
+		markdown.PlainTextf("[Full logs of attempt #%d](%s)", attempt, logsURL)
+	}
+
+	if len(tail) > 0 {
+		markdown.Details(fmt.Sprintf("Last %d lines", len(tail)), "\n```text\n"+strings.Join(tail, "\n")+"\n```\n")
+	}
+}
+
+// AddLog records a message from imbere about the deployment
 func (p *ProcessMonitor) AddLog(log string) {
-	p.Logs <- log
+	p.addLog(log, constants.LOG_STREAM_IMBERE)
 }
 
+func (p *ProcessMonitor) addLog(line string, stream constants.LogStream) {
+	p.mu.Lock()
+	step := p.Progress
+
+	p.tail = append(p.tail, line)
+	if len(p.tail) > constants.FAILED_COMMENT_LOG_LINES {
+		p.tail = p.tail[len(p.tail)-constants.FAILED_COMMENT_LOG_LINES:]
+	}
+	p.mu.Unlock()
+
+	entry := LogEntry{
+		Line:   line,
+		Stream: stream,
+		Step:   step,
+		Time:   time.Now(),
+	}
+
+	// output of a command that outlived the monitor is dropped
+	select {
+	case p.Logs <- entry:
+	case <-p.closing:
+	}
+}
+
+// Close saves the logs that are left and stops handling them, it is called once the monitor is done with
+func (p *ProcessMonitor) Close() {
+	p.close.Do(func() {
+		close(p.closing)
+	})
+
+	<-p.closed
+}
+
+// HandleLogs stores the logs, in batches, to be queried later. It returns once the monitor is closed.
 func (p *ProcessMonitor) HandleLogs() {
 	go func() {
-		for log := range p.Logs {
-			fmt.Printf("Process ID: %d, Log: %s\n", p.ID, log)
-			// just in case I might want to save logs or display them
+		defer close(p.closed)
+
+		batch := []db.LogLine{}
+		var flush <-chan time.Time
+
+		save := func() {
+			if len(batch) == 0 {
+				return
+			}
+
+			if err := p.logRepo.CreateMany(batch); err != nil {
+				fmt.Printf("Process ID: %d, could not save %d log lines: %s\n", p.ID, len(batch), err)
+			}
+
+			batch = []db.LogLine{}
+			flush = nil
+		}
+
+		for {
+			select {
+			case entry := <-p.Logs:
+				p.mu.Lock()
+				attempt := p.attempt
+				p.mu.Unlock()
+
+				batch = append(batch, db.LogLine{
+					CreatedAt: entry.Time,
+					PrID:      p.ID,
+					Attempt:   attempt,
+					Step:      entry.Step,
+					Stream:    entry.Stream,
+					Line:      entry.Line,
+				})
+
+				if len(batch) >= logBatchSize {
+					save()
+				} else if flush == nil {
+					flush = time.After(logFlushInterval)
+				}
+			case <-flush:
+				save()
+			case <-p.closing:
+				save()
+				return
+			}
 		}
 	}()
 }
@@ -114,14 +350,14 @@ func (p *ProcessMonitor) ListenToCmd(cmd *exec.Cmd) {
 	go func() {
 		scanner := bufio.NewScanner(stdout)
 		for scanner.Scan() {
-			p.AddLog(scanner.Text())
+			p.addLog(scanner.Text(), constants.LOG_STREAM_STDOUT)
 		}
 	}()
 
 	go func() {
 		scanner := bufio.NewScanner(stderr)
 		for scanner.Scan() {
-			p.AddLog(scanner.Text())
+			p.addLog(scanner.Text(), constants.LOG_STREAM_STDERR)
 		}
 	}()
 
@@ -0,0 +1,312 @@
+package pull_request
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/rssb/imbere/pkg/client"
+	"github.com/rssb/imbere/pkg/config"
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+	"github.com/rssb/imbere/pkg/logs"
+	"github.com/rssb/imbere/pkg/preview_proxy"
+	"github.com/rssb/imbere/pkg/process_monitor"
+	"github.com/rssb/imbere/pkg/scheduler"
+	"github.com/rssb/imbere/pkg/utils"
+)
+
+// permission a commenter needs on the repository to run each command, ordered by permissionRanks
+var commandPermissions = map[string]string{
+	constants.COMMAND_DEPLOY:   "write",
+	constants.COMMAND_REDEPLOY: "write",
+	constants.COMMAND_STOP:     "write",
+	constants.COMMAND_WAKE:     "write",
+	constants.COMMAND_ROLLBACK: "write",
+	constants.COMMAND_LOGS:     "write", // the link gives access to the logs without the api token
+	constants.COMMAND_STATUS:   "read",
+}
+
+var permissionRanks = map[string]int{
+	"none":  0,
+	"read":  1,
+	"write": 2,
+	"admin": 3,
+}
+
+// reactions left on the comment of a command
+const (
+	reactionReceived = "eyes"
+	reactionDone     = "+1"
+	reactionFailed   = "-1"
+	reactionUnknown  = "confused"
+)
+
+// commandRunner runs a command a reviewer commented on a PR, and answers them on the PR
+type commandRunner struct {
+	pr        *db.PullRequest
+	client    client.GithubClient
+	appConfig *config.Config
+	builds    *scheduler.Scheduler
+	user      string   // who commented
+	args      []string // what follows the command, ie. the commit to roll back to
+	commentID int64
+}
+
+// handleCommand runs the command of a comment posted on a PR, ie. /imbere deploy.
+// Commands work whether the PR is labeled IMBERE_DEPLOY or not.
+func handleCommand(ctx context.Context, appConfig *config.Config, newClient client.Factory, builds *scheduler.Scheduler, event Event, payload map[string]interface{}) error {
+	command := ExtractCommand(event, payload)
+	if command == "" {
+		return nil
+	}
+
+	user, commentID, err := extractCommenter(event, payload)
+	if err != nil {
+		return err
+	}
+
+	prId, err := ExtractPRID(event, payload)
+	if err != nil {
+		return err
+	}
+
+	prRepo := db.PullRequestRepo{}
+
+	PR, err := prRepo.GetByPrID(prId)
+	if err != nil {
+		return err
+	}
+
+	if PR == nil {
+		return fmt.Errorf("PR ID: %d is not known", prId)
+	}
+
+	githubClient, err := newClient(PR.InstallationID)
+	if err != nil {
+		return err
+	}
+
+	runner := &commandRunner{
+		pr:        PR,
+		client:    githubClient,
+		appConfig: appConfig,
+		builds:    builds,
+		user:      user,
+		args:      extractCommandArgs(event, payload),
+		commentID: commentID,
+	}
+
+	return runner.run(ctx, command)
+}
+
+func (runner *commandRunner) run(ctx context.Context, command string) error {
+	required, ok := commandPermissions[command]
+	if !ok {
+		runner.react(reactionUnknown)
+		runner.reply(fmt.Sprintf("`%s %s` is not a command, use one of %s.", constants.COMMAND_PREFIX, command, commandList()))
+		return nil
+	}
+
+	permission, err := runner.client.GetPermissionLevel(runner.pr.OwnerName, runner.pr.RepoName, runner.user)
+	if err != nil {
+		runner.react(reactionFailed)
+		return err
+	}
+
+	if permissionRanks[permission] < permissionRanks[required] {
+		log.Printf("%s has %s permission on %s/%s, %s needs %s", runner.user, permission, runner.pr.OwnerName, runner.pr.RepoName, command, required)
+		runner.react(reactionFailed)
+		runner.reply(fmt.Sprintf("`%s %s` needs %s permission on the repository.", constants.COMMAND_PREFIX, command, required))
+		return nil
+	}
+
+	runner.react(reactionReceived)
+
+	result, err := runner.execute(ctx, command)
+	if err != nil {
+		runner.react(reactionFailed)
+		runner.reply(fmt.Sprintf("`%s %s` failed: %s", constants.COMMAND_PREFIX, command, err))
+		return err
+	}
+
+	runner.react(reactionDone)
+	runner.reply(result)
+
+	return nil
+}
+
+// execute runs the command and gives what is answered on the PR
+func (runner *commandRunner) execute(ctx context.Context, command string) (string, error) {
+	pr := runner.pr
+
+	switch command {
+	case constants.COMMAND_STATUS:
+		return runner.status()
+	case constants.COMMAND_LOGS:
+		return runner.logs()
+	}
+
+	if pr.IsDeploying {
+		return "", errors.New("a deployment of the PR is in progress, try again once it is done")
+	}
+
+	monitor := process_monitor.NewProcessMonitor(pr, runner.client, runner.appConfig)
+	defer monitor.Close()
+
+	prService := NewPullRequestService(pr, monitor, runner.client, runner.appConfig, runner.builds)
+
+	switch command {
+	case constants.COMMAND_DEPLOY, constants.COMMAND_REDEPLOY:
+		if pr.Closed {
+			return "", errors.New("the PR is closed")
+		}
+
+		if command == constants.COMMAND_DEPLOY && pr.Deployed && !pr.Sleeping {
+			return fmt.Sprintf("The preview is already deployed on %s, comment `%s %s` to deploy it again.", runner.previewURL(), constants.COMMAND_PREFIX, constants.COMMAND_REDEPLOY), nil
+		}
+
+		// the commenter has write permission, asking for a deployment approves the commit of a fork
+		prService.approveHead()
+
+		restriction, err := prService.forkRestriction()
+		if err != nil {
+			return "", err
+		}
+
+		if restriction != "" {
+			return "", errors.New(restriction)
+		}
+
+		if err := prService.Deploy(ctx, "issue_comment."+command); err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("Deployed on %s", runner.previewURL()), nil
+	case constants.COMMAND_STOP:
+		if !pr.Deployed {
+			return "The preview is not deployed.", nil
+		}
+
+		if err := prService.UnDeploy(ctx); err != nil {
+			return "", err
+		}
+
+		if pr.LabeledToDeploy {
+			return "Stopped the preview, it is deployed again on the next push while the PR is labeled " + constants.DEPLOYMENT_LABEL + ".", nil
+		}
+
+		return "Stopped the preview.", nil
+	case constants.COMMAND_ROLLBACK:
+		sha := ""
+		if len(runner.args) > 0 {
+			sha = strings.ToLower(runner.args[0])
+		}
+
+		target, err := prService.Rollback(ctx, sha, "issue_comment."+command)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("Rolled back to `%s` (build of attempt #%d), it is live on %s", utils.ShortSHA(target.HeadSHA), target.Attempt, runner.previewURL()), nil
+	case constants.COMMAND_WAKE:
+		if !pr.Sleeping {
+			return "The preview is not sleeping.", nil
+		}
+
+		if err := prService.Wake(ctx); err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("Woke the preview up on %s", runner.previewURL()), nil
+	}
+
+	return "", fmt.Errorf("unknown command %q", command)
+}
+
+// status describes the preview of the PR and its last deployment
+func (runner *commandRunner) status() (string, error) {
+	pr := runner.pr
+	lines := []string{}
+
+	switch {
+	case pr.IsDeploying:
+		lines = append(lines, "The preview is being deployed.")
+	case pr.Sleeping:
+		lines = append(lines, fmt.Sprintf("The preview is sleeping, comment `%s %s` to wake it up.", constants.COMMAND_PREFIX, constants.COMMAND_WAKE))
+	case pr.Deployed:
+		lines = append(lines, fmt.Sprintf("The preview is deployed on %s", runner.previewURL()))
+	default:
+		lines = append(lines, "The preview is not deployed.")
+	}
+
+	deploymentRepo := db.DeploymentRepo{}
+
+	latest, err := deploymentRepo.GetLatest(pr.PrID)
+	if err != nil {
+		return "", err
+	}
+
+	if latest != nil {
+		line := fmt.Sprintf("Last deployment: attempt #%d of %s, %s", latest.Attempt, utils.ShortSHA(latest.HeadSHA), strings.ToLower(utils.GetOutcomeName(latest.Outcome)))
+		if latest.FailureReason != "" {
+			line += " (" + latest.FailureReason + ")"
+		}
+
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n\n"), nil
+}
+
+// logs links the logs of the last deployment
+func (runner *commandRunner) logs() (string, error) {
+	deploymentRepo := db.DeploymentRepo{}
+
+	latest, err := deploymentRepo.GetLatest(runner.pr.PrID)
+	if err != nil {
+		return "", err
+	}
+
+	if latest == nil {
+		return "The PR was never deployed, there are no logs yet.", nil
+	}
+
+	logsURL := logs.URL(runner.appConfig.PublicURL, runner.pr, latest.Attempt)
+	if logsURL == "" {
+		return "", errors.New("imbere has no public_url configured to link the logs")
+	}
+
+	return fmt.Sprintf("[Logs of attempt #%d](%s)", latest.Attempt, logsURL), nil
+}
+
+func (runner *commandRunner) previewURL() string {
+	return preview_proxy.URL(runner.appConfig.Preview, runner.pr)
+}
+
+func (runner *commandRunner) react(content string) {
+	if err := runner.client.CreateCommentReaction(runner.commentID, runner.pr.OwnerName, runner.pr.RepoName, content); err != nil {
+		log.Printf("could not react to comment %d: %s", runner.commentID, err)
+	}
+}
+
+func (runner *commandRunner) reply(content string) {
+	if content == "" {
+		return
+	}
+
+	if _, err := runner.client.CreateComment(runner.pr.OwnerName, runner.pr.RepoName, runner.pr.PrNumber, "@"+runner.user+" "+content); err != nil {
+		log.Printf("could not answer %s on PR ID: %s: %s", runner.user, runner.pr.GetPrId(), err)
+	}
+}
+
+func commandList() string {
+	commands := []string{}
+	for _, command := range []string{constants.COMMAND_DEPLOY, constants.COMMAND_REDEPLOY, constants.COMMAND_STOP, constants.COMMAND_WAKE, constants.COMMAND_ROLLBACK, constants.COMMAND_LOGS, constants.COMMAND_STATUS} {
+		commands = append(commands, "`"+constants.COMMAND_PREFIX+" "+command+"`")
+	}
+
+	return strings.Join(commands, ", ")
+}
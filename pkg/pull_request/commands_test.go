@@ -0,0 +1,85 @@
+package pull_request
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/rssb/imbere/pkg/config"
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/github_fake"
+)
+
+func TestCommandPermissions(t *testing.T) {
+	tests := []struct {
+		name       string
+		command    string
+		permission string
+		reaction   string // the last reaction left on the comment
+		reply      string // part of the answer posted on the PR
+	}{
+		{"read runs status", constants.COMMAND_STATUS, "read", reactionDone, "The preview is not deployed."},
+		{"none cannot run status", constants.COMMAND_STATUS, "none", reactionFailed, "needs read permission"},
+		{"read cannot stop", constants.COMMAND_STOP, "read", reactionFailed, "needs write permission"},
+		{"read cannot ask for the logs", constants.COMMAND_LOGS, "read", reactionFailed, "needs write permission"},
+		{"read cannot wake", constants.COMMAND_WAKE, "read", reactionFailed, "needs write permission"},
+		{"write stops", constants.COMMAND_STOP, "write", reactionDone, "The preview is not deployed."},
+		{"write wakes", constants.COMMAND_WAKE, "write", reactionDone, "The preview is not sleeping."},
+		{"admin outranks write", constants.COMMAND_STOP, "admin", reactionDone, "The preview is not deployed."},
+		{"unknown permission ranks as none", constants.COMMAND_STATUS, "triage", reactionFailed, "needs read permission"},
+		{"unknown command", "explode", "admin", reactionUnknown, "is not a command"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := github_fake.NewServer()
+			defer fake.Close()
+
+			pr := newTestPR()
+			fake.SetPermission(pr.OwnerName, pr.RepoName, "reviewer", test.permission)
+
+			runner := &commandRunner{
+				pr:        pr,
+				client:    fake.Client(),
+				appConfig: &config.Config{BuildDir: t.TempDir()},
+				user:      "reviewer",
+				commentID: 42,
+			}
+
+			if err := runner.run(context.Background(), test.command); err != nil {
+				t.Fatal(err)
+			}
+
+			reactions := fake.Reactions()
+			if len(reactions) == 0 || reactions[len(reactions)-1].Content != test.reaction {
+				t.Errorf("reactions = %v, want the last one to be %s", reactions, test.reaction)
+			}
+
+			comments := fake.Comments()
+			if len(comments) != 1 || !strings.HasPrefix(comments[0].Body, "@reviewer ") || !strings.Contains(comments[0].Body, test.reply) {
+				t.Errorf("comments = %v, want one answering @reviewer with %q", comments, test.reply)
+			}
+		})
+	}
+}
+
+// every command listed on the PR can be run, by someone
+func TestCommandListHasPermissions(t *testing.T) {
+	for _, command := range strings.Split(commandList(), ", ") {
+		name := strings.TrimPrefix(strings.Trim(command, "`"), constants.COMMAND_PREFIX+" ")
+
+		required, ok := commandPermissions[name]
+		if !ok {
+			t.Errorf("%s has no permission", command)
+			continue
+		}
+
+		if _, ok := permissionRanks[required]; !ok {
+			t.Errorf("%s needs %q, which is not a permission github gives", command, required)
+		}
+
+		if required == "none" {
+			t.Errorf("%s can be run by anyone commenting", command)
+		}
+	}
+}
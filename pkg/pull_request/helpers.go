@@ -4,8 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rssb/imbere/pkg/constants"
 	"github.com/rssb/imbere/pkg/db"
 )
 
@@ -13,6 +15,10 @@ import (
 // It extracts the repository information, branch name, PR ID, PR number, and PR URL from the payload.
 // If any of these extractions fail, it returns an error.
 func CreateOrAssociatePullRequestFromPayload(event Event, payload map[string]interface{}) (*db.PullRequest, error) {
+	if isRunWithoutPR(event, payload) {
+		return knownPROfRun(event, payload)
+	}
+
 	repository, ok := payload["repository"].(map[string]interface{})
 	if !ok {
 		return &db.PullRequest{}, fmt.Errorf("failed to parse repository from payload")
@@ -44,7 +50,7 @@ func CreateOrAssociatePullRequestFromPayload(event Event, payload map[string]int
 		return &db.PullRequest{}, err
 	}
 
-	prId, err := extractPRID(event, payload)
+	prId, err := ExtractPRID(event, payload)
 	if err != nil {
 		return &db.PullRequest{}, err
 	}
@@ -64,6 +70,11 @@ func CreateOrAssociatePullRequestFromPayload(event Event, payload map[string]int
 		return &db.PullRequest{}, err
 	}
 
+	headSha, err := ExtractHeadSHA(event, payload)
+	if err != nil {
+		return &db.PullRequest{}, err
+	}
+
 	prRepo := db.PullRequestRepo{}
 	// Try to get the PR by its ID
 	pr, err := prRepo.GetByPrID(prId)
@@ -87,6 +98,15 @@ func CreateOrAssociatePullRequestFromPayload(event Event, payload map[string]int
 	pr.OwnerName = ownerName
 	pr.OwnerID = ownerId
 
+	// workflow runs can be about an older commit than the PR head, so only pull request events move the head
+	if event.name == "pull_request" || pr.HeadSHA == "" {
+		pr.HeadSHA = headSha
+	}
+
+	if event.name == "pull_request" {
+		pr.IsFork = isFork(payload)
+	}
+
 	return pr, nil
 }
 
@@ -161,10 +181,24 @@ func extractBranchName(event Event, payload map[string]interface{}) (string, err
 	return branchName, nil
 }
 
-func extractPRID(event Event, payload map[string]interface{}) (int64, error) {
+// ExtractPRID gives the id of the pull request the event is about
+func ExtractPRID(event Event, payload map[string]interface{}) (int64, error) {
 	var err error
 	var temp interface{}
 
+	if event.name == "issue_comment" {
+		return extractCommentedPRID(event, payload)
+	}
+
+	if isRunWithoutPR(event, payload) {
+		pr, err := knownPROfRun(event, payload)
+		if err != nil {
+			return 0, err
+		}
+
+		return pr.PrID, nil
+	}
+
 	if event.name == "pull_request" {
 		temp, err = extractValueFromPayload(payload, "pull_request", "id")
 	} else if event.name == "workflow_run" {
@@ -183,6 +217,197 @@ func extractPRID(event Event, payload map[string]interface{}) (int64, error) {
 	return int64(prId), nil
 }
 
+// isFork tells if the head branch of the PR is in another repository than the base one,
+// a fork that was deleted since is still a fork
+func isFork(payload map[string]interface{}) bool {
+	head, err := extractValueFromPayload(payload, "pull_request", "head", "repo", "full_name")
+	if err != nil {
+		return true
+	}
+
+	base, err := extractValueFromPayload(payload, "pull_request", "base", "repo", "full_name")
+
+	return err != nil || head != base
+}
+
+// isRunWithoutPR tells if the workflow run does not say which PR it ran for,
+// github leaves the PRs out of the runs of forks
+func isRunWithoutPR(event Event, payload map[string]interface{}) bool {
+	if event.name != "workflow_run" {
+		return false
+	}
+
+	_, err := extractValueFromPayload(payload, "workflow_run", "pull_requests", "0")
+
+	return err != nil
+}
+
+// knownPROfRun finds the PR a workflow run ran for from the commit and the branch it ran on, the PR must already be known.
+// Several PRs can be at the same commit, the run is not trusted to any of them when its branch does not tell which one it is.
+func knownPROfRun(event Event, payload map[string]interface{}) (*db.PullRequest, error) {
+	ownerName, _, err := extractRepoOwnerInfo(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	temp, err := extractValueFromPayload(payload, "repository", "name")
+	if err != nil {
+		return nil, errors.New(event.GetNameAction() + " - Could not extract repository name: " + err.Error())
+	}
+
+	repoName, ok := temp.(string)
+	if !ok {
+		return nil, errors.New(event.GetNameAction() + " - Could not extract repository name: value is not a string")
+	}
+
+	headSha, err := ExtractHeadSHA(event, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	temp, err = extractValueFromPayload(payload, "workflow_run", "head_branch")
+	if err != nil {
+		return nil, errors.New(event.GetNameAction() + " - Could not extract head branch: " + err.Error())
+	}
+
+	headBranch, ok := temp.(string)
+	if !ok {
+		return nil, errors.New(event.GetNameAction() + " - Could not extract head branch: value is not a string")
+	}
+
+	prRepo := db.PullRequestRepo{}
+	prs, err := prRepo.ListByHeadSHA(ownerName, repoName, headSha)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []*db.PullRequest{}
+	for i := range prs {
+		if prs[i].BranchName == headBranch {
+			matches = append(matches, &prs[i])
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("%s - no known PR of %s/%s is at %s on %s", event.GetNameAction(), ownerName, repoName, headSha, headBranch)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("%s - %d PRs of %s/%s are at %s on %s, the run can not be told apart", event.GetNameAction(), len(matches), ownerName, repoName, headSha, headBranch)
+	}
+}
+
+// extractCommentedPRID gives the id of the PR a comment was posted on, comments only carry the number of the PR
+// so it must be one imbere already knows
+func extractCommentedPRID(event Event, payload map[string]interface{}) (int64, error) {
+	if _, err := extractValueFromPayload(payload, "issue", "pull_request"); err != nil {
+		return 0, errors.New(event.GetNameAction() + " - the comment is not on a pull request")
+	}
+
+	temp, err := extractValueFromPayload(payload, "issue", "number")
+	if err != nil {
+		return 0, errors.New(event.GetNameAction() + " - Could not extract pull request number: " + err.Error())
+	}
+
+	prNumber, ok := temp.(float64)
+	if !ok {
+		return 0, errors.New(event.GetNameAction() + " - Could not extract pull request number: value is not a int64")
+	}
+
+	ownerName, _, err := extractRepoOwnerInfo(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	temp, err = extractValueFromPayload(payload, "repository", "name")
+	if err != nil {
+		return 0, errors.New(event.GetNameAction() + " - Could not extract repository name: " + err.Error())
+	}
+
+	repoName, ok := temp.(string)
+	if !ok {
+		return 0, errors.New(event.GetNameAction() + " - Could not extract repository name: value is not a string")
+	}
+
+	prRepo := db.PullRequestRepo{}
+	pr, err := prRepo.GetByRepoAndNumber(ownerName, repoName, int64(prNumber))
+	if err != nil {
+		return 0, err
+	}
+
+	if pr == nil {
+		return 0, fmt.Errorf("%s - PR #%d of %s/%s is not known", event.GetNameAction(), int64(prNumber), ownerName, repoName)
+	}
+
+	return pr.PrID, nil
+}
+
+// ExtractCommand gives the command of a comment (ie. "wake" for "/imbere wake"),
+// it is empty when the comment is not addressed to imbere
+func ExtractCommand(event Event, payload map[string]interface{}) string {
+	if event.name != "issue_comment" {
+		return ""
+	}
+
+	temp, err := extractValueFromPayload(payload, "comment", "body")
+	if err != nil {
+		return ""
+	}
+
+	body, ok := temp.(string)
+	if !ok {
+		return ""
+	}
+
+	fields := strings.Fields(body)
+	if len(fields) < 2 || fields[0] != constants.COMMAND_PREFIX {
+		return ""
+	}
+
+	return strings.ToLower(fields[1])
+}
+
+// extractCommandArgs gives what follows the command in a comment, ie. the commit of "/imbere rollback 1a2b3c4"
+func extractCommandArgs(event Event, payload map[string]interface{}) []string {
+	temp, err := extractValueFromPayload(payload, "comment", "body")
+	if err != nil || ExtractCommand(event, payload) == "" {
+		return nil
+	}
+
+	body, ok := temp.(string)
+	if !ok {
+		return nil
+	}
+
+	return strings.Fields(body)[2:]
+}
+
+// extractCommenter gives who posted a comment, and the id of the comment
+func extractCommenter(event Event, payload map[string]interface{}) (string, int64, error) {
+	temp, err := extractValueFromPayload(payload, "comment", "user", "login")
+	if err != nil {
+		return "", 0, errors.New(event.GetNameAction() + " - Could not extract commenter: " + err.Error())
+	}
+
+	user, ok := temp.(string)
+	if !ok {
+		return "", 0, errors.New(event.GetNameAction() + " - Could not extract commenter: value is not a string")
+	}
+
+	temp, err = extractValueFromPayload(payload, "comment", "id")
+	if err != nil {
+		return "", 0, errors.New(event.GetNameAction() + " - Could not extract comment id: " + err.Error())
+	}
+
+	commentID, ok := temp.(float64)
+	if !ok {
+		return "", 0, errors.New(event.GetNameAction() + " - Could not extract comment id: value is not a int64")
+	}
+
+	return user, int64(commentID), nil
+}
+
 func extractPRNumber(event Event, payload map[string]interface{}) (int64, error) {
 	var err error
 	var temp interface{}
@@ -205,6 +430,59 @@ func extractPRNumber(event Event, payload map[string]interface{}) (int64, error)
 	return int64(prNumber), nil
 }
 
+// ExtractHeadSHA gives the commit the event is about,
+// for workflow runs it's the commit the workflow ran on which is not necessarily the head of the PR anymore
+func ExtractHeadSHA(event Event, payload map[string]interface{}) (string, error) {
+	var err error
+	var temp interface{}
+
+	if event.name == "pull_request" {
+		temp, err = extractValueFromPayload(payload, "pull_request", "head", "sha")
+	} else if event.name == "workflow_run" {
+		temp, err = extractValueFromPayload(payload, "workflow_run", "head_sha")
+	}
+
+	if err != nil {
+		return "", errors.New(event.GetNameAction() + " - Could not extract head sha: " + err.Error())
+	}
+
+	headSha, ok := temp.(string)
+	if !ok {
+		return "", errors.New(event.GetNameAction() + " - Could not extract head sha: value is not a string")
+	}
+
+	return headSha, nil
+}
+
+// ExtractWorkflowConclusion gives how a workflow run ended, ie. success or failure
+func ExtractWorkflowConclusion(event Event, payload map[string]interface{}) (string, error) {
+	temp, err := extractValueFromPayload(payload, "workflow_run", "conclusion")
+	if err != nil {
+		return "", errors.New(event.GetNameAction() + " - Could not extract workflow conclusion: " + err.Error())
+	}
+
+	conclusion, ok := temp.(string)
+	if !ok {
+		return "", errors.New(event.GetNameAction() + " - Could not extract workflow conclusion: value is not a string")
+	}
+
+	return conclusion, nil
+}
+
+// IsNewPush tells if the event brings new code to the PR, either new commits were pushed
+// or the PR was edited to target another base branch.
+func IsNewPush(event Event, payload map[string]interface{}) bool {
+	switch event.GetNameAction() {
+	case "pull_request.synchronize":
+		return true
+	case "pull_request.edited":
+		_, err := extractValueFromPayload(payload, "changes", "base")
+		return err == nil
+	default:
+		return false
+	}
+}
+
 func extractLabelName(event Event, payload map[string]interface{}) (string, error) {
 	var err error
 	var temp interface{}
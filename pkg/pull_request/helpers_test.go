@@ -0,0 +1,154 @@
+package pull_request
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rssb/imbere/pkg/db"
+)
+
+func commentPayload(body string) map[string]interface{} {
+	return map[string]interface{}{
+		"comment": map[string]interface{}{
+			"id":   float64(1),
+			"body": body,
+			"user": map[string]interface{}{"login": "reviewer"},
+		},
+	}
+}
+
+func TestExtractCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		event Event
+		body  string
+		want  string
+	}{
+		{"command", NewEvent("issue_comment", "created"), "/imbere deploy", "deploy"},
+		{"upper case", NewEvent("issue_comment", "created"), "/imbere DePloy", "deploy"},
+		{"surrounding whitespace", NewEvent("issue_comment", "created"), "  \n/imbere \t status  \n", "status"},
+		{"with arguments", NewEvent("issue_comment", "created"), "/imbere rollback abc123", "rollback"},
+		{"unknown command", NewEvent("issue_comment", "created"), "/imbere explode", "explode"},
+		{"prefix alone", NewEvent("issue_comment", "created"), "/imbere", ""},
+		{"upper case prefix", NewEvent("issue_comment", "created"), "/IMBERE deploy", ""},
+		{"prefix inside a sentence", NewEvent("issue_comment", "created"), "please /imbere deploy", ""},
+		{"prefix glued to the command", NewEvent("issue_comment", "created"), "/imberedeploy", ""},
+		{"regular comment", NewEvent("issue_comment", "created"), "looks good to me", ""},
+		{"empty comment", NewEvent("issue_comment", "created"), "", ""},
+		{"not a comment", NewEvent("pull_request", "labeled"), "/imbere deploy", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ExtractCommand(test.event, commentPayload(test.body)); got != test.want {
+				t.Errorf("ExtractCommand(%q) = %q, want %q", test.body, got, test.want)
+			}
+		})
+	}
+
+	if got := ExtractCommand(NewEvent("issue_comment", "created"), map[string]interface{}{}); got != "" {
+		t.Errorf("ExtractCommand() of a payload without comment = %q, want none", got)
+	}
+}
+
+func TestExtractCommandArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"no argument", "/imbere rollback", []string{}},
+		{"argument", "/imbere rollback abc123", []string{"abc123"}},
+		{"arguments keep their case", "/imbere rollback ABC123", []string{"ABC123"}},
+		{"whitespace between arguments", "/imbere rollback \t abc123 \n now ", []string{"abc123", "now"}},
+		{"not a command", "rollback abc123", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := extractCommandArgs(NewEvent("issue_comment", "created"), commentPayload(test.body)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("extractCommandArgs(%q) = %#v, want %#v", test.body, got, test.want)
+			}
+		})
+	}
+}
+
+func TestKnownPROfRun(t *testing.T) {
+	prRepo := db.PullRequestRepo{}
+
+	// two forks opened from branches at the same commit, and a third from a branch with the same name
+	prs := []*db.PullRequest{newTestPR(), newTestPR(), newTestPR()}
+	for i, pr := range prs {
+		pr.RepoName = "runs"
+		pr.HeadSHA = "ccc333"
+		pr.BranchName = []string{"main", "fix", "fix"}[i]
+		pr.IsFork = true
+		if i == 2 {
+			pr.RepoName = "other-runs"
+		}
+
+		if err := prRepo.Save(pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run := func(repoName string, sha string, branch string) map[string]interface{} {
+		return map[string]interface{}{
+			"repository": map[string]interface{}{
+				"name":  repoName,
+				"owner": map[string]interface{}{"login": "rssb", "id": float64(1)},
+			},
+			"workflow_run": map[string]interface{}{
+				"head_sha":      sha,
+				"head_branch":   branch,
+				"pull_requests": []interface{}{},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		payload map[string]interface{}
+		want    int64 // 0 when the run is not attributed to any PR
+	}{
+		{"branch tells the PRs at the commit apart", run("runs", "ccc333", "fix"), prs[1].PrID},
+		{"other branch at the same commit", run("runs", "ccc333", "main"), prs[0].PrID},
+		{"same branch in another repository", run("other-runs", "ccc333", "fix"), prs[2].PrID},
+		{"branch of no PR at the commit", run("runs", "ccc333", "feature"), 0},
+		{"unknown commit", run("runs", "ddd444", "fix"), 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pr, err := knownPROfRun(NewEvent("workflow_run", "completed"), test.payload)
+
+			if test.want == 0 {
+				if err == nil {
+					t.Errorf("knownPROfRun() = PR ID: %d, want an error", pr.PrID)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if pr.PrID != test.want {
+				t.Errorf("knownPROfRun() = PR ID: %d, want %d", pr.PrID, test.want)
+			}
+		})
+	}
+
+	// a fork pushed the same branch at the same commit, the run could be of either
+	twin := newTestPR()
+	twin.RepoName = "runs"
+	twin.HeadSHA = "ccc333"
+	twin.BranchName = "fix"
+	if err := prRepo.Save(twin); err != nil {
+		t.Fatal(err)
+	}
+
+	if pr, err := knownPROfRun(NewEvent("workflow_run", "completed"), run("runs", "ccc333", "fix")); err == nil {
+		t.Errorf("knownPROfRun() of an ambiguous run = PR ID: %d, want an error", pr.PrID)
+	}
+}
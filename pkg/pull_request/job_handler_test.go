@@ -0,0 +1,231 @@
+package pull_request
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rssb/imbere/pkg/config"
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+	"github.com/rssb/imbere/pkg/github_fake"
+	"github.com/rssb/imbere/pkg/repo_config"
+	"github.com/rssb/imbere/pkg/scheduler"
+)
+
+// newTestRepository creates a git repository with a single commit on branch, holding the given .imbere.yml.
+// It gives the path of the repository, PRs are cloned from it as from github, and the sha of the commit.
+func newTestRepository(t *testing.T, branch string, imbereYml string) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=imbere", "GIT_AUTHOR_EMAIL=imbere@example.com", "GIT_COMMITTER_NAME=imbere", "GIT_COMMITTER_EMAIL=imbere@example.com")
+
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, output)
+		}
+
+		return strings.TrimSpace(string(output))
+	}
+
+	git("init", "--quiet", "--initial-branch", branch)
+
+	if err := os.WriteFile(filepath.Join(dir, repo_config.FILE_NAME), []byte(imbereYml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	git("add", repo_config.FILE_NAME)
+	git("commit", "--quiet", "-m", "preview")
+
+	return dir, git("rev-parse", "HEAD")
+}
+
+// newTestJob gives the job the webhook queues for a pull_request event
+func newTestJob(t *testing.T, pr *db.PullRequest, action string, label string) *db.Job {
+	t.Helper()
+
+	payload, err := json.Marshal(pullRequestPayload(pr, action, pr.OwnerName+"/"+pr.RepoName, label))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &db.Job{
+		PrID:        pr.PrID,
+		EventName:   "pull_request",
+		EventAction: action,
+		Payload:     string(payload),
+	}
+}
+
+// runPipeline opens a PR on a local repository deployed with the process deployer and labels it to deploy it,
+// github is the fake: the PR is checked against what it recorded. It gives the handler the next jobs of the PR go through.
+func runPipeline(t *testing.T, imbereYml string) (*github_fake.Server, *db.PullRequest, func(ctx context.Context, job *db.Job) error) {
+	t.Helper()
+
+	fake := github_fake.NewServer()
+	t.Cleanup(fake.Close)
+
+	pr := newTestPR()
+	pr.RepoName = fmt.Sprintf("pipeline-%d", pr.PrID)
+	pr.RepoAddress, pr.HeadSHA = newTestRepository(t, pr.BranchName, imbereYml)
+
+	settingsRepo := db.RepositorySettingsRepo{}
+	if err := settingsRepo.Save(&db.RepositorySettings{
+		OwnerName: pr.OwnerName,
+		RepoName:  pr.RepoName,
+		Deployer:  constants.DEPLOYER_PROCESS,
+		CloneAuth: constants.CLONE_AUTH_NONE,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	appConfig := &config.Config{
+		BuildDir: t.TempDir(),
+		Preview:  config.PreviewConfig{Scheme: "http", Host: "localhost"},
+		Timeouts: config.TimeoutsConfig{Pull: 1, Install: 1, Build: 1, Deploy: 1},
+	}
+
+	handler := NewJobHandler(appConfig, fake.Factory(), scheduler.New(config.ConcurrencyConfig{MaxBuilds: config.DEFAULT_MAX_BUILDS}))
+	ctx := context.Background()
+
+	for _, job := range []*db.Job{newTestJob(t, pr, "opened", ""), newTestJob(t, pr, "labeled", constants.DEPLOYMENT_LABEL)} {
+		if err := handler(ctx, job); err != nil {
+			t.Fatalf("pull_request.%s failed: %s", job.EventAction, err)
+		}
+	}
+
+	// the app must not outlive the test
+	t.Cleanup(func() {
+		prRepo := db.PullRequestRepo{}
+		if current, err := prRepo.GetByPrID(pr.PrID); err == nil && current.Deployed {
+			handler(ctx, newTestJob(t, pr, "closed", ""))
+		}
+	})
+
+	return fake, pr, handler
+}
+
+func TestJobHandlerDeploysWithFakeGithub(t *testing.T) {
+	fake, pr, handler := runPipeline(t, `
+install: ""
+build: ""
+start: exec python3 -m http.server "$PORT" --bind 127.0.0.1
+health_check:
+  path: /
+  interval: 1
+`)
+
+	prRepo := db.PullRequestRepo{}
+
+	deployed, err := prRepo.GetByPrID(pr.PrID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !deployed.Deployed || deployed.DeployedSHA != pr.HeadSHA || deployed.DeploymentPort == 0 {
+		t.Fatalf("PR after the deployment: deployed %v, sha %q, port %d, want %s deployed on a port", deployed.Deployed, deployed.DeployedSHA, deployed.DeploymentPort, pr.HeadSHA)
+	}
+
+	comments := fake.Comments()
+	if len(comments) != 1 || !strings.Contains(comments[0].Body, "Deployed") || comments[0].Number != pr.PrNumber {
+		t.Errorf("comments = %+v, want the comment of the PR showing it deployed", comments)
+	}
+
+	checkRuns := fake.CheckRuns()
+	if len(checkRuns) != 1 || checkRuns[0].HeadSHA != pr.HeadSHA || checkRuns[0].Status != "completed" || checkRuns[0].Conclusion != "success" {
+		t.Errorf("check runs = %+v, want a successful one on %s", checkRuns, pr.HeadSHA)
+	}
+
+	if len(fake.Statuses()) != 0 {
+		t.Errorf("commit statuses = %+v, want none, the check run reports the deployment", fake.Statuses())
+	}
+
+	deployments := fake.Deployments()
+	if len(deployments) != 1 || deployments[0].Ref != pr.HeadSHA {
+		t.Fatalf("deployments = %+v, want one of %s", deployments, pr.HeadSHA)
+	}
+
+	statuses := fake.DeploymentStatuses(deployments[0].ID)
+	if len(statuses) == 0 || statuses[len(statuses)-1].State != "success" || statuses[len(statuses)-1].EnvironmentURL == "" {
+		t.Errorf("deployment statuses = %+v, want the last one successful with the preview url", statuses)
+	}
+
+	response, err := http.Get(statuses[len(statuses)-1].EnvironmentURL)
+	if err != nil {
+		t.Fatalf("the preview is not served: %s", err)
+	}
+	response.Body.Close()
+
+	// closing the PR stops the preview
+	if err := handler(context.Background(), newTestJob(t, pr, "closed", "")); err != nil {
+		t.Fatalf("pull_request.closed failed: %s", err)
+	}
+
+	closed, err := prRepo.GetByPrID(pr.PrID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if closed.Deployed || !closed.Closed {
+		t.Errorf("PR once closed: deployed %v, closed %v, want it closed and not deployed", closed.Deployed, closed.Closed)
+	}
+
+	statuses = fake.DeploymentStatuses(deployments[0].ID)
+	if statuses[len(statuses)-1].State != "inactive" {
+		t.Errorf("deployment statuses = %+v, want the last one inactive", statuses)
+	}
+
+	if response, err := http.Get(statuses[len(statuses)-2].EnvironmentURL); err == nil {
+		response.Body.Close()
+		t.Error("the preview is still served once the PR is closed")
+	}
+}
+
+func TestJobHandlerReportsFailedBuildsWithFakeGithub(t *testing.T) {
+	fake, pr, _ := runPipeline(t, `
+install: ""
+build: exit 3
+start: exec python3 -m http.server "$PORT" --bind 127.0.0.1
+`)
+
+	prRepo := db.PullRequestRepo{}
+
+	failed, err := prRepo.GetByPrID(pr.PrID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if failed.Deployed || failed.IsDeploying {
+		t.Errorf("PR after the failed build: deployed %v, deploying %v, want neither", failed.Deployed, failed.IsDeploying)
+	}
+
+	comments := fake.Comments()
+	if len(comments) != 1 || !strings.Contains(comments[0].Body, "build command failed with exit status 3") {
+		t.Errorf("comments = %+v, want the comment of the PR showing why the build failed", comments)
+	}
+
+	checkRuns := fake.CheckRuns()
+	if len(checkRuns) != 1 || checkRuns[0].Conclusion != "failure" {
+		t.Errorf("check runs = %+v, want a failed one", checkRuns)
+	}
+
+	deployments := fake.Deployments()
+	if len(deployments) != 1 {
+		t.Fatalf("deployments = %+v, want one", deployments)
+	}
+
+	statuses := fake.DeploymentStatuses(deployments[0].ID)
+	if len(statuses) == 0 || statuses[len(statuses)-1].State != "failure" {
+		t.Errorf("deployment statuses = %+v, want the last one failed", statuses)
+	}
+}
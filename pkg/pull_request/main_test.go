@@ -0,0 +1,126 @@
+package pull_request
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rssb/imbere/pkg/config"
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+	"github.com/rssb/imbere/pkg/process_monitor"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "imbere-pull-request-test-*")
+	if err != nil {
+		panic(err)
+	}
+
+	db.DbInit(filepath.Join(dir, "imbere.db"), nil)
+
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestService gives a service of the PR building in a temporary directory, without github
+func newTestService(t *testing.T, pr *db.PullRequest) *PullRequestService {
+	t.Helper()
+
+	appConfig := &config.Config{BuildDir: t.TempDir()}
+
+	monitor := process_monitor.NewProcessMonitor(pr, nil, appConfig)
+	t.Cleanup(monitor.Close)
+
+	return NewPullRequestService(pr, monitor, nil, appConfig, nil)
+}
+
+// addBuilds creates the directories of the given slots of the PR
+func addBuilds(t *testing.T, service *PullRequestService, slots ...int64) {
+	t.Helper()
+
+	for _, slot := range slots {
+		if err := os.MkdirAll(filepath.Join(service.appConfig.BuildDir, service.pr.GetSlotDir(slot)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// addDeployment records a finished deployment of the PR
+func addDeployment(t *testing.T, pr *db.PullRequest, attempt int64, slot int64, sha string, outcome constants.ProcessOutcome) {
+	t.Helper()
+
+	deploymentRepo := db.DeploymentRepo{}
+	deployment := &db.Deployment{
+		PullRequestID: 1,
+		PrID:          pr.PrID,
+		Attempt:       attempt,
+		Slot:          slot,
+		HeadSHA:       sha,
+		TriggerEvent:  "test",
+	}
+
+	if err := deploymentRepo.Create(deployment); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deploymentRepo.Finish(deployment, outcome, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nextPrID gives every test its own PR, they share the database
+var lastPrID int64 = 1000
+
+func nextPrID() int64 {
+	lastPrID++
+	return lastPrID
+}
+
+func newTestPR() *db.PullRequest {
+	prId := nextPrID()
+
+	return &db.PullRequest{
+		PrID:       prId,
+		PrNumber:   prId,
+		BranchName: "feature",
+		RepoName:   "app",
+		OwnerName:  "rssb",
+	}
+}
+
+// pullRequestPayload gives the payload github sends about the PR, headRepository is the full name of the repository
+// of its branch (ie. a fork) and label the label that was added or removed, if any
+func pullRequestPayload(pr *db.PullRequest, action string, headRepository string, label string) map[string]interface{} {
+	payload := map[string]interface{}{
+		"action": action,
+		"repository": map[string]interface{}{
+			"name":     pr.RepoName,
+			"html_url": pr.RepoAddress,
+			"ssh_url":  pr.SSHAddress,
+			"owner":    map[string]interface{}{"login": pr.OwnerName, "id": float64(1)},
+		},
+		"pull_request": map[string]interface{}{
+			"id":     float64(pr.PrID),
+			"number": float64(pr.PrNumber),
+			"url":    "https://api.github.com/repos/" + pr.OwnerName + "/" + pr.RepoName + "/pulls/" + pr.GetPrNumber(),
+			"head": map[string]interface{}{
+				"ref":  pr.BranchName,
+				"sha":  pr.HeadSHA,
+				"repo": map[string]interface{}{"full_name": headRepository},
+			},
+			"base": map[string]interface{}{
+				"repo": map[string]interface{}{"full_name": pr.OwnerName + "/" + pr.RepoName},
+			},
+		},
+		"installation": map[string]interface{}{"id": float64(1)},
+	}
+
+	if label != "" {
+		payload["label"] = map[string]interface{}{"name": label}
+	}
+
+	return payload
+}
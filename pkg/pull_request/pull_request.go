@@ -1,15 +1,27 @@
 package pull_request
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"time"
 
+	"github.com/rssb/imbere/pkg/client"
+	"github.com/rssb/imbere/pkg/config"
 	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/credentials"
 	"github.com/rssb/imbere/pkg/db"
 	"github.com/rssb/imbere/pkg/deployment"
+	"github.com/rssb/imbere/pkg/git_mirror"
+	"github.com/rssb/imbere/pkg/logs"
 	"github.com/rssb/imbere/pkg/process_monitor"
+	"github.com/rssb/imbere/pkg/scheduler"
+	"github.com/rssb/imbere/pkg/utils"
 )
 
 // Concrete type that implements PullRequest
@@ -19,6 +31,21 @@ type Event struct {
 	action string
 }
 
+func NewEvent(name string, action string) Event {
+	return Event{
+		name:   name,
+		action: action,
+	}
+}
+
+func (event *Event) GetName() string {
+	return event.name
+}
+
+func (event *Event) GetAction() string {
+	return event.action
+}
+
 // gives a combination of event name(type) and action
 // ie. workflow_run.completed or pull_request.opened
 func (event *Event) GetNameAction() string {
@@ -26,15 +53,22 @@ func (event *Event) GetNameAction() string {
 }
 
 type PullRequestService struct {
-	pr      *db.PullRequest
-	monitor *process_monitor.ProcessMonitor
+	pr         *db.PullRequest
+	monitor    *process_monitor.ProcessMonitor
+	client     client.GithubClient // gives the tokens the repository is cloned with
+	appConfig  *config.Config
+	deployment *db.Deployment       // record of the current deployment attempt, see startAttempt
+	builds     *scheduler.Scheduler // limits how many PRs are built at the same time
 }
 
-func NewPullRequestService(pr *db.PullRequest, processMonitor *process_monitor.ProcessMonitor) *PullRequestService {
+func NewPullRequestService(pr *db.PullRequest, processMonitor *process_monitor.ProcessMonitor, githubClient client.GithubClient, appConfig *config.Config, builds *scheduler.Scheduler) *PullRequestService {
 
 	return &PullRequestService{
-		pr:      pr,
-		monitor: processMonitor,
+		pr:        pr,
+		monitor:   processMonitor,
+		client:    githubClient,
+		appConfig: appConfig,
+		builds:    builds,
 	}
 }
 
@@ -42,46 +76,66 @@ func (service *PullRequestService) log(content string) {
 	service.monitor.AddLog(content)
 }
 
-func (service *PullRequestService) removeDir() error {
-	dirPath := constants.BUILD_DIR + service.pr.GetDir()
+// dirPath is the directory the current attempt is built in, see db.PullRequest.GetSlotDir
+func (service *PullRequestService) dirPath() string {
+	return filepath.Join(service.appConfig.BuildDir, service.pr.GetSlotDir(service.pr.Attempts))
+}
 
-	if _, err := os.Stat(dirPath); !os.IsNotExist(err) {
-		removeDirErr := os.RemoveAll(dirPath)
+func (service *PullRequestService) mirror() *git_mirror.Mirror {
+	return git_mirror.New(service.appConfig.BuildDir, service.pr.OwnerName, service.pr.RepoName, service.monitor)
+}
+
+// removeDir removes the builds of every attempt of the PR
+func (service *PullRequestService) removeDir(ctx context.Context) error {
+	slots, dirs := service.slots()
 
-		if removeDirErr != nil {
+	for _, slot := range slots {
+		if err := service.removeSlot(ctx, slot, dirs[slot]); err != nil {
 			service.log(fmt.Sprintf("Failed to remove directory: %s", err.Error()))
-			return removeDirErr
+			return err
 		}
+
+		service.log(fmt.Sprintf("Directory %s  removed successfully", dirs[slot]))
 	}
-	service.log(fmt.Sprintf("Directory %s  removed successfully", dirPath))
+
 	return nil
 }
 
-// When a pull request (PR) is created, a corresponding directory is generated that contains the changes introduced by the PR.
-// If a directory for the PR already exists, it is first deleted and then recreated to reflect the latest changes.
-// This approach ensures that any new pushes to the PR are incorporated, keeping the deployed code up-to-date.
+// When a pull request (PR) is deployed, a directory is generated for the attempt that contains the changes introduced by the PR,
+// the preview keeps running from the directory of the previous attempt until the new one is ready.
+// The latest build the preview does not run is moved to the new directory and updated in place (see git_mirror)
+// so that dependencies and build caches are reused by the next deployment.
 // The directory can later be deployed to any environment, enabling continuous integration and delivery.
-func (service *PullRequestService) prepareDir() (string, error) {
-	dirPath := constants.BUILD_DIR + service.pr.GetDir()
+func (service *PullRequestService) prepareDir(ctx context.Context) (string, error) {
+	dirPath := service.dirPath()
 
 	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_PREPARING_DIR, constants.PROCESS_OUTCOME_ONGOING)
 
-	// check if dir exists and remove it
-	if err := service.removeDir(); err != nil {
-		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_PREPARING_DIR, constants.PROCESS_OUTCOME_FAILED)
-		return "", err
+	if _, err := os.Stat(dirPath); err == nil {
+		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_PREPARING_DIR, constants.PROCESS_OUTCOME_SUCCEEDED)
+		service.log(fmt.Sprintf("Directory %s exists, it will be updated", dirPath))
+		return dirPath, nil
 	}
 
-	// create dir
-	err := os.MkdirAll(dirPath, 0755)
+	// create the parent dir, the directory itself is created by git
+	err := os.MkdirAll(filepath.Dir(dirPath), 0755)
 	if err != nil {
 		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_PREPARING_DIR, constants.PROCESS_OUTCOME_FAILED)
 		service.log(fmt.Sprintf("Failed to create directory: %s", err.Error()))
 		return "", err
 	}
 
+	if reusable := service.reusableSlot(); reusable != "" {
+		if err := service.mirror().MoveWorktree(ctx, reusable, dirPath); err != nil {
+			// the checkout starts from scratch instead
+			service.log(fmt.Sprintf("Failed to reuse %s: %s", reusable, err.Error()))
+		} else {
+			service.log(fmt.Sprintf("Reusing the build in %s", reusable))
+		}
+	}
+
 	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_PREPARING_DIR, constants.PROCESS_OUTCOME_SUCCEEDED)
-	service.log(fmt.Sprintf("Directory %s created successfully", dirPath))
+	service.log(fmt.Sprintf("Directory %s prepared successfully", filepath.Dir(dirPath)))
 
 	return dirPath, nil
 }
@@ -98,7 +152,7 @@ func (service *PullRequestService) save() error {
 // 2. Pull the latest changes from the pull request into this directory.
 // 3. Save the current state of the pull request in the database.
 // These steps ensure that we have the most recent code changes isolated in a separate directory and the pull request's status is accurately tracked in the database.
-func (service *PullRequestService) PullChanges() error {
+func (service *PullRequestService) PullChanges(ctx context.Context) error {
 	_, err := exec.LookPath("git")
 	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_STARTED, constants.PROCESS_OUTCOME_ONGOING)
 
@@ -115,35 +169,57 @@ func (service *PullRequestService) PullChanges() error {
 
 	// prepare cloning dir
 	// the process about directory creation is communicated inside this method
-	dirPath, err := service.prepareDir()
+	dirPath, err := service.prepareDir(ctx)
 	if err != nil {
 		return err
 	}
 
 	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_PULLING_CHANGES, constants.PROCESS_OUTCOME_ONGOING)
 
-	cmd := exec.Command("git", "clone", "-b", service.pr.BranchName, "--single-branch", service.pr.RepoAddress, dirPath)
-	cmd.Env = append(os.Environ(),
-		"GIT_SSH_COMMAND=ssh -i ./.ssh/key -F /dev/null",
-	)
-
-	service.monitor.ListenToCmd(cmd) // listen for outcome
-
-	err = cmd.Start()
+	settingsRepo := db.RepositorySettingsRepo{}
+	settings, err := settingsRepo.Get(service.pr.OwnerName, service.pr.RepoName)
 	if err != nil {
-		service.log(fmt.Sprintf("Failed to clone repository: %s", err.Error()))
 		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_PULLING_CHANGES, constants.PROCESS_OUTCOME_FAILED)
 		return err
 	}
 
-	err = cmd.Wait()
+	creds, err := credentials.ForPR(service.pr, settings, service.client)
 	if err != nil {
-		service.log(fmt.Sprintf("Failed to clone repository: %s", err.Error()))
+		service.log(fmt.Sprintf("Failed to get credentials to clone the repository with: %s", err.Error()))
 		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_PULLING_CHANGES, constants.PROCESS_OUTCOME_FAILED)
 		return err
 	}
+	defer creds.Close()
+
+	service.log(fmt.Sprintf("Fetching %s from %s with %s auth", service.pr.HeadSHA, creds.URL, settings.GetCloneAuth()))
+
+	timeout := time.Duration(service.appConfig.Timeouts.Pull) * time.Minute
+	pullCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// the checkout is reset to the exact commit the event was about, not to whatever the branch points to by now
+	err = service.mirror().Checkout(pullCtx, creds, service.pr.GetHeadRef(), service.pr.HeadSHA, dirPath)
+	if err != nil {
+		err = utils.StepError(pullCtx, timeout, err)
+		service.log(fmt.Sprintf("Failed to pull changes: %s", err.Error()))
+		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_PULLING_CHANGES, utils.StepOutcome(err))
+		return err
+	}
+
+	// what is built must be the commit the event was about (ie. the one the workflow passed on)
+	head, err := service.mirror().Head(pullCtx, dirPath)
+	if err == nil && service.pr.HeadSHA != "" && head != service.pr.HeadSHA {
+		err = fmt.Errorf("checked out %s instead of %s", head, service.pr.HeadSHA)
+	}
+
+	if err != nil {
+		err = utils.StepError(pullCtx, timeout, err)
+		service.log(fmt.Sprintf("Failed to verify the checked out commit: %s", err.Error()))
+		service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_PULLING_CHANGES, utils.StepOutcome(err))
+		return err
+	}
 
-	service.log("Repository cloned successfully")
+	service.log(fmt.Sprintf("Repository updated successfully to %s", head))
 	service.monitor.UpdateProgress(constants.PROCESS_PROGRESS_PULLING_CHANGES, constants.PROCESS_OUTCOME_SUCCEEDED)
 
 	err = service.save()
@@ -156,68 +232,365 @@ func (service *PullRequestService) PullChanges() error {
 
 func (service *PullRequestService) MarkActive() error {
 	service.pr.Active = true
+	service.pr.Closed = false
 	return service.save()
 }
 
-func (service *PullRequestService) Deploy() error {
+// Close un deploys the PR, it is remembered as closed so that the reconciler stops its preview
+// if un deploying it does not go through
+func (service *PullRequestService) Close(ctx context.Context) error {
+	service.pr.Active = false
+	service.pr.Closed = true
+
+	if err := service.save(); err != nil {
+		return err
+	}
+
+	return service.UnDeploy(ctx)
+}
+
+// Deploy runs the deployment pipeline, trigger is the event that started it (ie. workflow_run.completed)
+// and is kept in the deployment history.
+func (service *PullRequestService) Deploy(ctx context.Context, trigger string) error {
 	if service.pr.IsDeploying {
 		service.log(fmt.Sprintf("There is a deployment in progress for this PR ID: %s, skipping...", service.pr.GetPrId()))
-	} else {
+		return nil
+	}
 
-		err := service.PullChanges()
+	restriction, err := service.forkRestriction()
+	if err != nil {
+		return err
+	}
 
-		if err != nil {
-			return err
-		}
+	if restriction != "" {
+		service.log(fmt.Sprintf("Not deploying PR ID: %s, %s", service.pr.GetPrId(), restriction))
+		return nil
+	}
 
-		deploymentService := deployment.NewDeploymentService(service.pr, service.monitor)
+	err = service.deploy(ctx, trigger)
+	service.endAttempt(ctx, err)
 
-		err = deploymentService.InstallDependencies()
-		if err != nil {
-			return err
-		}
+	return err
+}
 
-		err = deploymentService.Build()
-		if err != nil {
-			return err
+// Rollback deploys again the build of a previous successful deployment, it is not pulled, installed nor built again.
+// sha selects the commit whose build is deployed (a prefix is enough), without it the latest build of another commit
+// than the one the preview runs is. The deployment rolled back to is returned.
+func (service *PullRequestService) Rollback(ctx context.Context, sha string, trigger string) (*db.Deployment, error) {
+	if service.pr.IsDeploying {
+		return nil, errors.New("a deployment of the PR is in progress, try again once it is done")
+	}
+
+	if service.pr.Closed {
+		return nil, errors.New("the PR is closed")
+	}
+
+	target, err := service.rollbackTarget(sha)
+	if err != nil {
+		return nil, err
+	}
+
+	err = service.rollback(ctx, target, trigger)
+	service.endAttempt(ctx, err)
+
+	return target, err
+}
+
+func (service *PullRequestService) rollback(ctx context.Context, target *db.Deployment, trigger string) error {
+	err := service.startAttempt(trigger, target)
+	if err != nil {
+		return err
+	}
+
+	service.pr.IsDeploying = true
+	if err := service.save(); err != nil {
+		return err
+	}
+
+	service.log(fmt.Sprintf("Rolling back to the build of attempt #%d (%s)", target.Attempt, utils.ShortSHA(target.HeadSHA)))
+
+	deploymentService := deployment.NewDeploymentService(service.pr, service.monitor, service.appConfig)
+
+	err = deploymentService.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	return deploymentService.Deploy(ctx)
+}
+
+// endAttempt records the outcome of the deployment attempt, the builds that are no longer needed are removed once it went through
+func (service *PullRequestService) endAttempt(ctx context.Context, err error) {
+	service.finishAttempt(err)
+
+	if err == nil {
+		service.pruneSlots(ctx)
+		return
+	}
+
+	// the deployment did not go through (failed or cancelled by a newer push),
+	// the PR should not stay flagged as deploying otherwise the next deployments would be skipped
+	service.pr.IsDeploying = false
+	if saveErr := service.save(); saveErr != nil {
+		service.log(fmt.Sprintf("Failed to reset deploying status: %s", saveErr.Error()))
+	}
+}
+
+// approveHead allows the current commit of a fork to be deployed, see constants.FORK_POLICY_LABEL.
+// It is called when a maintainer labels the PR or asks for a deployment, new pushes need to be approved again.
+func (service *PullRequestService) approveHead() {
+	if service.pr.IsFork {
+		service.pr.ApprovedSHA = service.pr.HeadSHA
+	}
+}
+
+// forkRestriction gives why the PR can not be deployed because it comes from a fork, it is empty when it can be
+func (service *PullRequestService) forkRestriction() (string, error) {
+	if !service.pr.IsFork {
+		return "", nil
+	}
+
+	settingsRepo := db.RepositorySettingsRepo{}
+	settings, err := settingsRepo.Get(service.pr.OwnerName, service.pr.RepoName)
+	if err != nil {
+		return "", err
+	}
+
+	switch settings.GetForkPolicy() {
+	case constants.FORK_POLICY_LABEL:
+		if service.pr.ApprovedSHA != service.pr.HeadSHA {
+			return fmt.Sprintf("commit %s of the fork was not approved, a maintainer has to label the PR %s again or comment `%s %s`",
+				utils.ShortSHA(service.pr.HeadSHA), constants.DEPLOYMENT_LABEL, constants.COMMAND_PREFIX, constants.COMMAND_DEPLOY), nil
 		}
 
-		err = deploymentService.Deploy()
+		return "", nil
+	case constants.FORK_POLICY_SANDBOX:
+		return "", nil
+	default:
+		return "PRs from forks are not deployed on this repository", nil
+	}
+}
+
+// startAttempt numbers the deployment that is starting and records it in the history, its logs are stored under that number.
+// A new build is made for the attempt, unless it rolls back to the build of target.
+// Logs of old attempts are pruned at the same time.
+func (service *PullRequestService) startAttempt(trigger string, target *db.Deployment) error {
+	service.pr.Attempts++
+
+	if service.pr.LogsToken == "" {
+		token, err := logs.NewToken()
 		if err != nil {
 			return err
 		}
 
+		service.pr.LogsToken = token
+	}
+
+	if err := service.save(); err != nil {
+		return err
+	}
+
+	deploymentRepo := db.DeploymentRepo{}
+	deployment := &db.Deployment{
+		PullRequestID: service.pr.ID,
+		PrID:          service.pr.PrID,
+		Attempt:       service.pr.Attempts,
+		Slot:          service.pr.Attempts,
+		HeadSHA:       service.pr.HeadSHA,
+		TriggerEvent:  trigger,
+	}
+
+	if target != nil {
+		deployment.Slot = target.GetSlot()
+		deployment.HeadSHA = target.HeadSHA
+	}
+
+	if err := deploymentRepo.Create(deployment); err != nil {
+		return err
+	}
+
+	service.deployment = deployment
+	service.monitor.SetDeployment(deployment)
+
+	logRepo := db.LogLineRepo{}
+	oldestAttempt := service.pr.Attempts - constants.LOG_RETENTION_ATTEMPTS + 1
+	expiry := time.Now().AddDate(0, 0, -constants.LOG_RETENTION_DAYS)
+
+	if err := logRepo.Prune(service.pr.PrID, oldestAttempt, expiry); err != nil {
+		service.log(fmt.Sprintf("Failed to prune old logs: %s", err.Error()))
 	}
 
 	return nil
 }
 
-func (service *PullRequestService) UnDeploy() error {
+// finishAttempt records the outcome of the deployment attempt in the history
+func (service *PullRequestService) finishAttempt(deployErr error) {
+	if service.deployment == nil {
+		return
+	}
+
+	deploymentRepo := db.DeploymentRepo{}
+
+	outcome := constants.PROCESS_OUTCOME_SUCCEEDED
+	failureReason := ""
 
-	err := service.removeDir()
+	if deployErr != nil {
+		outcome = utils.StepOutcome(deployErr)
+		failureReason = deployErr.Error()
 
+		// steps that fail report it themselves, the ones that were interrupted (ie. by a newer push) would stay in progress on the PR checks
+		if !utils.IsOutcomeFailure(service.monitor.Status) {
+			service.monitor.UpdateProgress(service.monitor.Progress, outcome)
+		}
+	}
+
+	if err := deploymentRepo.Finish(service.deployment, outcome, failureReason); err != nil {
+		service.log(fmt.Sprintf("Failed to record deployment outcome: %s", err.Error()))
+	}
+}
+
+// waitForBuild waits for the scheduler to let the PR be built, its place in the queue is shown on the PR meanwhile.
+// PRs whose last deployment is broken are built first.
+func (service *PullRequestService) waitForBuild(ctx context.Context, broken bool) (release func(), err error) {
+	build := scheduler.Build{
+		PrID:           service.pr.PrID,
+		Repository:     service.pr.OwnerName + "/" + service.pr.RepoName,
+		InstallationID: service.pr.InstallationID,
+		Broken:         broken,
+	}
+
+	release, err = service.builds.Acquire(ctx, build, func(ahead int) {
+		service.log(fmt.Sprintf("Waiting for a build slot, %d ahead", ahead))
+		service.monitor.SetQueued(ahead)
+	})
+	if err != nil {
+		service.log(fmt.Sprintf("Stopped waiting for a build slot: %s", err.Error()))
+		return nil, err
+	}
+
+	return release, nil
+}
+
+// isBroken tells if the last deployment of the PR did not go through, a cancelled one was replaced by a newer one
+func (service *PullRequestService) isBroken() bool {
+	deploymentRepo := db.DeploymentRepo{}
+
+	latest, err := deploymentRepo.GetLatest(service.pr.PrID)
+	if err != nil || latest == nil {
+		return false
+	}
+
+	return latest.Outcome == constants.PROCESS_OUTCOME_FAILED || latest.Outcome == constants.PROCESS_OUTCOME_TIMED_OUT
+}
+
+func (service *PullRequestService) deploy(ctx context.Context, trigger string) error {
+	// before the attempt that is starting becomes the latest one
+	broken := service.isBroken()
+
+	err := service.startAttempt(trigger, nil)
+	if err != nil {
+		return err
+	}
+
+	release, err := service.waitForBuild(ctx, broken)
 	if err != nil {
 		return err
 	}
+	defer release()
+
+	err = service.PullChanges(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	deploymentService := deployment.NewDeploymentService(service.pr, service.monitor, service.appConfig)
 
-	deploymentService := deployment.NewDeploymentService(service.pr, service.monitor)
+	err = deploymentService.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	err = deploymentService.InstallDependencies(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = deploymentService.Build(ctx)
+	if err != nil {
+		return err
+	}
+
+	return deploymentService.Deploy(ctx)
+}
+
+func (service *PullRequestService) UnDeploy(ctx context.Context) error {
+
+	err := service.removeDir(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	deploymentService := deployment.NewDeploymentService(service.pr, service.monitor, service.appConfig)
+
+	return deploymentService.UnDeploy(ctx)
+}
+
+// Sleep stops the preview of the PR until it is requested again, see deployment.DeploymentService.Sleep
+func (service *PullRequestService) Sleep(ctx context.Context) error {
+	deploymentService := deployment.NewDeploymentService(service.pr, service.monitor, service.appConfig)
+
+	return deploymentService.Sleep(ctx)
+}
+
+// Wake starts the preview of a sleeping PR again
+func (service *PullRequestService) Wake(ctx context.Context) error {
+	deploymentService := deployment.NewDeploymentService(service.pr, service.monitor, service.appConfig)
+
+	return deploymentService.Wake(ctx)
+}
 
-	return deploymentService.UnDeploy()
+// RunAction runs an action imbere queued on its own or that was asked with a command, see constants.INTERNAL_ACTION_*
+// argument is what the action is about, ie. the commit to roll back to
+func (service *PullRequestService) RunAction(ctx context.Context, action string, argument string) error {
+	switch action {
+	case constants.INTERNAL_ACTION_ROLLBACK:
+		_, err := service.Rollback(ctx, argument, constants.INTERNAL_EVENT+"."+action)
+		return err
+	case constants.INTERNAL_ACTION_WAKE:
+		return service.Wake(ctx)
+	case constants.INTERNAL_ACTION_SLEEP:
+		return service.Sleep(ctx)
+	default:
+		return fmt.Errorf("unknown action %q on PR ID: %s", action, service.pr.GetPrId())
+	}
 }
 
-func (service *PullRequestService) UpdateLabelToDeploy(isLabelPresent bool) error {
+func (service *PullRequestService) UpdateLabelToDeploy(ctx context.Context, isLabelPresent bool) error {
 	service.pr.LabeledToDeploy = isLabelPresent
 
 	log.Printf("Updating label to deploy %v", isLabelPresent)
 
-	if isLabelPresent && !service.pr.Deployed {
-		service.Deploy()
+	if isLabelPresent {
+		service.approveHead()
+	}
+
+	// a fork labeled again after new pushes gets its approved commit deployed
+	isApprovedPush := service.pr.IsFork && service.pr.DeployedSHA != service.pr.HeadSHA
+
+	if isLabelPresent && (!service.pr.Deployed || isApprovedPush) {
+		service.Deploy(ctx, "pull_request.labeled")
 	}
 
 	return service.save()
 }
 
-func HandlePR(event Event, payload map[string]interface{}) error {
+// HandlePR acts on an event of a PR, newClient gives the client reporting on github for the installation the PR belongs to
+func HandlePR(ctx context.Context, appConfig *config.Config, newClient client.Factory, builds *scheduler.Scheduler, event Event, payload map[string]interface{}) error {
+	if event.GetName() == "issue_comment" {
+		return handleCommand(ctx, appConfig, newClient, builds, event, payload)
+	}
 
 	PR, err := CreateOrAssociatePullRequestFromPayload(event, payload)
 
@@ -226,23 +599,77 @@ func HandlePR(event Event, payload map[string]interface{}) error {
 		// utils.ReturnError(c, err.Error())
 	}
 
+	settingsRepo := db.RepositorySettingsRepo{}
+	settings, err := settingsRepo.Get(PR.OwnerName, PR.RepoName)
+
+	if err != nil {
+		return err
+	}
+
 	nameAction := event.GetNameAction()
 	isPullRequestOpenedOrReopened := nameAction == "pull_request.opened" || nameAction == "pull_request.reopened"
+	isNewPush := IsNewPush(event, payload)
 	isWorkflowRunCompleted := nameAction == "workflow_run.completed"
-	shouldDeploy := isWorkflowRunCompleted && PR.LabeledToDeploy
+	// repositories either deploy every push, or wait for the workflow to succeed on it
+	shouldDeployOnPush := isNewPush && PR.LabeledToDeploy && settings.DeployOnPush
+	shouldDeployOnWorkflow := isWorkflowRunCompleted && PR.LabeledToDeploy && !settings.DeployOnPush
 	isPullRequestClosed := nameAction == "pull_request.closed"
 	isPullRequestLabeled := nameAction == "pull_request.labeled"
 	isPullRequestUnlabeled := nameAction == "pull_request.unlabeled"
-	processMonitor := process_monitor.NewProcessMonitor(PR)
 
-	prService := NewPullRequestService(PR, processMonitor)
+	if isNewPush {
+		// the workflow has to run again on the new commits
+		PR.WorkflowSucceeded = false
+	}
+
+	if isWorkflowRunCompleted {
+		runSha, err := ExtractHeadSHA(event, payload)
+		if err != nil {
+			return err
+		}
+
+		// the workflow ran on a commit that was since replaced by a newer push, its own workflow run will deploy it
+		if runSha != PR.HeadSHA {
+			log.Printf("Workflow ran on %s but PR ID: %s is now at %s, skipping...", runSha, PR.GetPrId(), PR.HeadSHA)
+			return nil
+		}
+
+		conclusion, err := ExtractWorkflowConclusion(event, payload)
+		if err != nil {
+			return err
+		}
+
+		PR.WorkflowSucceeded = conclusion == "success"
+
+		if !PR.WorkflowSucceeded || !shouldDeployOnWorkflow {
+			if !PR.WorkflowSucceeded {
+				log.Printf("Workflow on %s of PR ID: %s concluded with %s, not deploying it", runSha, PR.GetPrId(), conclusion)
+			}
+
+			prRepo := db.PullRequestRepo{}
+			return prRepo.Save(PR)
+		}
+	}
+
+	githubClient, err := newClient(PR.InstallationID)
+	if err != nil {
+		return err
+	}
+
+	processMonitor := process_monitor.NewProcessMonitor(PR, githubClient, appConfig)
+	defer processMonitor.Close()
+
+	prService := NewPullRequestService(PR, processMonitor, githubClient, appConfig, builds)
 
 	if isPullRequestOpenedOrReopened {
 		return prService.MarkActive()
-	} else if shouldDeploy {
-		return prService.Deploy()
+	} else if shouldDeployOnPush || shouldDeployOnWorkflow {
+		return prService.Deploy(ctx, nameAction)
+	} else if isNewPush {
+		// keep track of the new head, so that workflow runs of older commits are not deployed
+		return prService.save()
 	} else if isPullRequestClosed {
-		return prService.UnDeploy()
+		return prService.Close(ctx)
 	} else if isPullRequestLabeled || isPullRequestUnlabeled {
 		labelName, err := extractLabelName(event, payload)
 		if err != nil {
@@ -251,9 +678,9 @@ func HandlePR(event Event, payload map[string]interface{}) error {
 
 		if labelName == constants.DEPLOYMENT_LABEL {
 			if isPullRequestLabeled {
-				return prService.UpdateLabelToDeploy(true)
+				return prService.UpdateLabelToDeploy(ctx, true)
 			} else if isPullRequestUnlabeled {
-				return prService.UpdateLabelToDeploy(false)
+				return prService.UpdateLabelToDeploy(ctx, false)
 			}
 		}
 
@@ -262,6 +689,49 @@ func HandlePR(event Event, payload map[string]interface{}) error {
 	return nil
 }
 
+// runAction runs an action on a PR that is already known, there is no payload to update it from
+func runAction(ctx context.Context, appConfig *config.Config, newClient client.Factory, builds *scheduler.Scheduler, prId int64, action string, argument string) error {
+	prRepo := db.PullRequestRepo{}
+
+	PR, err := prRepo.GetByPrID(prId)
+	if err != nil {
+		return err
+	}
+
+	if PR == nil {
+		return fmt.Errorf("PR ID: %d is not known", prId)
+	}
+
+	githubClient, err := newClient(PR.InstallationID)
+	if err != nil {
+		return err
+	}
+
+	processMonitor := process_monitor.NewProcessMonitor(PR, githubClient, appConfig)
+	defer processMonitor.Close()
+
+	return NewPullRequestService(PR, processMonitor, githubClient, appConfig, builds).RunAction(ctx, action, argument)
+}
+
+// NewJobHandler gives the handler of the events that were queued by the webhook, see job_queue.
+// The deployments of every job share builds, so that the host is not overloaded by many PRs built at once.
+func NewJobHandler(appConfig *config.Config, newClient client.Factory, builds *scheduler.Scheduler) func(ctx context.Context, job *db.Job) error {
+	return func(ctx context.Context, job *db.Job) error {
+		if job.EventName == constants.INTERNAL_EVENT {
+			// the payload of the actions imbere queues is their argument, see job_queue.JobQueue.EnqueueActionWith
+			return runAction(ctx, appConfig, newClient, builds, job.PrID, job.EventAction, job.Payload)
+		}
+
+		var payload map[string]interface{}
+
+		if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+			return fmt.Errorf("could not parse payload of job %d: %v", job.ID, err)
+		}
+
+		return HandlePR(ctx, appConfig, newClient, builds, NewEvent(job.EventName, job.EventAction), payload)
+	}
+}
+
 func CommunicateProgress(status string) error {
 	logger := log.Default()
 	logger.Println(status)
@@ -0,0 +1,132 @@
+package pull_request
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/rssb/imbere/pkg/config"
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+	"github.com/rssb/imbere/pkg/github_fake"
+	"github.com/rssb/imbere/pkg/scheduler"
+)
+
+// newForkPR gives a PR from a fork, in a repository of its own with the given fork policy ("" keeps the default)
+func newForkPR(t *testing.T, policy string) *db.PullRequest {
+	t.Helper()
+
+	pr := newTestPR()
+	pr.RepoName = fmt.Sprintf("app-%d", pr.PrID)
+	pr.IsFork = true
+	pr.HeadSHA = "aaa111"
+
+	if policy != "" {
+		settingsRepo := db.RepositorySettingsRepo{}
+		if err := settingsRepo.Save(&db.RepositorySettings{OwnerName: pr.OwnerName, RepoName: pr.RepoName, ForkPolicy: policy}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return pr
+}
+
+func TestForkRestriction(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		fork        bool
+		approvedSHA string
+		allowed     bool
+	}{
+		{name: "not a fork", policy: constants.FORK_POLICY_NEVER, allowed: true},
+		{name: "never by default", fork: true, approvedSHA: "aaa111"},
+		{name: "never", policy: constants.FORK_POLICY_NEVER, fork: true, approvedSHA: "aaa111"},
+		{name: "label without approval", policy: constants.FORK_POLICY_LABEL, fork: true},
+		{name: "label with the head approved", policy: constants.FORK_POLICY_LABEL, fork: true, approvedSHA: "aaa111", allowed: true},
+		{name: "label with an older commit approved", policy: constants.FORK_POLICY_LABEL, fork: true, approvedSHA: "000000", allowed: false},
+		{name: "sandbox", policy: constants.FORK_POLICY_SANDBOX, fork: true, allowed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pr := newForkPR(t, test.policy)
+			pr.IsFork = test.fork
+			pr.ApprovedSHA = test.approvedSHA
+
+			restriction, err := newTestService(t, pr).forkRestriction()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if allowed := restriction == ""; allowed != test.allowed {
+				t.Errorf("forkRestriction() = %q, want the PR allowed: %v", restriction, test.allowed)
+			}
+		})
+	}
+}
+
+func TestApprovalIsResetByANewPush(t *testing.T) {
+	pr := newForkPR(t, constants.FORK_POLICY_LABEL)
+	pr.ApprovedSHA = pr.HeadSHA
+
+	prRepo := db.PullRequestRepo{}
+	if err := prRepo.Save(pr); err != nil {
+		t.Fatal(err)
+	}
+
+	pushed := *pr
+	pushed.HeadSHA = "bbb222"
+
+	updated, err := CreateOrAssociatePullRequestFromPayload(NewEvent("pull_request", "synchronize"), pullRequestPayload(&pushed, "synchronize", "someone/"+pr.RepoName, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := newTestService(t, updated)
+
+	if restriction, err := service.forkRestriction(); err != nil || restriction == "" {
+		t.Errorf("forkRestriction() after a push = %q, %v, want the new commit to need an approval", restriction, err)
+	}
+
+	service.approveHead()
+
+	if restriction, err := service.forkRestriction(); err != nil || restriction != "" {
+		t.Errorf("forkRestriction() once approved again = %q, %v, want the PR allowed", restriction, err)
+	}
+}
+
+func TestOtherLabelsAreIgnored(t *testing.T) {
+	for _, label := range []string{"bug", strings.ToLower(constants.DEPLOYMENT_LABEL), constants.DEPLOYMENT_LABEL + "_LATER"} {
+		t.Run(label, func(t *testing.T) {
+			fake := github_fake.NewServer()
+			defer fake.Close()
+
+			pr := newForkPR(t, constants.FORK_POLICY_LABEL)
+
+			prRepo := db.PullRequestRepo{}
+			if err := prRepo.Save(pr); err != nil {
+				t.Fatal(err)
+			}
+
+			payload := pullRequestPayload(pr, "labeled", "someone/"+pr.RepoName, label)
+			if err := HandlePR(context.Background(), &config.Config{BuildDir: t.TempDir()}, fake.Factory(), scheduler.New(config.ConcurrencyConfig{}), NewEvent("pull_request", "labeled"), payload); err != nil {
+				t.Fatal(err)
+			}
+
+			saved, err := prRepo.GetByPrID(pr.PrID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if saved.LabeledToDeploy || saved.ApprovedSHA != "" || saved.Attempts != 0 {
+				t.Errorf("the label marked the PR labeled to deploy: %v, approved %q, %d attempts", saved.LabeledToDeploy, saved.ApprovedSHA, saved.Attempts)
+			}
+
+			if len(fake.Comments()) > 0 || len(fake.Deployments()) > 0 || len(fake.CheckRuns()) > 0 {
+				t.Errorf("the label reported a deployment on github: %v comments, %v deployments, %v check runs", fake.Comments(), fake.Deployments(), fake.CheckRuns())
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package pull_request
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+	"github.com/rssb/imbere/pkg/deployment"
+)
+
+// slots gives the directories of the builds of the PR by slot (see db.PullRequest.GetSlotDir), oldest first
+func (service *PullRequestService) slots() ([]int64, map[int64]string) {
+	dirs := map[int64]string{}
+
+	legacyDir := filepath.Join(service.appConfig.BuildDir, service.pr.GetSlotDir(0))
+	if _, err := os.Stat(legacyDir); err == nil {
+		dirs[0] = legacyDir
+	}
+
+	prefix := filepath.Base(legacyDir) + "@"
+	entries, _ := os.ReadDir(filepath.Dir(legacyDir))
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+
+		slot, err := strconv.ParseInt(strings.TrimPrefix(entry.Name(), prefix), 10, 64)
+		if err != nil {
+			continue // the directory of another PR whose branch has an @ in its name
+		}
+
+		dirs[slot] = filepath.Join(filepath.Dir(legacyDir), entry.Name())
+	}
+
+	slots := []int64{}
+	for slot := range dirs {
+		slots = append(slots, slot)
+	}
+
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+
+	return slots, dirs
+}
+
+// keptSlots gives the builds that are neither recycled nor removed, the one the preview runs
+// and the ones of the latest successful attempts it can be rolled back to, at most count of them
+func (service *PullRequestService) keptSlots(count int) (map[int64]bool, error) {
+	kept := map[int64]bool{}
+
+	if service.pr.Deployed {
+		kept[service.pr.DeployedSlot] = true
+	}
+
+	deploymentRepo := db.DeploymentRepo{}
+
+	deployments, err := deploymentRepo.ListSucceeded(service.pr.PrID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, deployment := range deployments {
+		if len(kept) >= count {
+			break
+		}
+
+		kept[deployment.GetSlot()] = true
+	}
+
+	return kept, nil
+}
+
+// reusableSlot gives the directory of the latest build that is not kept, it is recycled for the next one
+// (room is made for it among the constants.KEPT_BUILDS builds)
+func (service *PullRequestService) reusableSlot() string {
+	kept, err := service.keptSlots(constants.KEPT_BUILDS - 1)
+	if err != nil {
+		service.log(fmt.Sprintf("Failed to list the kept builds: %s", err.Error()))
+		return ""
+	}
+
+	slots, dirs := service.slots()
+
+	for i := len(slots) - 1; i >= 0; i-- {
+		if !kept[slots[i]] {
+			return dirs[slots[i]]
+		}
+	}
+
+	return ""
+}
+
+// pruneSlots removes the builds that are not kept, see keptSlots
+func (service *PullRequestService) pruneSlots(ctx context.Context) {
+	kept, err := service.keptSlots(constants.KEPT_BUILDS)
+	if err != nil {
+		service.log(fmt.Sprintf("Failed to list the kept builds: %s", err.Error()))
+		return
+	}
+
+	slots, dirs := service.slots()
+
+	for _, slot := range slots {
+		if kept[slot] {
+			continue
+		}
+
+		if err := service.removeSlot(ctx, slot, dirs[slot]); err != nil {
+			service.log(fmt.Sprintf("Failed to remove old build %s: %s", dirs[slot], err.Error()))
+		}
+	}
+}
+
+// removeSlot removes a build of the PR with what its runtime kept of it (ie. the docker image of the slot)
+func (service *PullRequestService) removeSlot(ctx context.Context, slot int64, dir string) error {
+	if err := service.mirror().RemoveWorktree(ctx, dir); err != nil {
+		return err
+	}
+
+	return deployment.RemoveImage(ctx, service.monitor, service.pr.GetAppName(slot))
+}
+
+// rollbackTarget gives the successful deployment whose build is rolled back to: the latest one of a commit starting with sha,
+// or without sha the latest one of another commit than the one the preview runs
+func (service *PullRequestService) rollbackTarget(sha string) (*db.Deployment, error) {
+	deploymentRepo := db.DeploymentRepo{}
+
+	deployments, err := deploymentRepo.ListSucceeded(service.pr.PrID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, dirs := service.slots()
+
+	for i := range deployments {
+		deployment := &deployments[i]
+
+		if dirs[deployment.GetSlot()] == "" || service.isLive(deployment.GetSlot()) {
+			continue // its build was removed, or the preview already runs it
+		}
+
+		if sha == "" && deployment.HeadSHA != service.pr.DeployedSHA || sha != "" && strings.HasPrefix(deployment.HeadSHA, sha) {
+			return deployment, nil
+		}
+	}
+
+	if sha == "" {
+		return nil, errors.New("no previous successful build of another commit is kept")
+	}
+
+	return nil, fmt.Errorf("no successful build of %s is kept, only the last %d builds can be rolled back to", sha, constants.KEPT_BUILDS)
+}
+
+// isLive tells if the preview runs the build of the slot
+func (service *PullRequestService) isLive(slot int64) bool {
+	return service.pr.Deployed && service.pr.DeployedSlot == slot
+}
@@ -0,0 +1,376 @@
+package pull_request
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rssb/imbere/pkg/constants"
+)
+
+type testDeployment struct {
+	attempt int64
+	slot    int64
+	sha     string
+	outcome constants.ProcessOutcome
+}
+
+func TestReusableSlot(t *testing.T) {
+	tests := []struct {
+		name        string
+		builds      []int64
+		deployed    bool
+		live        int64
+		deployments []testDeployment
+		want        int64 // -1 when no build is reused
+	}{
+		{
+			name: "no build yet",
+			want: -1,
+		},
+		{
+			name:   "undeployed PR reuses its latest build",
+			builds: []int64{1, 2},
+			want:   2,
+		},
+		{
+			name:     "the live build and the previous success are kept",
+			builds:   []int64{1, 2, 3},
+			deployed: true,
+			live:     3,
+			deployments: []testDeployment{
+				{1, 1, "a", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{2, 2, "b", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{3, 3, "c", constants.PROCESS_OUTCOME_SUCCEEDED},
+			},
+			want: 1,
+		},
+		{
+			name:     "failed builds are reused first",
+			builds:   []int64{1, 2, 3},
+			deployed: true,
+			live:     1,
+			deployments: []testDeployment{
+				{1, 1, "a", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{2, 2, "b", constants.PROCESS_OUTCOME_FAILED},
+				{3, 3, "c", constants.PROCESS_OUTCOME_TIMED_OUT},
+			},
+			want: 3,
+		},
+		{
+			name:     "every build is kept",
+			builds:   []int64{1, 2},
+			deployed: true,
+			live:     2,
+			deployments: []testDeployment{
+				{1, 1, "a", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{2, 2, "b", constants.PROCESS_OUTCOME_SUCCEEDED},
+			},
+			want: -1,
+		},
+		{
+			name:     "build deployed before slots existed",
+			builds:   []int64{0, 1},
+			deployed: true,
+			live:     0,
+			want:     1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pr := newTestPR()
+			pr.Deployed = test.deployed
+			pr.DeployedSlot = test.live
+
+			service := newTestService(t, pr)
+			addBuilds(t, service, test.builds...)
+
+			for _, deployment := range test.deployments {
+				addDeployment(t, pr, deployment.attempt, deployment.slot, deployment.sha, deployment.outcome)
+			}
+
+			want := ""
+			if test.want >= 0 {
+				want = filepath.Join(service.appConfig.BuildDir, pr.GetSlotDir(test.want))
+			}
+
+			if got := service.reusableSlot(); got != want {
+				t.Errorf("reusableSlot() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestPruneSlots(t *testing.T) {
+	pr := newTestPR()
+	pr.Deployed = true
+	pr.DeployedSlot = 4
+
+	service := newTestService(t, pr)
+	addBuilds(t, service, 1, 2, 3, 4, 5)
+
+	addDeployment(t, pr, 1, 1, "a", constants.PROCESS_OUTCOME_SUCCEEDED)
+	addDeployment(t, pr, 2, 2, "b", constants.PROCESS_OUTCOME_SUCCEEDED)
+	addDeployment(t, pr, 3, 3, "c", constants.PROCESS_OUTCOME_SUCCEEDED)
+	addDeployment(t, pr, 4, 4, "d", constants.PROCESS_OUTCOME_SUCCEEDED)
+	addDeployment(t, pr, 5, 5, "e", constants.PROCESS_OUTCOME_FAILED)
+
+	service.pruneSlots(context.Background())
+
+	slots, _ := service.slots()
+
+	// the live build and the latest successful ones, constants.KEPT_BUILDS of them
+	if want := []int64{2, 3, 4}; !reflect.DeepEqual(slots, want) {
+		t.Errorf("slots after pruning = %v, want %v", slots, want)
+	}
+}
+
+func TestSlotsIgnoresOtherPRs(t *testing.T) {
+	pr := newTestPR()
+	service := newTestService(t, pr)
+	addBuilds(t, service, 0, 2)
+
+	// the build of another PR whose branch starts like this one and has an @ in its name
+	other := *pr
+	other.BranchName = pr.BranchName + "_" + pr.GetPrNumber() + "@next"
+	if err := os.MkdirAll(filepath.Join(service.appConfig.BuildDir, other.GetSlotDir(1)), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	slots, dirs := service.slots()
+
+	if want := []int64{0, 2}; !reflect.DeepEqual(slots, want) {
+		t.Errorf("slots() = %v, want %v", slots, want)
+	}
+
+	if want := filepath.Join(service.appConfig.BuildDir, pr.GetSlotDir(2)); dirs[2] != want {
+		t.Errorf("dir of slot 2 = %q, want %q", dirs[2], want)
+	}
+}
+
+func TestIsLive(t *testing.T) {
+	tests := []struct {
+		name     string
+		deployed bool
+		live     int64
+		slot     int64
+		want     bool
+	}{
+		{"slot the preview runs", true, 2, 2, true},
+		{"another slot", true, 2, 1, false},
+		{"undeployed PR", false, 2, 2, false},
+		{"build deployed before slots existed", true, 0, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pr := newTestPR()
+			pr.Deployed = test.deployed
+			pr.DeployedSlot = test.live
+
+			service := newTestService(t, pr)
+
+			if got := service.isLive(test.slot); got != test.want {
+				t.Errorf("isLive(%d) = %v, want %v", test.slot, got, test.want)
+			}
+		})
+	}
+}
+
+func TestKeptSlots(t *testing.T) {
+	tests := []struct {
+		name        string
+		deployed    bool
+		live        int64
+		deployments []testDeployment
+		count       int
+		want        map[int64]bool
+	}{
+		{
+			name:  "nothing deployed",
+			count: constants.KEPT_BUILDS,
+			want:  map[int64]bool{},
+		},
+		{
+			name:     "the live build comes first",
+			deployed: true,
+			live:     1,
+			deployments: []testDeployment{
+				{1, 1, "a", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{2, 2, "b", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{3, 3, "c", constants.PROCESS_OUTCOME_SUCCEEDED},
+			},
+			count: 2,
+			want:  map[int64]bool{1: true, 3: true},
+		},
+		{
+			name:     "failed deployments are not kept",
+			deployed: true,
+			live:     2,
+			deployments: []testDeployment{
+				{1, 1, "a", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{2, 2, "b", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{3, 3, "c", constants.PROCESS_OUTCOME_FAILED},
+				{4, 4, "d", constants.PROCESS_OUTCOME_CANCELLED},
+			},
+			count: constants.KEPT_BUILDS,
+			want:  map[int64]bool{1: true, 2: true},
+		},
+		{
+			name:     "a rollback keeps the build it runs",
+			deployed: true,
+			live:     1,
+			deployments: []testDeployment{
+				{1, 1, "a", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{2, 2, "b", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{3, 1, "a", constants.PROCESS_OUTCOME_SUCCEEDED},
+			},
+			count: constants.KEPT_BUILDS,
+			want:  map[int64]bool{1: true, 2: true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pr := newTestPR()
+			pr.Deployed = test.deployed
+			pr.DeployedSlot = test.live
+
+			service := newTestService(t, pr)
+
+			for _, deployment := range test.deployments {
+				addDeployment(t, pr, deployment.attempt, deployment.slot, deployment.sha, deployment.outcome)
+			}
+
+			got, err := service.keptSlots(test.count)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("keptSlots(%d) = %v, want %v", test.count, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRollbackTarget(t *testing.T) {
+	tests := []struct {
+		name        string
+		builds      []int64
+		live        int64
+		liveSHA     string
+		deployments []testDeployment
+		sha         string
+		want        int64 // attempt rolled back to, 0 when the rollback is refused
+	}{
+		{
+			name:    "previous success by default",
+			builds:  []int64{1, 2, 3},
+			live:    3,
+			liveSHA: "ccc",
+			deployments: []testDeployment{
+				{1, 1, "aaa", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{2, 2, "bbb", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{3, 3, "ccc", constants.PROCESS_OUTCOME_SUCCEEDED},
+			},
+			want: 2,
+		},
+		{
+			name:    "default skips rebuilds of the live commit and failures",
+			builds:  []int64{1, 2, 3, 4},
+			live:    4,
+			liveSHA: "ccc",
+			deployments: []testDeployment{
+				{1, 1, "aaa", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{2, 2, "bbb", constants.PROCESS_OUTCOME_FAILED},
+				{3, 3, "ccc", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{4, 4, "ccc", constants.PROCESS_OUTCOME_SUCCEEDED},
+			},
+			want: 1,
+		},
+		{
+			name:    "explicit sha prefix",
+			builds:  []int64{1, 2, 3},
+			live:    3,
+			liveSHA: "ccc",
+			deployments: []testDeployment{
+				{1, 1, "abc123", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{2, 2, "bcd456", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{3, 3, "ccc", constants.PROCESS_OUTCOME_SUCCEEDED},
+			},
+			sha:  "abc",
+			want: 1,
+		},
+		{
+			name:    "explicit sha whose build was removed",
+			builds:  []int64{2, 3, 4},
+			live:    4,
+			liveSHA: "ddd",
+			deployments: []testDeployment{
+				{1, 1, "aaa", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{2, 2, "bbb", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{3, 3, "ccc", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{4, 4, "ddd", constants.PROCESS_OUTCOME_SUCCEEDED},
+			},
+			sha: "aaa",
+		},
+		{
+			name:    "explicit sha the preview already runs",
+			builds:  []int64{1, 2},
+			live:    2,
+			liveSHA: "bbb",
+			deployments: []testDeployment{
+				{1, 1, "aaa", constants.PROCESS_OUTCOME_SUCCEEDED},
+				{2, 2, "bbb", constants.PROCESS_OUTCOME_SUCCEEDED},
+			},
+			sha: "bbb",
+		},
+		{
+			name:    "no other successful build",
+			builds:  []int64{1, 2},
+			live:    2,
+			liveSHA: "bbb",
+			deployments: []testDeployment{
+				{1, 1, "aaa", constants.PROCESS_OUTCOME_FAILED},
+				{2, 2, "bbb", constants.PROCESS_OUTCOME_SUCCEEDED},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pr := newTestPR()
+			pr.Deployed = true
+			pr.DeployedSlot = test.live
+			pr.DeployedSHA = test.liveSHA
+
+			service := newTestService(t, pr)
+			addBuilds(t, service, test.builds...)
+
+			for _, deployment := range test.deployments {
+				addDeployment(t, pr, deployment.attempt, deployment.slot, deployment.sha, deployment.outcome)
+			}
+
+			target, err := service.rollbackTarget(test.sha)
+
+			if test.want == 0 {
+				if err == nil {
+					t.Fatalf("rollbackTarget(%q) = attempt %d, want an error", test.sha, target.Attempt)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("rollbackTarget(%q) failed: %s", test.sha, err)
+			}
+
+			if target.Attempt != test.want {
+				t.Errorf("rollbackTarget(%q) = attempt %d, want %d", test.sha, target.Attempt, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,401 @@
+package reconciler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rssb/imbere/pkg/client"
+	"github.com/rssb/imbere/pkg/config"
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+	"github.com/rssb/imbere/pkg/deployment"
+	"github.com/rssb/imbere/pkg/process_monitor"
+)
+
+// runtimes checked for apps imbere started
+var runtimes = []string{constants.DEPLOYER_PM2, constants.DEPLOYER_DOCKER, constants.DEPLOYER_PROCESS}
+
+// Queue keeps jobs from changing a PR while it is being reconciled (see job_queue.JobQueue.Reserve),
+// and runs the actions the reconciler decides on (see job_queue.JobQueue.EnqueueAction)
+type Queue interface {
+	Reserve(prId int64) (release func(), ok bool)
+	EnqueueAction(prId int64, action string) error
+}
+
+// Reconciler brings the state of the PRs in the database back in line with what really runs,
+// ie. after imbere crashed in the middle of a deployment or an app died.
+type Reconciler struct {
+	appConfig *config.Config
+	newClient client.Factory
+	queue     Queue
+	prRepo    *db.PullRequestRepo
+}
+
+func NewReconciler(appConfig *config.Config, newClient client.Factory, queue Queue) *Reconciler {
+	return &Reconciler{
+		appConfig: appConfig,
+		newClient: newClient,
+		queue:     queue,
+		prRepo:    &db.PullRequestRepo{},
+	}
+}
+
+// Start reconciles right away, then every constants.RECONCILE_INTERVAL_MINUTES
+func (reconciler *Reconciler) Start() {
+	reconciler.Reconcile(context.Background())
+
+	go func() {
+		ticker := time.NewTicker(constants.RECONCILE_INTERVAL_MINUTES * time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			reconciler.Reconcile(context.Background())
+		}
+	}()
+}
+
+// Reconcile runs every check, PRs that have a job running are left alone
+func (reconciler *Reconciler) Reconcile(ctx context.Context) {
+	log.Printf("reconciling deployments")
+
+	if err := reconciler.failInterrupted(); err != nil {
+		log.Printf("could not fail interrupted deployments: %s", err)
+	}
+
+	if err := reconciler.clearStaleDeploying(); err != nil {
+		log.Printf("could not clear stale deployments: %s", err)
+	}
+
+	if err := reconciler.checkDeployed(ctx); err != nil {
+		log.Printf("could not check deployed PRs: %s", err)
+	}
+
+	if err := reconciler.sleepIdle(); err != nil {
+		log.Printf("could not put idle previews to sleep: %s", err)
+	}
+
+	for _, kind := range runtimes {
+		if err := reconciler.stopOrphans(ctx, kind); err != nil {
+			log.Printf("could not look for orphaned apps on %s: %s", kind, err)
+		}
+	}
+}
+
+// clearStaleDeploying resets the PRs flagged as deploying without a job deploying them,
+// otherwise every later deployment of those PRs would be skipped.
+func (reconciler *Reconciler) clearStaleDeploying() error {
+	prs, err := reconciler.prRepo.GetDeploying()
+	if err != nil {
+		return err
+	}
+
+	for i := range prs {
+		pr := &prs[i]
+
+		release, ok := reconciler.queue.Reserve(pr.PrID)
+		if !ok {
+			continue
+		}
+
+		log.Printf("PR ID: %s was left deploying, resetting it", pr.GetPrId())
+
+		if err := reconciler.prRepo.ResetDeploying(pr.PrID); err != nil {
+			log.Printf("could not reset deploying status of PR ID: %s: %s", pr.GetPrId(), err)
+		}
+
+		release()
+	}
+
+	return nil
+}
+
+// failInterrupted finishes the deployments that were left ongoing (ie. imbere stopped in the middle of them)
+// so that their check run and comment do not stay in progress forever.
+func (reconciler *Reconciler) failInterrupted() error {
+	deploymentRepo := db.DeploymentRepo{}
+
+	deployments, err := deploymentRepo.GetOngoing()
+	if err != nil {
+		return err
+	}
+
+	for i := range deployments {
+		deployment := &deployments[i]
+
+		release, ok := reconciler.queue.Reserve(deployment.PrID)
+		if !ok {
+			continue
+		}
+
+		if err := reconciler.failDeployment(deployment); err != nil {
+			log.Printf("could not fail deployment %d of PR ID: %d: %s", deployment.ID, deployment.PrID, err)
+		}
+
+		release()
+	}
+
+	return nil
+}
+
+func (reconciler *Reconciler) failDeployment(deployment *db.Deployment) error {
+	pr, err := reconciler.prRepo.GetByPrID(deployment.PrID)
+	if err != nil {
+		return err
+	}
+
+	deploymentRepo := db.DeploymentRepo{}
+	reason := "interrupted before it finished"
+
+	log.Printf("attempt #%d of PR ID: %d was %s", deployment.Attempt, deployment.PrID, reason)
+
+	if pr != nil {
+		progress := constants.PROCESS_PROGRESS_STARTED
+		if len(deployment.Steps) > 0 {
+			progress = deployment.Steps[len(deployment.Steps)-1].Step
+		}
+
+		githubClient, err := reconciler.newClient(pr.InstallationID)
+		if err != nil {
+			log.Printf("could not report on PR ID: %s: %s", pr.GetPrId(), err)
+		} else {
+			monitor := process_monitor.NewProcessMonitor(pr, githubClient, reconciler.appConfig)
+			defer monitor.Close()
+
+			monitor.SetDeployment(deployment)
+			monitor.SetError("The deployment was " + reason + ", push a new commit or label the PR again to deploy it.")
+			monitor.UpdateProgress(progress, constants.PROCESS_OUTCOME_FAILED)
+		}
+	}
+
+	return deploymentRepo.Finish(deployment, constants.PROCESS_OUTCOME_FAILED, reason)
+}
+
+// checkDeployed marks the PRs whose app is no longer running as not deployed,
+// closed PRs that are still running are stopped.
+func (reconciler *Reconciler) checkDeployed(ctx context.Context) error {
+	prs, err := reconciler.prRepo.GetDeployed()
+	if err != nil {
+		return err
+	}
+
+	for i := range prs {
+		pr := &prs[i]
+
+		// a sleeping app is not expected to run, it is only un deployed once its PR is closed
+		if pr.Sleeping && !pr.Closed {
+			continue
+		}
+
+		release, ok := reconciler.queue.Reserve(pr.PrID)
+		if !ok {
+			continue
+		}
+
+		if err := reconciler.checkPR(ctx, pr); err != nil {
+			log.Printf("could not check PR ID: %s: %s", pr.GetPrId(), err)
+		}
+
+		release()
+	}
+
+	return nil
+}
+
+func (reconciler *Reconciler) checkPR(ctx context.Context, pr *db.PullRequest) error {
+	kind := deployedWith(pr)
+
+	deployer, err := deployment.NewDeployer(kind, logOutput{}, reconciler.appConfig.PM2Namespace)
+	if err != nil {
+		return err
+	}
+
+	if pr.Closed {
+		log.Printf("PR ID: %s is closed but still deployed on %s, stopping it", pr.GetPrId(), kind)
+
+		if !pr.Sleeping {
+			if err := deployer.Stop(ctx, pr.GetDeployedAppName()); err != nil {
+				return err
+			}
+		}
+
+		return reconciler.unDeploy(pr, constants.PROCESS_PROGRESS_UN_DEPLOYING, constants.PROCESS_OUTCOME_SUCCEEDED, "")
+	}
+
+	status, err := deployer.Status(ctx, pr.GetDeployedAppName())
+	if err != nil {
+		return err
+	}
+
+	if status == deployment.RUNTIME_STATUS_RUNNING {
+		return nil
+	}
+
+	log.Printf("PR ID: %s is deployed but %s reports it %s", pr.GetPrId(), kind, status)
+
+	message := fmt.Sprintf("The preview is no longer running on %s (%s), push a new commit or label the PR again to deploy it.", kind, status)
+
+	return reconciler.unDeploy(pr, constants.PROCESS_PROGRESS_DEPLOYING, constants.PROCESS_OUTCOME_FAILED, message)
+}
+
+// sleepIdle queues the PRs whose preview was not used for longer than the idle ttl of their repository to be put to sleep
+func (reconciler *Reconciler) sleepIdle() error {
+	prs, err := reconciler.prRepo.GetDeployed()
+	if err != nil {
+		return err
+	}
+
+	settingsRepo := db.RepositorySettingsRepo{}
+
+	for i := range prs {
+		pr := &prs[i]
+
+		if pr.Sleeping || pr.Closed || pr.IsDeploying {
+			continue
+		}
+
+		settings, err := settingsRepo.Get(pr.OwnerName, pr.RepoName)
+		if err != nil {
+			log.Printf("could not get settings of %s/%s: %s", pr.OwnerName, pr.RepoName, err)
+			continue
+		}
+
+		if settings.IdleTTLMinutes <= 0 {
+			continue
+		}
+
+		lastActiveAt := pr.UpdatedAt
+		if pr.LastActiveAt != nil {
+			lastActiveAt = *pr.LastActiveAt
+		}
+
+		if time.Since(lastActiveAt) < time.Duration(settings.IdleTTLMinutes)*time.Minute {
+			continue
+		}
+
+		log.Printf("PR ID: %s was idle since %s, putting it to sleep", pr.GetPrId(), lastActiveAt.Format(time.RFC3339))
+
+		if err := reconciler.queue.EnqueueAction(pr.PrID, constants.INTERNAL_ACTION_SLEEP); err != nil {
+			log.Printf("could not queue PR ID: %s to sleep: %s", pr.GetPrId(), err)
+		}
+	}
+
+	return nil
+}
+
+// stopOrphans stops the apps of a runtime that no PR should be running
+func (reconciler *Reconciler) stopOrphans(ctx context.Context, kind string) error {
+	deployer, err := deployment.NewDeployer(kind, logOutput{}, reconciler.appConfig.PM2Namespace)
+	if err != nil {
+		return err
+	}
+
+	names, err := deployer.List(ctx)
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil // the runtime is not installed, nothing can run on it
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		// apps are named <pr id>-<slot>, or <pr id> if they were deployed before slots existed
+		prId, err := strconv.ParseInt(strings.SplitN(name, "-", 2)[0], 10, 64)
+		if err != nil {
+			continue // not started by imbere
+		}
+
+		release, ok := reconciler.queue.Reserve(prId)
+		if !ok {
+			continue
+		}
+
+		pr, err := reconciler.prRepo.GetByPrID(prId)
+
+		if err != nil {
+			log.Printf("could not find PR ID: %d: %s", prId, err)
+		} else if isOrphan(pr, kind, name) {
+			log.Printf("%s is running on %s without a PR deployed there, stopping it", name, kind)
+
+			if err := deployer.Stop(ctx, name); err != nil {
+				log.Printf("could not stop %s on %s: %s", name, kind, err)
+			}
+		}
+
+		release()
+	}
+
+	return nil
+}
+
+// isOrphan tells if the app of the PR should not be running on the runtime under name
+func isOrphan(pr *db.PullRequest, kind string, name string) bool {
+	if pr == nil || pr.Closed {
+		return true
+	}
+
+	if pr.IsDeploying {
+		return false
+	}
+
+	// the app of a previous slot that was not stopped once the preview switched over
+	return !pr.Deployed || pr.Sleeping || deployedWith(pr) != kind || pr.GetDeployedAppName() != name
+}
+
+func (reconciler *Reconciler) unDeploy(pr *db.PullRequest, progress constants.ProcessProgress, status constants.ProcessOutcome, message string) error {
+	updated, err := reconciler.prRepo.UnDeploy(pr.PrID)
+	if err != nil {
+		return err
+	}
+
+	githubClient, err := reconciler.newClient(updated.InstallationID)
+	if err != nil {
+		log.Printf("could not report on PR ID: %s: %s", updated.GetPrId(), err)
+		return nil
+	}
+
+	// the comment says why the preview is gone, and it no longer shows as active on the PR
+	monitor := process_monitor.NewProcessMonitor(updated, githubClient, reconciler.appConfig)
+	defer monitor.Close()
+
+	monitor.SetError(message)
+	monitor.UpdateProgress(progress, status)
+	monitor.DeactivateEnvironment()
+
+	return nil
+}
+
+func deployedWith(pr *db.PullRequest) string {
+	if pr.Deployer == "" {
+		return constants.DEFAULT_DEPLOYER
+	}
+
+	return pr.Deployer
+}
+
+// logOutput prints what the runtimes do while reconciling, there is no deployment to attach it to
+type logOutput struct{}
+
+func (logOutput) AddLog(line string) {
+	log.Printf("reconciler: %s", line)
+}
+
+func (logOutput) ListenToCmd(cmd *exec.Cmd) {
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
+
+	for _, reader := range []io.Reader{stdout, stderr} {
+		go func(scanner *bufio.Scanner) {
+			for scanner.Scan() {
+				log.Printf("reconciler: %s", scanner.Text())
+			}
+		}(bufio.NewScanner(reader))
+	}
+}
@@ -0,0 +1,119 @@
+package reconciler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rssb/imbere/pkg/config"
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "imbere-reconciler-test-*")
+	if err != nil {
+		panic(err)
+	}
+
+	db.DbInit(filepath.Join(dir, "imbere.db"), nil)
+
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// fakeQueue records the actions the reconciler queues
+type fakeQueue struct {
+	mu      sync.Mutex
+	actions map[int64][]string
+}
+
+func (queue *fakeQueue) Reserve(prId int64) (release func(), ok bool) {
+	return func() {}, true
+}
+
+func (queue *fakeQueue) EnqueueAction(prId int64, action string) error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	queue.actions[prId] = append(queue.actions[prId], action)
+
+	return nil
+}
+
+func TestSleepIdle(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttl        int // idle ttl of the repository in minutes
+		idle       time.Duration
+		neverUsed  bool // the preview was deployed just now and not visited since
+		sleeping   bool
+		closed     bool
+		deploying  bool
+		wantAsleep bool
+	}{
+		{name: "idle for longer than the ttl", ttl: 30, idle: time.Hour, wantAsleep: true},
+		{name: "used within the ttl", ttl: 30, idle: 10 * time.Minute},
+		{name: "ttl of another repository", ttl: 120, idle: time.Hour},
+		{name: "repository without ttl", ttl: 0, idle: 24 * time.Hour},
+		{name: "just deployed", ttl: 30, neverUsed: true},
+		{name: "already sleeping", ttl: 30, idle: time.Hour, sleeping: true},
+		{name: "closed", ttl: 30, idle: time.Hour, closed: true},
+		{name: "being deployed", ttl: 30, idle: time.Hour, deploying: true},
+	}
+
+	prRepo := db.PullRequestRepo{}
+	settingsRepo := db.RepositorySettingsRepo{}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// every PR is in its own repository, with its own ttl
+			pr := &db.PullRequest{
+				PrID:        int64(2000 + i),
+				PrNumber:    int64(i + 1),
+				BranchName:  "feature",
+				RepoName:    fmt.Sprintf("app-%d", i),
+				OwnerName:   "rssb",
+				Deployed:    true,
+				Sleeping:    test.sleeping,
+				Closed:      test.closed,
+				IsDeploying: test.deploying,
+			}
+
+			if !test.neverUsed {
+				lastActiveAt := time.Now().Add(-test.idle)
+				pr.LastActiveAt = &lastActiveAt
+			}
+
+			if err := prRepo.Save(pr); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := settingsRepo.Save(&db.RepositorySettings{OwnerName: pr.OwnerName, RepoName: pr.RepoName, IdleTTLMinutes: test.ttl}); err != nil {
+				t.Fatal(err)
+			}
+
+			queue := &fakeQueue{actions: map[int64][]string{}}
+			reconciler := NewReconciler(&config.Config{}, nil, queue)
+
+			if err := reconciler.sleepIdle(); err != nil {
+				t.Fatal(err)
+			}
+
+			var want []string
+			if test.wantAsleep {
+				want = []string{constants.INTERNAL_ACTION_SLEEP}
+			}
+
+			if got := queue.actions[pr.PrID]; !reflect.DeepEqual(got, want) {
+				t.Errorf("queued actions = %v, want %v", got, want)
+			}
+		})
+	}
+}
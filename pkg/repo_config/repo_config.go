@@ -0,0 +1,284 @@
+package repo_config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Name of the file, at the root of the repository, describing how it is deployed
+const FILE_NAME = ".imbere.yml"
+
+// What repositories without FILE_NAME get, this is what imbere always did for node projects (using @antfu/ni)
+const (
+	DEFAULT_INSTALL    = "ni"
+	DEFAULT_BUILD      = "nr build"
+	DEFAULT_START      = "nr start"
+	DEFAULT_PORT_ENV   = "PORT"
+	DEFAULT_DOCKERFILE = "Dockerfile"
+)
+
+// Defaults of the health check, an app gets about a minute to become ready
+const (
+	DEFAULT_HEALTH_CHECK_STATUS   = 200
+	DEFAULT_HEALTH_CHECK_TIMEOUT  = 5  // seconds
+	DEFAULT_HEALTH_CHECK_INTERVAL = 2  // seconds
+	DEFAULT_HEALTH_CHECK_RETRIES  = 30 // probes
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// HealthCheck tells when a deployed app is ready, it is probed until it succeeds or the retries run out.
+// Without path nor command the app is ready once its port accepts connections.
+type HealthCheck struct {
+	Path           string `yaml:"path"`            // path requested on the app to know it is up, ie. /health
+	ExpectedStatus int    `yaml:"expected_status"` // status the path must answer with
+	Command        string `yaml:"command"`         // exits with 0 once the app is up, it runs in the working directory with PORT set
+	Timeout        int    `yaml:"timeout"`         // seconds a probe gets
+	Interval       int    `yaml:"interval"`        // seconds between two probes
+	Retries        int    `yaml:"retries"`         // probes that may fail before the deployment does
+}
+
+// RepoConfig is the pipeline of a repository as declared in its FILE_NAME
+//
+//	install: npm ci
+//	build: npm run build
+//	start: npm run start
+//	working_directory: apps/web
+//	port_env: PORT
+//	required_env:
+//	  - DATABASE_URL
+//	env:
+//	  NODE_ENV: production
+//	health_check:
+//	  path: /health
+//	  expected_status: 200
+//	  timeout: 5
+//	  interval: 2
+//	  retries: 30
+//	dockerfile: Dockerfile
+//
+// Install and build can be set to an empty string to skip them.
+type RepoConfig struct {
+	Install          *string           `yaml:"install"`
+	Build            *string           `yaml:"build"`
+	Start            string            `yaml:"start"`
+	WorkingDirectory string            `yaml:"working_directory"` // relative to the root of the repository
+	RequiredEnv      []string          `yaml:"required_env"`      // variables that must be set on the imbere host, they are passed to the app
+	Env              map[string]string `yaml:"env"`
+	HealthCheck      HealthCheck       `yaml:"health_check"`
+	PortEnv          string            `yaml:"port_env"`   // variable the app reads its port from
+	Dockerfile       string            `yaml:"dockerfile"` // relative to the working directory, used by the docker deployer
+}
+
+// Default is the pipeline used for repositories without FILE_NAME
+func Default() *RepoConfig {
+	config := &RepoConfig{}
+	config.applyDefaults()
+
+	return config
+}
+
+// Load reads FILE_NAME from the given directory, falling back to the defaults if the repository does not have one.
+// The returned error lists everything that is wrong with the file, so it can be shown as is on the PR.
+func Load(dir string) (*RepoConfig, error) {
+	content, err := os.ReadFile(filepath.Join(dir, FILE_NAME))
+
+	if errors.Is(err, os.ErrNotExist) {
+		return Default(), nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", FILE_NAME, err)
+	}
+
+	config := &RepoConfig{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("could not parse %s: %v", FILE_NAME, err)
+	}
+
+	config.applyDefaults()
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (config *RepoConfig) applyDefaults() {
+	if config.Install == nil {
+		install := DEFAULT_INSTALL
+		config.Install = &install
+	}
+
+	if config.Build == nil {
+		build := DEFAULT_BUILD
+		config.Build = &build
+	}
+
+	if config.Start == "" {
+		config.Start = DEFAULT_START
+	}
+
+	if config.PortEnv == "" {
+		config.PortEnv = DEFAULT_PORT_ENV
+	}
+
+	if config.Dockerfile == "" {
+		config.Dockerfile = DEFAULT_DOCKERFILE
+	}
+
+	if config.HealthCheck.ExpectedStatus == 0 {
+		config.HealthCheck.ExpectedStatus = DEFAULT_HEALTH_CHECK_STATUS
+	}
+
+	if config.HealthCheck.Timeout == 0 {
+		config.HealthCheck.Timeout = DEFAULT_HEALTH_CHECK_TIMEOUT
+	}
+
+	if config.HealthCheck.Interval == 0 {
+		config.HealthCheck.Interval = DEFAULT_HEALTH_CHECK_INTERVAL
+	}
+
+	if config.HealthCheck.Retries == 0 {
+		config.HealthCheck.Retries = DEFAULT_HEALTH_CHECK_RETRIES
+	}
+}
+
+// Validate checks the configuration, and that the required environment variables are available.
+func (config *RepoConfig) Validate() error {
+	problems := []string{}
+
+	if config.WorkingDirectory != "" && !isInside(config.WorkingDirectory) {
+		problems = append(problems, fmt.Sprintf("working_directory %q must be a path inside the repository", config.WorkingDirectory))
+	}
+
+	if !isInside(config.Dockerfile) {
+		problems = append(problems, fmt.Sprintf("dockerfile %q must be a path inside the repository", config.Dockerfile))
+	}
+
+	if !envNamePattern.MatchString(config.PortEnv) {
+		problems = append(problems, fmt.Sprintf("port_env %q is not a valid environment variable name", config.PortEnv))
+	}
+
+	for _, name := range config.RequiredEnv {
+		if !envNamePattern.MatchString(name) {
+			problems = append(problems, fmt.Sprintf("required_env %q is not a valid environment variable name", name))
+		} else if strings.HasPrefix(name, imbereEnvPrefix) {
+			problems = append(problems, fmt.Sprintf("required_env %q is a setting of imbere, it is not given to apps", name))
+		} else if _, ok := os.LookupEnv(name); !ok {
+			problems = append(problems, fmt.Sprintf("required_env %q is not set on the imbere host", name))
+		}
+	}
+
+	for name := range config.Env {
+		if !envNamePattern.MatchString(name) {
+			problems = append(problems, fmt.Sprintf("env %q is not a valid environment variable name", name))
+		}
+	}
+
+	if config.HealthCheck.Path != "" && !strings.HasPrefix(config.HealthCheck.Path, "/") {
+		problems = append(problems, fmt.Sprintf("health_check.path %q must start with /", config.HealthCheck.Path))
+	}
+
+	if config.HealthCheck.Path != "" && config.HealthCheck.Command != "" {
+		problems = append(problems, "health_check can have a path or a command, not both")
+	}
+
+	if config.HealthCheck.ExpectedStatus < 100 || config.HealthCheck.ExpectedStatus > 599 {
+		problems = append(problems, fmt.Sprintf("health_check.expected_status %d is not an http status", config.HealthCheck.ExpectedStatus))
+	}
+
+	if config.HealthCheck.Timeout < 0 || config.HealthCheck.Interval < 0 || config.HealthCheck.Retries < 0 {
+		problems = append(problems, "health_check.timeout, interval and retries must be positive")
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("invalid %s:\n- %s", FILE_NAME, strings.Join(problems, "\n- "))
+}
+
+// variables of the imbere host the code of PRs gets whatever it asks for, what a shell needs to find its tools.
+// The others (ie. the secrets of imbere, IMBERE_*) are only passed when listed in required_env.
+var hostEnv = []string{"PATH", "HOME", "USER", "LOGNAME", "SHELL", "TMPDIR", "TZ", "TERM", "LANG", "LANGUAGE"}
+
+// prefix of the variables imbere is configured with, they are never given to the code of PRs
+const imbereEnvPrefix = "IMBERE_"
+
+// HostEnv gives the variables of the imbere host any command running the code of a PR can see:
+// the ones of hostEnv and the locale (LC_*).
+func HostEnv() []string {
+	environ := []string{}
+
+	for _, variable := range os.Environ() {
+		name, _, _ := strings.Cut(variable, "=")
+
+		if slices.Contains(hostEnv, name) || strings.HasPrefix(name, "LC_") {
+			environ = append(environ, variable)
+		}
+	}
+
+	return environ
+}
+
+// Environ gives the environment of the pipeline commands, what the host gives every command (see HostEnv)
+// plus required_env, the variables declared in env and the port the app should listen on.
+func (config *RepoConfig) Environ(port int32) []string {
+	return append(HostEnv(), config.AppEnv(port)...)
+}
+
+// AppEnv gives only the variables the repository asked for (required_env and env) and the port,
+// for runtimes that do not inherit the environment of imbere (ie. docker).
+func (config *RepoConfig) AppEnv(port int32) []string {
+	environ := []string{}
+
+	for _, name := range config.RequiredEnv {
+		environ = append(environ, name+"="+os.Getenv(name))
+	}
+
+	for name, value := range config.Env {
+		environ = append(environ, name+"="+value)
+	}
+
+	if port != 0 {
+		environ = append(environ, fmt.Sprintf("%s=%d", config.PortEnv, port))
+	}
+
+	return environ
+}
+
+// SandboxEnv gives the variables declared in env and the port, without required_env,
+// for code that must not see the variables of the imbere host (ie. PRs from forks).
+func (config *RepoConfig) SandboxEnv(port int32) []string {
+	environ := []string{}
+
+	for name, value := range config.Env {
+		environ = append(environ, name+"="+value)
+	}
+
+	if port != 0 {
+		environ = append(environ, fmt.Sprintf("%s=%d", config.PortEnv, port))
+	}
+
+	return environ
+}
+
+// isInside tells if the relative path stays inside the repository
+func isInside(path string) bool {
+	cleaned := filepath.Clean(path)
+
+	return !filepath.IsAbs(cleaned) && cleaned != ".." && !strings.HasPrefix(cleaned, "../")
+}
@@ -0,0 +1,62 @@
+package repo_config
+
+import (
+	"strings"
+	"testing"
+)
+
+// the settings of imbere, as main reads them
+var imbereSecrets = []string{"IMBERE_WEBHOOK_SECRET", "IMBERE_GITHUB_PRIVATE_KEY", "IMBERE_SECRET_KEY", "IMBERE_API_TOKEN"}
+
+func TestEnvironHidesImbereSecrets(t *testing.T) {
+	for _, name := range imbereSecrets {
+		t.Setenv(name, "secret")
+	}
+	t.Setenv("DATABASE_URL", "postgres://preview")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("PATH", "/usr/bin:/bin")
+	t.Setenv("LC_ALL", "C.UTF-8")
+
+	config := Default()
+	config.RequiredEnv = []string{"DATABASE_URL"}
+	config.Env = map[string]string{"NODE_ENV": "production"}
+
+	environ := map[string]string{}
+	for _, variable := range config.Environ(3000) {
+		name, value, _ := strings.Cut(variable, "=")
+		environ[name] = value
+	}
+
+	for _, name := range append(imbereSecrets, "AWS_SECRET_ACCESS_KEY") {
+		if _, ok := environ[name]; ok {
+			t.Errorf("%s is given to the pipeline commands", name)
+		}
+	}
+
+	want := map[string]string{
+		"PATH":         "/usr/bin:/bin",
+		"LC_ALL":       "C.UTF-8",
+		"DATABASE_URL": "postgres://preview",
+		"NODE_ENV":     "production",
+		"PORT":         "3000",
+	}
+
+	for name, value := range want {
+		if environ[name] != value {
+			t.Errorf("%s = %q, want %q", name, environ[name], value)
+		}
+	}
+}
+
+func TestRequiredEnvCanNotAskForImbereSettings(t *testing.T) {
+	for _, name := range imbereSecrets {
+		t.Setenv(name, "secret")
+
+		config := Default()
+		config.RequiredEnv = []string{name}
+
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("Validate() with required_env %s = %v, want it refused", name, err)
+		}
+	}
+}
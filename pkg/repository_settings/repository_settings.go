@@ -0,0 +1,136 @@
+package repository_settings
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/credentials"
+	"github.com/rssb/imbere/pkg/db"
+	"github.com/rssb/imbere/pkg/deployment"
+	"github.com/rssb/imbere/pkg/utils"
+)
+
+// Body of the settings update, fields that are left out keep their current value
+type settingsRequest struct {
+	DeployOnPush   *bool   `json:"deploy_on_push"`
+	Deployer       *string `json:"deployer"`
+	IdleTTLMinutes *int    `json:"idle_ttl_minutes"`
+	CloneAuth      *string `json:"clone_auth"`
+	DeployKey      *string `json:"deploy_key"` // an empty key removes it
+	ForkPolicy     *string `json:"fork_policy"`
+}
+
+func HandleGetSettings(c *gin.Context) {
+	settingsRepo := db.RepositorySettingsRepo{}
+
+	settings, err := settingsRepo.Get(c.Param("owner"), c.Param("repo"))
+	if err != nil {
+		utils.ReturnError(c, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, settingsResponse(settings))
+}
+
+func HandleUpdateSettings(c *gin.Context) {
+	var request settingsRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		utils.ReturnError(c, err.Error())
+		return
+	}
+
+	settingsRepo := db.RepositorySettingsRepo{}
+
+	settings, err := settingsRepo.Get(c.Param("owner"), c.Param("repo"))
+	if err != nil {
+		utils.ReturnError(c, err.Error())
+		return
+	}
+
+	if request.DeployOnPush != nil {
+		settings.DeployOnPush = *request.DeployOnPush
+	}
+
+	if request.Deployer != nil {
+		if !deployment.IsValidDeployer(*request.Deployer) {
+			utils.ReturnError(c, fmt.Sprintf("unknown deployer %q, expected one of pm2, docker or process", *request.Deployer))
+			return
+		}
+
+		settings.Deployer = *request.Deployer
+	}
+
+	if request.IdleTTLMinutes != nil {
+		if *request.IdleTTLMinutes < 0 {
+			utils.ReturnError(c, "idle_ttl_minutes must be 0 (never sleep) or more")
+			return
+		}
+
+		settings.IdleTTLMinutes = *request.IdleTTLMinutes
+	}
+
+	if request.CloneAuth != nil {
+		if !credentials.IsValidCloneAuth(*request.CloneAuth) {
+			utils.ReturnError(c, fmt.Sprintf("unknown clone_auth %q, expected one of token, ssh or none", *request.CloneAuth))
+			return
+		}
+
+		settings.CloneAuth = *request.CloneAuth
+	}
+
+	if request.DeployKey != nil {
+		if *request.DeployKey != "" && !credentials.IsValidDeployKey(*request.DeployKey) {
+			utils.ReturnError(c, "deploy_key must be a private ssh key")
+			return
+		}
+
+		settings.DeployKey = *request.DeployKey
+	}
+
+	if request.ForkPolicy != nil {
+		if !isValidForkPolicy(*request.ForkPolicy) {
+			utils.ReturnError(c, fmt.Sprintf("unknown fork_policy %q, expected one of never, label or sandbox", *request.ForkPolicy))
+			return
+		}
+
+		settings.ForkPolicy = *request.ForkPolicy
+	}
+
+	if settings.GetCloneAuth() == constants.CLONE_AUTH_SSH && settings.DeployKey == "" {
+		utils.ReturnError(c, "clone_auth ssh needs a deploy_key")
+		return
+	}
+
+	if err := settingsRepo.Save(settings); err != nil {
+		utils.ReturnError(c, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, settingsResponse(settings))
+}
+
+func settingsResponse(settings *db.RepositorySettings) gin.H {
+	return gin.H{
+		"owner":            settings.OwnerName,
+		"repo":             settings.RepoName,
+		"deploy_on_push":   settings.DeployOnPush,
+		"deployer":         settings.GetDeployer(),
+		"idle_ttl_minutes": settings.IdleTTLMinutes,
+		"clone_auth":       settings.GetCloneAuth(),
+		"deploy_key_set":   settings.DeployKey != "",
+		"fork_policy":      settings.GetForkPolicy(),
+	}
+}
+
+// isValidForkPolicy tells if the policy is one of constants.FORK_POLICY_*
+func isValidForkPolicy(policy string) bool {
+	switch policy {
+	case constants.FORK_POLICY_NEVER, constants.FORK_POLICY_LABEL, constants.FORK_POLICY_SANDBOX:
+		return true
+	default:
+		return false
+	}
+}
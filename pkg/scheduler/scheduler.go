@@ -0,0 +1,190 @@
+package scheduler
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/rssb/imbere/pkg/config"
+)
+
+// Build is a deployment waiting for, or holding, a build slot
+type Build struct {
+	PrID           int64
+	Repository     string // owner/repo
+	InstallationID int64
+	Broken         bool // the previous deployment of the PR failed, it is fixed before other PRs are built
+
+	seq     uint64
+	granted bool
+	ahead   int           // builds waiting before this one, last sent on moves
+	ready   chan struct{} // closed once the build got its slot
+	moves   chan int      // the number of builds ahead, when it changes
+}
+
+// Scheduler limits how many PRs are built at the same time, on the whole host, per repository and per installation
+// of the github app (see config.ConcurrencyConfig). Builds get their slot in the order they asked for it,
+// the ones of broken PRs first, a build held back by the limit of its repository does not hold back the builds of other repositories.
+type Scheduler struct {
+	limits config.ConcurrencyConfig
+
+	mu             sync.Mutex
+	seq            uint64
+	waiting        []*Build
+	running        int
+	byRepository   map[string]int
+	byInstallation map[int64]int
+}
+
+func New(limits config.ConcurrencyConfig) *Scheduler {
+	return &Scheduler{
+		limits:         limits,
+		byRepository:   map[string]int{},
+		byInstallation: map[int64]int{},
+	}
+}
+
+// Acquire waits until the build can start, queued is called with the number of builds ahead of it whenever it changes
+// (it is not called when the build starts right away). release must be called once the build is done,
+// the wait stops with the error of ctx if it is cancelled first.
+func (scheduler *Scheduler) Acquire(ctx context.Context, build Build, queued func(ahead int)) (release func(), err error) {
+	waiting := &build
+	waiting.ready = make(chan struct{})
+	waiting.moves = make(chan int, 1)
+	waiting.ahead = -1
+
+	scheduler.mu.Lock()
+	scheduler.seq++
+	waiting.seq = scheduler.seq
+	scheduler.waiting = append(scheduler.waiting, waiting)
+	scheduler.dispatch()
+	scheduler.mu.Unlock()
+
+	release = func() {
+		scheduler.mu.Lock()
+		defer scheduler.mu.Unlock()
+
+		scheduler.finish(waiting)
+		scheduler.dispatch()
+	}
+
+	for {
+		select {
+		case <-waiting.ready:
+			return release, nil
+		case ahead := <-waiting.moves:
+			queued(ahead)
+		case <-ctx.Done():
+			scheduler.mu.Lock()
+			defer scheduler.mu.Unlock()
+
+			// the slot may have been given meanwhile
+			if waiting.granted {
+				scheduler.finish(waiting)
+			} else {
+				scheduler.remove(waiting)
+			}
+
+			scheduler.dispatch()
+
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// dispatch gives their slot to the waiting builds that fit within the limits,
+// and tells the others how many builds are ahead of them. It is called with the lock held.
+func (scheduler *Scheduler) dispatch() {
+	sort.SliceStable(scheduler.waiting, func(i, j int) bool {
+		a, b := scheduler.waiting[i], scheduler.waiting[j]
+		if a.Broken != b.Broken {
+			return a.Broken
+		}
+
+		return a.seq < b.seq
+	})
+
+	still := []*Build{}
+
+	for _, build := range scheduler.waiting {
+		if !scheduler.fits(build) {
+			still = append(still, build)
+			continue
+		}
+
+		build.granted = true
+		scheduler.running++
+		scheduler.byRepository[build.Repository]++
+		scheduler.byInstallation[build.InstallationID]++
+		close(build.ready)
+
+		log.Printf("build of PR ID: %d started, %d running", build.PrID, scheduler.running)
+	}
+
+	scheduler.waiting = still
+
+	for ahead, build := range scheduler.waiting {
+		if build.ahead == ahead {
+			continue
+		}
+
+		build.ahead = ahead
+
+		// only the latest position matters, the one that was not read yet is replaced
+		select {
+		case <-build.moves:
+		default:
+		}
+		build.moves <- ahead
+	}
+}
+
+// fits tells if the build can start without going over a limit, 0 means no limit
+func (scheduler *Scheduler) fits(build *Build) bool {
+	limits := scheduler.limits
+
+	if limits.MaxBuilds > 0 && scheduler.running >= limits.MaxBuilds {
+		return false
+	}
+
+	if limits.MaxBuildsPerRepository > 0 && scheduler.byRepository[build.Repository] >= limits.MaxBuildsPerRepository {
+		return false
+	}
+
+	if limits.MaxBuildsPerInstallation > 0 && scheduler.byInstallation[build.InstallationID] >= limits.MaxBuildsPerInstallation {
+		return false
+	}
+
+	return true
+}
+
+// finish frees the slot of a build, it is called with the lock held
+func (scheduler *Scheduler) finish(build *Build) {
+	if !build.granted {
+		return
+	}
+
+	build.granted = false
+	scheduler.running--
+	scheduler.byRepository[build.Repository]--
+	scheduler.byInstallation[build.InstallationID]--
+
+	if scheduler.byRepository[build.Repository] == 0 {
+		delete(scheduler.byRepository, build.Repository)
+	}
+
+	if scheduler.byInstallation[build.InstallationID] == 0 {
+		delete(scheduler.byInstallation, build.InstallationID)
+	}
+}
+
+// remove takes a build that is still waiting out of the queue, it is called with the lock held
+func (scheduler *Scheduler) remove(build *Build) {
+	for i, waiting := range scheduler.waiting {
+		if waiting == build {
+			scheduler.waiting = append(scheduler.waiting[:i], scheduler.waiting[i+1:]...)
+			return
+		}
+	}
+}
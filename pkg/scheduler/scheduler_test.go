@@ -0,0 +1,330 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rssb/imbere/pkg/config"
+	"github.com/rssb/imbere/pkg/constants"
+)
+
+// how long a test waits for the scheduler before failing
+const testTimeout = 5 * time.Second
+
+// pending is a build asking for its slot in the background
+type pending struct {
+	release chan func()
+	err     chan error
+	ahead   chan int
+}
+
+func acquire(ctx context.Context, scheduler *Scheduler, build Build) *pending {
+	waiting := &pending{
+		release: make(chan func(), 1),
+		err:     make(chan error, 1),
+		ahead:   make(chan int, 100),
+	}
+
+	go func() {
+		release, err := scheduler.Acquire(ctx, build, func(ahead int) { waiting.ahead <- ahead })
+		if err != nil {
+			waiting.err <- err
+			return
+		}
+
+		waiting.release <- release
+	}()
+
+	return waiting
+}
+
+// wait gives the release of the build if it started, or nil once it is queued
+func (waiting *pending) wait(t *testing.T) func() {
+	t.Helper()
+
+	select {
+	case release := <-waiting.release:
+		return release
+	case <-waiting.ahead:
+		return nil
+	case err := <-waiting.err:
+		t.Fatalf("Acquire() failed: %s", err)
+	case <-time.After(testTimeout):
+		t.Fatal("the build neither started nor was queued")
+	}
+
+	return nil
+}
+
+// started waits for the build to get its slot
+func (waiting *pending) started(t *testing.T) func() {
+	t.Helper()
+
+	select {
+	case release := <-waiting.release:
+		return release
+	case err := <-waiting.err:
+		t.Fatalf("Acquire() failed: %s", err)
+	case <-time.After(testTimeout):
+		t.Fatal("the build did not start")
+	}
+
+	return nil
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  config.ConcurrencyConfig
+		builds  []Build
+		started []int // the builds that start right away, the others are queued
+	}{
+		{
+			name:    "no limit",
+			builds:  []Build{{PrID: 1, Repository: "a/a"}, {PrID: 2, Repository: "a/a"}, {PrID: 3, Repository: "a/a"}},
+			started: []int{0, 1, 2},
+		},
+		{
+			name:    "global limit",
+			limits:  config.ConcurrencyConfig{MaxBuilds: 2},
+			builds:  []Build{{PrID: 1, Repository: "a/a"}, {PrID: 2, Repository: "b/b"}, {PrID: 3, Repository: "c/c"}},
+			started: []int{0, 1},
+		},
+		{
+			name:    "per repository limit",
+			limits:  config.ConcurrencyConfig{MaxBuildsPerRepository: 1},
+			builds:  []Build{{PrID: 1, Repository: "a/a"}, {PrID: 2, Repository: "a/a"}, {PrID: 3, Repository: "b/b"}},
+			started: []int{0, 2},
+		},
+		{
+			name:   "per installation limit",
+			limits: config.ConcurrencyConfig{MaxBuildsPerInstallation: 1},
+			builds: []Build{
+				{PrID: 1, Repository: "a/a", InstallationID: 1},
+				{PrID: 2, Repository: "a/b", InstallationID: 1},
+				{PrID: 3, Repository: "b/a", InstallationID: 2},
+			},
+			started: []int{0, 2},
+		},
+		{
+			name:    "a repository at its limit does not hold back the others",
+			limits:  config.ConcurrencyConfig{MaxBuilds: 2, MaxBuildsPerRepository: 1},
+			builds:  []Build{{PrID: 1, Repository: "a/a"}, {PrID: 2, Repository: "a/a"}, {PrID: 3, Repository: "b/b"}, {PrID: 4, Repository: "c/c"}},
+			started: []int{0, 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scheduler := New(test.limits)
+
+			started := []int{}
+			for i, build := range test.builds {
+				if release := acquire(context.Background(), scheduler, build).wait(t); release != nil {
+					started = append(started, i)
+					defer release()
+				}
+			}
+
+			if !reflect.DeepEqual(started, test.started) {
+				t.Errorf("started builds = %v, want %v", started, test.started)
+			}
+		})
+	}
+}
+
+func TestOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		queued []Build
+		want   []int64 // PRs in the order they are built
+	}{
+		{
+			name:   "first come first served",
+			queued: []Build{{PrID: 1}, {PrID: 2}, {PrID: 3}},
+			want:   []int64{1, 2, 3},
+		},
+		{
+			name:   "broken PRs first",
+			queued: []Build{{PrID: 1}, {PrID: 2, Broken: true}, {PrID: 3}, {PrID: 4, Broken: true}},
+			want:   []int64{2, 4, 1, 3},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scheduler := New(config.ConcurrencyConfig{MaxBuilds: 1})
+
+			running := acquire(context.Background(), scheduler, Build{PrID: 0}).started(t)
+
+			var (
+				mu     sync.Mutex
+				order  []int64
+				builds sync.WaitGroup
+			)
+
+			// only one build runs at a time and releases its slot once recorded, so they are recorded in the order they are built
+			for _, build := range test.queued {
+				builds.Add(1)
+				queued := make(chan struct{}, 1)
+
+				go func(build Build) {
+					defer builds.Done()
+
+					release, err := scheduler.Acquire(context.Background(), build, func(int) {
+						select {
+						case queued <- struct{}{}:
+						default:
+						}
+					})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					mu.Lock()
+					order = append(order, build.PrID)
+					mu.Unlock()
+
+					release()
+				}(build)
+
+				select {
+				case <-queued:
+				case <-time.After(testTimeout):
+					t.Fatalf("PR %d was not queued", build.PrID)
+				}
+			}
+
+			running()
+			builds.Wait()
+
+			if !reflect.DeepEqual(order, test.want) {
+				t.Errorf("build order = %v, want %v", order, test.want)
+			}
+		})
+	}
+}
+
+func TestCancelWhileQueued(t *testing.T) {
+	scheduler := New(config.ConcurrencyConfig{MaxBuilds: 1})
+
+	running := acquire(context.Background(), scheduler, Build{PrID: 1, Repository: "a/a"}).started(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := acquire(ctx, scheduler, Build{PrID: 2, Repository: "a/a"})
+	cancelled.wait(t)
+
+	next := acquire(context.Background(), scheduler, Build{PrID: 3, Repository: "a/a"})
+	next.wait(t)
+
+	cancel()
+
+	select {
+	case err := <-cancelled.err:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Acquire() of the cancelled build = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the cancelled build is still waiting")
+	}
+
+	// the cancelled build leaves the queue, the next one moves up
+	select {
+	case ahead := <-next.ahead:
+		if ahead != 0 {
+			t.Errorf("builds ahead of PR 3 = %d, want 0", ahead)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("PR 3 was not told it moved up")
+	}
+
+	running()
+	next.started(t)()
+
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	if scheduler.running != 0 || len(scheduler.waiting) != 0 || len(scheduler.byRepository) != 0 || len(scheduler.byInstallation) != 0 {
+		t.Errorf("slots left after every build is done: %d running, %d waiting, %v by repository, %v by installation",
+			scheduler.running, len(scheduler.waiting), scheduler.byRepository, scheduler.byInstallation)
+	}
+}
+
+// a build cancelled as it gets its slot frees it, whichever of the two Acquire sees first
+func TestCancelWhenGranted(t *testing.T) {
+	scheduler := New(config.ConcurrencyConfig{MaxBuilds: 1})
+
+	for i := 0; i < 50; i++ {
+		running := acquire(context.Background(), scheduler, Build{PrID: 1}).started(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelled := acquire(ctx, scheduler, Build{PrID: 2})
+		cancelled.wait(t)
+
+		cancel()
+		running()
+
+		select {
+		case release := <-cancelled.release:
+			release()
+		case <-cancelled.err:
+		case <-time.After(testTimeout):
+			t.Fatal("the cancelled build is still waiting")
+		}
+
+		if release := acquire(context.Background(), scheduler, Build{PrID: 3}).wait(t); release == nil {
+			t.Fatal("the slot of the cancelled build was not freed")
+		} else {
+			release()
+		}
+	}
+}
+
+// the job queue runs constants.JOB_WORKERS jobs at the same time, the builds among them stay within max_builds
+func TestMaxBuildsWithEveryWorkerDeploying(t *testing.T) {
+	scheduler := New(config.ConcurrencyConfig{MaxBuilds: config.DEFAULT_MAX_BUILDS})
+
+	var (
+		mu      sync.Mutex
+		current int
+		most    int
+		workers sync.WaitGroup
+	)
+
+	for worker := 0; worker < constants.JOB_WORKERS; worker++ {
+		workers.Add(1)
+
+		go func(prId int64) {
+			defer workers.Done()
+
+			release, err := scheduler.Acquire(context.Background(), Build{PrID: prId, Repository: "a/a"}, func(int) {})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer release()
+
+			mu.Lock()
+			current++
+			most = max(most, current)
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			current--
+			mu.Unlock()
+		}(int64(worker))
+	}
+
+	workers.Wait()
+
+	if most != config.DEFAULT_MAX_BUILDS {
+		t.Errorf("at most %d builds ran at the same time, want %d", most, config.DEFAULT_MAX_BUILDS)
+	}
+}
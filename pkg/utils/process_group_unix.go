@@ -0,0 +1,23 @@
+//go:build !windows
+
+package utils
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// SetProcessGroup makes the command the leader of a new process group,
+// so that its children (ie. the app started by `sh -c`) can be signaled with it.
+func SetProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// SignalProcessGroup sends the signal to the started command and all of its children
+func SignalProcessGroup(cmd *exec.Cmd, signal syscall.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+
+	return syscall.Kill(-cmd.Process.Pid, signal)
+}
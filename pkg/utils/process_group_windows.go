@@ -0,0 +1,21 @@
+//go:build windows
+
+package utils
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// SetProcessGroup is a no-op, process groups are not supported on windows
+func SetProcessGroup(cmd *exec.Cmd) {
+}
+
+// SignalProcessGroup can only kill the started command on windows, its children are left running
+func SignalProcessGroup(cmd *exec.Cmd, signal syscall.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+
+	return cmd.Process.Kill()
+}
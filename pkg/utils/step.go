@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/rssb/imbere/pkg/constants"
+)
+
+// how long a killed command gets to release its output, children that escaped its process group could keep it open
+const killWaitDelay = 5 * time.Second
+
+var (
+	ErrTimedOut  = errors.New("timed out")
+	ErrCancelled = errors.New("cancelled")
+)
+
+// KillProcessGroupOnCancel makes the command and everything it started (ie. the package manager run by `sh -c`)
+// killed when its context is done, only the shell would be otherwise.
+// The command must be created with exec.CommandContext.
+func KillProcessGroupOnCancel(cmd *exec.Cmd) {
+	SetProcessGroup(cmd)
+
+	cmd.Cancel = func() error {
+		return SignalProcessGroup(cmd, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = killWaitDelay
+}
+
+// StepError gives why a step that ran with ctx failed with err: a killed command only tells it was killed,
+// the error says instead if the step timed out or was cancelled, see StepOutcome
+func StepError(ctx context.Context, timeout time.Duration, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("%w after %s: %v", ErrTimedOut, timeout, err)
+	case context.Canceled:
+		return fmt.Errorf("%w: %v", ErrCancelled, err)
+	default:
+		return err
+	}
+}
+
+// StepOutcome gives the outcome of a step that failed with err
+func StepOutcome(err error) constants.ProcessOutcome {
+	switch {
+	case errors.Is(err, ErrTimedOut) || errors.Is(err, context.DeadlineExceeded):
+		return constants.PROCESS_OUTCOME_TIMED_OUT
+	case errors.Is(err, ErrCancelled) || errors.Is(err, context.Canceled):
+		return constants.PROCESS_OUTCOME_CANCELLED
+	default:
+		return constants.PROCESS_OUTCOME_FAILED
+	}
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rssb/imbere/pkg/constants"
+)
+
+func TestTimeoutKillsProcessGroup(t *testing.T) {
+	timeout := 200 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// the background sleep holds the output open, the command only returns before killWaitDelay if it is killed too
+	cmd := exec.CommandContext(ctx, "sh", "-c", "sleep 60 & echo $!; sleep 60")
+	KillProcessGroupOnCancel(cmd)
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+
+	started := time.Now()
+	err := StepError(ctx, timeout, cmd.Run())
+	elapsed := time.Since(started)
+
+	if elapsed >= killWaitDelay {
+		t.Errorf("the command returned after %s, its background child was not killed", elapsed)
+	}
+
+	if !errors.Is(err, ErrTimedOut) {
+		t.Errorf("StepError() = %v, want %v", err, ErrTimedOut)
+	}
+
+	if outcome := StepOutcome(err); outcome != constants.PROCESS_OUTCOME_TIMED_OUT {
+		t.Errorf("StepOutcome() = %v, want %v", outcome, constants.PROCESS_OUTCOME_TIMED_OUT)
+	}
+
+	child, convErr := strconv.Atoi(strings.TrimSpace(output.String()))
+	if convErr != nil {
+		t.Fatalf("could not read the pid of the background child from %q", output.String())
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); isRunning(child); {
+		if time.Now().After(deadline) {
+			t.Fatalf("the background child %d is still running", child)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// isRunning tells if the process exists and is not a zombie waiting to be reaped
+func isRunning(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+
+	// the state follows the command name, which is in parentheses
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestStepOutcome(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  func() context.Context
+		err  error
+		want constants.ProcessOutcome
+	}{
+		{
+			name: "failure",
+			ctx:  context.Background,
+			err:  errors.New("exit status 1"),
+			want: constants.PROCESS_OUTCOME_FAILED,
+		},
+		{
+			name: "timeout",
+			ctx: func() context.Context {
+				ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+				cancel()
+				return ctx
+			},
+			err:  errors.New("signal: killed"),
+			want: constants.PROCESS_OUTCOME_TIMED_OUT,
+		},
+		{
+			name: "cancel",
+			ctx: func() context.Context {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return ctx
+			},
+			err:  errors.New("signal: killed"),
+			want: constants.PROCESS_OUTCOME_CANCELLED,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := StepOutcome(StepError(test.ctx(), time.Minute, test.err)); got != test.want {
+				t.Errorf("StepOutcome() = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if err := StepError(context.Background(), time.Minute, nil); err != nil {
+		t.Errorf("StepError() of a step that went through = %v, want nil", err)
+	}
+}
@@ -1,10 +1,13 @@
 package utils
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"runtime/debug"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	md "github.com/nao1215/markdown"
@@ -17,10 +20,27 @@ func ReturnError(c *gin.Context, message string) {
 		"message": message,
 	})
 	debug.PrintStack()
-	fmt.Println("Error occured %+v\n", message)
+	fmt.Printf("Error occured %+v\n", message)
 
 }
 
+// RequireToken protects the management endpoints, requests must send the configured token
+// as "Authorization: Bearer <token>". When no token is configured every request is rejected.
+func RequireToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sent := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+		if token == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"message": "unauthorized",
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
 func GetFreePort() (int32, error) {
 	port, err := freeport.GetFreePort()
 	if err != nil {
@@ -33,32 +53,84 @@ func GetFreePort() (int32, error) {
 	return int32(port), nil
 }
 
+// ShortSHA gives the abbreviated commit sha, as github shows it
+func ShortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+
+	return sha
+}
+
+// IsPortFree tells if nothing listens on the port yet
+func IsPortFree(port int32) bool {
+	if port == 0 {
+		return false
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return false
+	}
+
+	listener.Close()
+
+	return true
+}
+
+
+// Steps of a deployment in the order they happen
+var PROGRESS_STEPS = []constants.ProcessProgress{
+	constants.PROCESS_PROGRESS_STARTED,
+	constants.PROCESS_PROGRESS_PREPARING_DIR,
+	constants.PROCESS_PROGRESS_PULLING_CHANGES,
+	constants.PROCESS_PROGRESS_LOADING_CONFIG,
+	constants.PROCESS_PROGRESS_INSTALLING_DEPENDENCIES,
+	constants.PROCESS_PROGRESS_BUILDING_PROJECT,
+	constants.PROCESS_PROGRESS_DEPLOYING,
+	constants.PROCESS_PROGRESS_VERIFYING,
+	constants.PROCESS_PROGRESS_COMPLETED,
+}
+
+// GetProgressStepIndex gives the position of the step in the pipeline, or -1 if it is not part of it
+func GetProgressStepIndex(step constants.ProcessProgress) int {
+	for index, progressStep := range PROGRESS_STEPS {
+		if progressStep == step {
+			return index
+		}
+	}
+
+	return -1
+}
 
 func ParseProgressToMD(progress constants.ProcessProgress, outcome constants.ProcessOutcome) *md.Markdown {
 	markdown := md.NewMarkdown(nil)
 	markdown.H3("Progress Status")
 
-	progressSteps := []constants.ProcessProgress{
-		constants.PROCESS_PROGRESS_STARTED,
-		constants.PROCESS_PROGRESS_PREPARING_DIR,
-		constants.PROCESS_PROGRESS_PULLING_CHANGES,
-		constants.PROCESS_PROGRESS_INSTALLING_DEPENDENCIES,
-		constants.PROCESS_PROGRESS_BUILDING_PROJECT,
-		constants.PROCESS_PROGRESS_DEPLOYING,
-		constants.PROCESS_PROGRESS_COMPLETED,
+	progressIndex := GetProgressStepIndex(progress)
+
+	// steps outside of the pipeline (ie. un deploying) happen after it
+	if progressIndex == -1 {
+		progressIndex = len(PROGRESS_STEPS)
 	}
 
-	for _, step := range progressSteps {
+	for index, step := range PROGRESS_STEPS {
 		if step == progress {
 			switch outcome {
 			case constants.PROCESS_OUTCOME_SUCCEEDED:
 				markdown.PlainTextf(fmt.Sprintf("✅ %s", GetProgressStepName(step)))
 			case constants.PROCESS_OUTCOME_FAILED:
 				markdown.PlainTextf(fmt.Sprintf("❌ %s", GetProgressStepName(step)))
+			case constants.PROCESS_OUTCOME_TIMED_OUT:
+				markdown.PlainTextf(fmt.Sprintf("⌛ %s (timed out)", GetProgressStepName(step)))
+			case constants.PROCESS_OUTCOME_CANCELLED:
+				markdown.PlainTextf(fmt.Sprintf("🚫 %s (cancelled)", GetProgressStepName(step)))
 			case constants.PROCESS_OUTCOME_ONGOING:
 				markdown.PlainTextf(fmt.Sprintf("⏳ %s", GetProgressStepName(step)))
+			case constants.PROCESS_OUTCOME_NOT_YET:
+				markdown.PlainTextf(fmt.Sprintf("⚪ %s", GetProgressStepName(step)))
 			}
-		} else if step < progress {
+		} else if index < progressIndex {
 			markdown.PlainTextf(fmt.Sprintf("✅ %s", GetProgressStepName(step)))
 		} else {
 			markdown.PlainTextf(fmt.Sprintf("⚪ %s", GetProgressStepName(step)))
@@ -76,15 +148,47 @@ func GetProgressStepName(step constants.ProcessProgress) string {
 		return "Preparing Directory"
 	case constants.PROCESS_PROGRESS_PULLING_CHANGES:
 		return "Pulling Changes"
+	case constants.PROCESS_PROGRESS_LOADING_CONFIG:
+		return "Loading Configuration"
 	case constants.PROCESS_PROGRESS_INSTALLING_DEPENDENCIES:
 		return "Installing Dependencies"
 	case constants.PROCESS_PROGRESS_BUILDING_PROJECT:
 		return "Building Project"
 	case constants.PROCESS_PROGRESS_DEPLOYING:
 		return "Deploying"
+	case constants.PROCESS_PROGRESS_VERIFYING:
+		return "Verifying"
 	case constants.PROCESS_PROGRESS_COMPLETED:
 		return "Completed"
+	case constants.PROCESS_PROGRESS_UN_DEPLOYING:
+		return "Un Deploying"
+	case constants.PROCESS_PROGRESS_SLEEPING:
+		return "Sleeping"
 	default:
 		return "Unknown"
 	}
 }
+
+func GetOutcomeName(outcome constants.ProcessOutcome) string {
+	switch outcome {
+	case constants.PROCESS_OUTCOME_NOT_YET:
+		return "not_yet"
+	case constants.PROCESS_OUTCOME_ONGOING:
+		return "ongoing"
+	case constants.PROCESS_OUTCOME_SUCCEEDED:
+		return "succeeded"
+	case constants.PROCESS_OUTCOME_FAILED:
+		return "failed"
+	case constants.PROCESS_OUTCOME_TIMED_OUT:
+		return "timed_out"
+	case constants.PROCESS_OUTCOME_CANCELLED:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
+
+// IsOutcomeFailure tells if the step did not go through, whether it failed, timed out or was cancelled
+func IsOutcomeFailure(outcome constants.ProcessOutcome) bool {
+	return outcome == constants.PROCESS_OUTCOME_FAILED || outcome == constants.PROCESS_OUTCOME_TIMED_OUT || outcome == constants.PROCESS_OUTCOME_CANCELLED
+}
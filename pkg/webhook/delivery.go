@@ -0,0 +1,61 @@
+package webhook
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+	"github.com/rssb/imbere/pkg/utils"
+)
+
+const deliveryHeader = "X-GitHub-Delivery"
+
+// HandleGetDelivery exposes what happened to a webhook delivery, identified by its X-GitHub-Delivery id.
+func HandleGetDelivery(c *gin.Context) {
+	deliveryRepo := db.DeliveryRepo{}
+
+	delivery, err := deliveryRepo.GetByDeliveryID(c.Param("id"))
+	if err != nil {
+		utils.ReturnError(c, err.Error())
+		return
+	}
+
+	if delivery == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "delivery not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, deliveryResponse(delivery))
+}
+
+func deliveryResponse(delivery *db.Delivery) gin.H {
+	return gin.H{
+		"delivery_id": delivery.DeliveryID,
+		"event":       delivery.EventName + "." + delivery.EventAction,
+		"pr_id":       delivery.PrID,
+		"job_id":      delivery.JobID,
+		"outcome":     getDeliveryOutcomeName(delivery.Outcome),
+		"message":     delivery.Message,
+		"received_at": delivery.CreatedAt,
+	}
+}
+
+func getDeliveryOutcomeName(outcome constants.DeliveryOutcome) string {
+	switch outcome {
+	case constants.DELIVERY_OUTCOME_IGNORED:
+		return "ignored"
+	case constants.DELIVERY_OUTCOME_QUEUED:
+		return "queued"
+	case constants.DELIVERY_OUTCOME_SUCCEEDED:
+		return "succeeded"
+	case constants.DELIVERY_OUTCOME_FAILED:
+		return "failed"
+	case constants.DELIVERY_OUTCOME_CANCELLED:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
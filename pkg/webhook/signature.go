@@ -0,0 +1,99 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const signatureHeader = "X-Hub-Signature-256"
+const signaturePrefix = "sha256="
+
+// VerifySignature returns a middleware that checks the X-Hub-Signature-256 header of every delivery
+// against the configured webhook secrets before anything else touches the payload.
+// More than one secret can be given to support rotation, a delivery is accepted if it was signed with any of them
+// (ie. the current secret and the previous one while github is being switched over).
+// The raw body is kept in the context so that the handler can parse exactly what was verified.
+func VerifySignature(secrets ...string) gin.HandlerFunc {
+	configuredSecrets := []string{}
+	for _, secret := range secrets {
+		if secret != "" {
+			configuredSecrets = append(configuredSecrets, secret)
+		}
+	}
+
+	if len(configuredSecrets) == 0 {
+		log.Printf("no webhook secret is configured, every github delivery will be rejected")
+	}
+
+	return func(c *gin.Context) {
+		body, err := c.GetRawData()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"message": "could not read request body",
+			})
+			return
+		}
+
+		if err := checkSignature(body, c.GetHeader(signatureHeader), configuredSecrets); err != nil {
+			log.Printf("rejected github delivery %s: %s", c.GetHeader("X-GitHub-Delivery"), err)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"message": err.Error(),
+			})
+			return
+		}
+
+		c.Set(gin.BodyBytesKey, body)
+		c.Next()
+	}
+}
+
+// checkSignature compares the signature sent by github with the HMAC-SHA256 of the body
+// computed with each of the secrets, in constant time.
+func checkSignature(body []byte, signature string, secrets []string) error {
+	if len(secrets) == 0 {
+		return errors.New("webhook secret is not configured")
+	}
+
+	if signature == "" {
+		return errors.New("missing " + signatureHeader + " header")
+	}
+
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return errors.New("unsupported signature format")
+	}
+
+	sent, err := hex.DecodeString(strings.TrimPrefix(signature, signaturePrefix))
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+
+		if hmac.Equal(sent, mac.Sum(nil)) {
+			return nil
+		}
+	}
+
+	return errors.New("signature does not match")
+}
+
+// rawBody returns the body verified by VerifySignature, falling back to reading the request
+// when the middleware was not mounted.
+func rawBody(c *gin.Context) ([]byte, error) {
+	if body, ok := c.Get(gin.BodyBytesKey); ok {
+		if bytes, ok := body.([]byte); ok {
+			return bytes, nil
+		}
+	}
+
+	return c.GetRawData()
+}
@@ -0,0 +1,123 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestCheckSignature(t *testing.T) {
+	body := []byte(`{"action":"opened"}`)
+
+	tests := []struct {
+		name      string
+		signature string
+		secrets   []string
+		valid     bool
+	}{
+		{"signed with the secret", sign("current", body), []string{"current"}, true},
+		{"signed with the previous secret during rotation", sign("previous", body), []string{"current", "previous"}, true},
+		{"missing header", "", []string{"current"}, false},
+		{"sha1 signature", "sha1=" + hex.EncodeToString(make([]byte, 20)), []string{"current"}, false},
+		{"prefix only", signaturePrefix, []string{"current"}, false},
+		{"not hex", signaturePrefix + "zz", []string{"current"}, false},
+		{"signed with another secret", sign("other", body), []string{"current", "previous"}, false},
+		{"signature of another body", sign("current", []byte(`{"action":"closed"}`)), []string{"current"}, false},
+		{"no secret configured", sign("", body), nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkSignature(body, test.signature, test.secrets)
+
+			if test.valid && err != nil {
+				t.Errorf("checkSignature() = %v, want the delivery accepted", err)
+			}
+
+			if !test.valid && err == nil {
+				t.Error("checkSignature() accepted the delivery")
+			}
+		})
+	}
+}
+
+// the signature is of the bytes github sent, a body parsed and encoded again would not match it
+func TestVerifySignatureHashesTheRawBody(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// spacing and key order json.Marshal would change
+	body := []byte("{ \"zen\" : \"Keep it simple\",\n  \"action\" : \"opened\" }")
+
+	var received []byte
+	var payload struct {
+		Action string `json:"action"`
+	}
+
+	router := gin.New()
+	router.POST("/webhook", VerifySignature("current", "previous"), func(c *gin.Context) {
+		var err error
+		if received, err = rawBody(c); err != nil {
+			t.Error(err)
+		}
+
+		if err := json.Unmarshal(received, &payload); err != nil {
+			t.Error(err)
+		}
+
+		c.Status(http.StatusAccepted)
+	})
+
+	tests := []struct {
+		name      string
+		signature string
+		want      int
+	}{
+		{"signed", sign("current", body), http.StatusAccepted},
+		{"signed with the previous secret", sign("previous", body), http.StatusAccepted},
+		{"unsigned", "", http.StatusUnauthorized},
+		{"signature of the re-encoded body", sign("current", []byte(`{"action":"opened","zen":"Keep it simple"}`)), http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			received, payload.Action = nil, ""
+
+			request := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+			if test.signature != "" {
+				request.Header.Set(signatureHeader, test.signature)
+			}
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.want {
+				t.Fatalf("status = %d, want %d", recorder.Code, test.want)
+			}
+
+			if test.want != http.StatusAccepted {
+				if received != nil {
+					t.Error("the handler ran for a delivery that was rejected")
+				}
+				return
+			}
+
+			if !bytes.Equal(received, body) || payload.Action != "opened" {
+				t.Errorf("the handler got %q (action %q), want the body that was verified", received, payload.Action)
+			}
+		})
+	}
+}
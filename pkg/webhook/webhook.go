@@ -1,54 +1,148 @@
 package webhook
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rssb/imbere/pkg/constants"
+	"github.com/rssb/imbere/pkg/db"
+	"github.com/rssb/imbere/pkg/job_queue"
 	"github.com/rssb/imbere/pkg/pull_request"
 	"github.com/rssb/imbere/pkg/utils"
 )
 
 // HandleWebhook is the main entry point for handling incoming github webhooks.
-// It parses the payload, extracts the event type, and handles the event if it's one of the supported types.
-// If the event is handled, it creates a PullRequest from the payload, and then pulls the changes(which later triggers deployment).
-// If the event is not handled, it simply returns a 202 Accepted response.
-func HandleWebhook(c *gin.Context) {
-	var payload map[string]any
+// It expects the delivery to have gone through VerifySignature first.
+// It parses the payload, extracts the event type, and if it's one of the supported types the event is queued
+// to be handled by the job queue(which later pulls the changes and triggers deployment), github does not wait for minutes long builds.
+// Either way it returns a 202 Accepted response, unless the delivery was already received in which case
+// it answers with the recorded outcome of the original delivery.
+func HandleWebhook(queue *job_queue.JobQueue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var payload map[string]any
+
+		body, err := rawBody(c)
+		if err != nil {
+			utils.ReturnError(c, err.Error())
+			return
+		}
 
-	if err := c.ShouldBindJSON(&payload); err != nil {
+		if err := json.Unmarshal(body, &payload); err != nil {
+			utils.ReturnError(c, err.Error())
+			return
+		}
 
-		utils.ReturnError(c, err.Error())
-	}
+		// get event type
+		event, err := pull_request.ExtractEventType(c, payload)
 
-	// get event type
-	event, err := pull_request.ExtractEventType(c, payload)
+		if err != nil {
+			utils.ReturnError(c, err.Error())
+			return
+		}
 
-	if err != nil {
-		utils.ReturnError(c, err.Error())
-		return
-	}
+		nameAction := event.GetNameAction()
 
-	nameAction := event.GetNameAction()
+		fmt.Println(nameAction)
 
-	fmt.Println(nameAction)
+		isHandledEVentAction := constants.ALLOWED_EVENT_ACTIONS[nameAction]
 
-	isHandledEVentAction := constants.ALLOWED_EVENT_ACTIONS[nameAction]
+		// most comments are not for imbere, and commands on PRs imbere never saw have nothing to act on
+		if isHandledEVentAction && event.GetName() == "issue_comment" {
+			_, err := pull_request.ExtractPRID(event, payload)
+			isHandledEVentAction = pull_request.ExtractCommand(event, payload) != "" && err == nil
+		}
 
-	if isHandledEVentAction {
+		var prId int64
+		if isHandledEVentAction {
+			prId, err = pull_request.ExtractPRID(event, payload)
+			if err != nil {
+				utils.ReturnError(c, err.Error())
+				return
+			}
+		}
 
-		err := pull_request.HandlePR(event, payload)
+		deliveryRepo := db.DeliveryRepo{}
+		delivery := &db.Delivery{
+			DeliveryID:  c.GetHeader(deliveryHeader),
+			EventName:   event.GetName(),
+			EventAction: event.GetAction(),
+			PrID:        prId,
+			Outcome:     constants.DELIVERY_OUTCOME_IGNORED,
+		}
 
-		if err != nil {
-			utils.ReturnError(c, err.Error())
+		if isHandledEVentAction {
+			delivery.Outcome = constants.DELIVERY_OUTCOME_QUEUED
 		}
 
-	}
+		// github redelivers events it thinks were not received, every delivery is recorded
+		// and a redelivery is answered with what happened to the original one instead of being processed again
+		if delivery.DeliveryID != "" {
+			recorded, isNew, err := deliveryRepo.Record(delivery)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"message": err.Error(),
+				})
+				return
+			}
+
+			if !isNew {
+				response := deliveryResponse(recorded)
+				response["duplicate"] = true
+
+				c.JSON(http.StatusOK, response)
+				return
+			}
+		}
+
+		if !isHandledEVentAction {
+			c.JSON(http.StatusAccepted, gin.H{
+				"message": "event ignored",
+			})
+			return
+		}
+
+		// not every event is about a commit (ie. label changes on old PRs), the sha is only used to cancel outdated builds
+		headSha, _ := pull_request.ExtractHeadSHA(event, payload)
 
-	c.JSON(http.StatusAccepted, gin.H{
-		"message": "not yet started",
-	})
+		job := &db.Job{
+			PrID:        prId,
+			DeliveryID:  delivery.DeliveryID,
+			HeadSHA:     headSha,
+			EventName:   event.GetName(),
+			EventAction: event.GetAction(),
+			Payload:     string(body),
+		}
+
+		if err := queue.Enqueue(job); err != nil {
+			// forget about the delivery so that it is processed when github redelivers it
+			if delivery.DeliveryID != "" {
+				deliveryRepo.Forget(delivery)
+			}
+
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": err.Error(),
+			})
+			return
+		}
+
+		if pull_request.IsNewPush(event, payload) {
+			queue.CancelOutdated(prId, headSha)
+		}
+
+		if delivery.DeliveryID != "" {
+			if err := deliveryRepo.SetJob(delivery, job.ID); err != nil {
+				log.Printf("could not link delivery %s to job %d: %s", delivery.DeliveryID, job.ID, err)
+			}
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "event queued",
+			"job_id":  job.ID,
+		})
+	}
 }
 
 // PULL REQUESTS
@@ -84,9 +178,13 @@ func HandleWebhook(c *gin.Context) {
 // pull_request.opened OR pull_request.reopened
 // 		CREATE A RECORD IN DB WITH NECESSARY INFORMATION FOR THE PR
 
+// pull_request.synchronize OR pull_request.edited (base branch changed)
+// 		UPDATE HEAD SHA, CANCEL BUILDS OF OLDER COMMITS
+// 		IF REPO DEPLOYS ON PUSH AND PR WAS LABELED 'IMBERE_DEPLOY', DEPLOY
+
 // workflow_run.completed
 // 		UPDATE DB WITH WORKFLOW STATUS 0 or 1, meaning succeeded or not
-// 		IF PR WAS LABELED 'IMBERE_DEPLOY' , DEPLOY
+// 		IF PR WAS LABELED 'IMBERE_DEPLOY' AND REPO DOES NOT DEPLOY ON PUSH, DEPLOY
 
 // pull_request.labeled
 // 		UPDATE DB LABELED TO DEPLOY